@@ -0,0 +1,104 @@
+package api
+
+import (
+	"PiliPili_Frontend/logger"
+	"PiliPili_Frontend/util"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// AlistAPI provides methods to interact with the Alist / OpenList API.
+type AlistAPI struct {
+	AlistURL string
+	Token    string
+	Client   *http.Client
+}
+
+// NewAlistAPI initializes a new AlistAPI instance for the given server and token.
+func NewAlistAPI(alistURL, token string) *AlistAPI {
+	return &AlistAPI{
+		AlistURL: util.BuildFullURL(alistURL, 0),
+		Token:    token,
+		Client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// GetRawURL resolves the direct link of a file through the Alist /api/fs/get API.
+// The password is only needed for folders protected by a meta password.
+func (api *AlistAPI) GetRawURL(path, password string) (string, error) {
+	url := fmt.Sprintf("%s/api/fs/get", api.AlistURL)
+
+	logger.Info("Fetching raw URL from Alist: %s (%s)", url, path)
+
+	requestBody, err := json.Marshal(map[string]string{
+		"path":     path,
+		"password": password,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(requestBody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if api.Token != "" {
+		req.Header.Set("Authorization", api.Token)
+	}
+
+	resp, err := api.Client.Do(req)
+	if err != nil {
+		logger.Error("Failed to fetch raw URL: %v", err)
+		return "", err
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Error("Failed to close response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		logger.Error("Received non-200 response from Alist: %d", resp.StatusCode)
+		return "", errors.New("failed to fetch raw URL")
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		logger.Error("Error reading response body: %v", err)
+		return "", err
+	}
+
+	// Alist reports errors in the body with HTTP 200 and a non-200 code.
+	var result struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Data    struct {
+			RawURL string `json:"raw_url"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		logger.Error("Error parsing JSON response: %v", err)
+		return "", err
+	}
+
+	if result.Code != http.StatusOK {
+		logger.Error("Alist returned code %d: %s", result.Code, result.Message)
+		return "", fmt.Errorf("alist error %d: %s", result.Code, result.Message)
+	}
+	if result.Data.RawURL == "" {
+		logger.Warn("Alist returned no raw URL for: %s", path)
+		return "", errors.New("raw URL not found")
+	}
+
+	logger.Debug("Found raw URL: %s", result.Data.RawURL)
+	return result.Data.RawURL, nil
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestAlist starts an Alist stub accepting the token "alist-token". It serves the file
+// /115/movie.mkv, the file /locked/movie.mkv behind the meta password "secret", and a few broken paths.
+func newTestAlist(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/fs/get" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected Alist request: %s %s (%s)", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var request struct {
+			Path     string `json:"path"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// Like Alist, failures are reported with HTTP 200 and the code in the body.
+		reply := func(code int, message, rawURL string) {
+			fmt.Fprintf(w, `{"code":%d,"message":%q,"data":{"name":"movie.mkv","raw_url":%q}}`, code, message, rawURL)
+		}
+		switch {
+		case r.Header.Get("Authorization") != "alist-token":
+			reply(http.StatusUnauthorized, "token is invalidated", "")
+		case request.Path == "/115/movie.mkv":
+			reply(http.StatusOK, "success", "https://cdn.115.com/movie.mkv?t=1")
+		case request.Path == "/locked/movie.mkv" && request.Password == "secret":
+			reply(http.StatusOK, "success", "https://cdn.115.com/locked.mkv?t=1")
+		case request.Path == "/locked/movie.mkv":
+			reply(http.StatusForbidden, "password is incorrect or you have no permission", "")
+		case request.Path == "/local/movie.mkv":
+			reply(http.StatusOK, "success", "")
+		case request.Path == "/broken/movie.mkv":
+			w.WriteHeader(http.StatusBadGateway)
+		case request.Path == "/garbage/movie.mkv":
+			fmt.Fprint(w, "<html>")
+		default:
+			reply(http.StatusInternalServerError, "object not found", "")
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestAlistGetRawURL(t *testing.T) {
+	alistURL := newTestAlist(t)
+
+	tests := []struct {
+		name     string
+		token    string
+		path     string
+		password string
+		want     string // Empty when the lookup fails
+	}{
+		{name: "file", token: "alist-token", path: "/115/movie.mkv", want: "https://cdn.115.com/movie.mkv?t=1"},
+		{name: "meta password", token: "alist-token", path: "/locked/movie.mkv", password: "secret", want: "https://cdn.115.com/locked.mkv?t=1"},
+		{name: "wrong meta password", token: "alist-token", path: "/locked/movie.mkv", password: "guess"},
+		{name: "invalid token", token: "expired-token", path: "/115/movie.mkv"},
+		{name: "missing token", path: "/115/movie.mkv"},
+		{name: "missing file", token: "alist-token", path: "/115/missing.mkv"},
+		{name: "no raw url", token: "alist-token", path: "/local/movie.mkv"},
+		{name: "http failure", token: "alist-token", path: "/broken/movie.mkv"},
+		{name: "invalid json", token: "alist-token", path: "/garbage/movie.mkv"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rawURL, err := NewAlistAPI(alistURL, test.token).GetRawURL(test.path, test.password)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("GetRawURL(%q) returned %q, want an error", test.path, rawURL)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetRawURL returned error: %v", err)
+			}
+			if rawURL != test.want {
+				t.Errorf("GetRawURL(%q)\n got: %s\nwant: %s", test.path, rawURL, test.want)
+			}
+		})
+	}
+}
+
+func TestAlistGetRawURLUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	if _, err := NewAlistAPI(server.URL, "alist-token").GetRawURL("/115/movie.mkv", ""); err == nil {
+		t.Error("GetRawURL against a closed server returned no error")
+	}
+}
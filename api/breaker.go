@@ -0,0 +1,68 @@
+package api
+
+import (
+	"PiliPili_Frontend/logger"
+	"sync"
+	"time"
+)
+
+// circuitBreaker fails media server requests fast once threshold requests in a row have failed.
+// After cooldown a single request probes the media server: its success closes the breaker,
+// its failure keeps it open for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int // 0 disables the breaker
+	cooldown  time.Duration
+	failures  int       // Consecutive failed requests
+	openedAt  time.Time // Zero while the breaker is closed
+	probing   bool      // A probe request is in flight
+}
+
+// allow reports whether a request may be sent to the media server now.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 || b.openedAt.IsZero() {
+		return true
+	}
+	if b.probing || now.Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// success records a request the media server answered.
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.openedAt.IsZero() {
+		logger.Info("Media server is answering again, closing the circuit breaker")
+	}
+	b.failures, b.openedAt, b.probing = 0, time.Time{}, false
+}
+
+// failure records a request that failed with a transient error.
+func (b *circuitBreaker) failure(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.threshold <= 0 || (!b.probing && b.failures < b.threshold) {
+		return
+	}
+	if b.openedAt.IsZero() {
+		logger.Warn("Media server failed %d requests in a row, opening the circuit breaker for %v", b.failures, b.cooldown)
+	}
+	b.openedAt, b.probing = now, false
+}
+
+// abandon records a request that ended without telling whether the media server is healthy,
+// e.g. because the client went away, so that another request can probe it.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
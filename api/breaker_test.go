@@ -0,0 +1,81 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 3, cooldown: 30 * time.Second}
+	start := time.Unix(1800000000, 0)
+
+	// Closed: failures below the threshold let requests through.
+	for i := 0; i < 2; i++ {
+		breaker.failure(start)
+		if !breaker.allow(start) {
+			t.Fatalf("Breaker opened after %d failures, threshold is 3", i+1)
+		}
+	}
+	breaker.success()
+	breaker.failure(start)
+	breaker.failure(start)
+	if !breaker.allow(start) {
+		t.Fatal("A success did not reset the failure count")
+	}
+
+	// Open: the third failure in a row fails requests fast until the cooldown is over.
+	breaker.failure(start)
+	if breaker.allow(start.Add(29 * time.Second)) {
+		t.Fatal("Breaker let a request through during the cooldown")
+	}
+
+	// Half-open: a single probe goes out, and its failure reopens the breaker for another cooldown.
+	probeAt := start.Add(30 * time.Second)
+	if !breaker.allow(probeAt) {
+		t.Fatal("Breaker did not let a probe through after the cooldown")
+	}
+	if breaker.allow(probeAt) {
+		t.Fatal("Breaker let a second request through while probing")
+	}
+	breaker.failure(probeAt)
+	if breaker.allow(probeAt.Add(29 * time.Second)) {
+		t.Fatal("A failed probe did not reopen the breaker")
+	}
+
+	// A successful probe closes the breaker.
+	probeAt = probeAt.Add(30 * time.Second)
+	if !breaker.allow(probeAt) {
+		t.Fatal("Breaker did not let a probe through after the second cooldown")
+	}
+	breaker.success()
+	for i := 0; i < 3; i++ {
+		if !breaker.allow(probeAt) {
+			t.Fatal("Breaker stayed open after a successful probe")
+		}
+	}
+}
+
+func TestCircuitBreakerAbandonedProbe(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 1, cooldown: time.Second}
+	start := time.Unix(1800000000, 0)
+
+	breaker.failure(start)
+	if !breaker.allow(start.Add(time.Second)) {
+		t.Fatal("Breaker did not let a probe through after the cooldown")
+	}
+	breaker.abandon()
+	if !breaker.allow(start.Add(time.Second)) {
+		t.Error("An abandoned probe kept other requests from probing")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 0}
+	now := time.Unix(1800000000, 0)
+	for i := 0; i < 100; i++ {
+		breaker.failure(now)
+	}
+	if !breaker.allow(now) {
+		t.Error("A breaker with threshold 0 opened")
+	}
+}
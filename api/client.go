@@ -0,0 +1,129 @@
+package api
+
+import (
+	"PiliPili_Frontend/config"
+	"PiliPili_Frontend/logger"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+)
+
+// mediaServerTransport pools the connections to the media server. Every Emby and Jellyfin
+// API instance shares it, so that bursts of lookups reuse warm connections instead of each
+// dialing and handshaking on its own.
+var mediaServerTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   32,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   5 * time.Second,
+	ResponseHeaderTimeout: 10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// mediaServerClient is the HTTP client shared by the media server APIs.
+var mediaServerClient = &http.Client{
+	Transport: mediaServerTransport,
+	Timeout:   10 * time.Second,
+}
+
+// retryPolicy controls how failed idempotent media server requests are retried.
+type retryPolicy struct {
+	retries    int
+	backoff    time.Duration // Delay before the first retry
+	maxBackoff time.Duration
+}
+
+var (
+	mediaServerRetries = retryPolicy{retries: 2, backoff: 200 * time.Millisecond, maxBackoff: 2 * time.Second}
+	mediaServerBreaker = &circuitBreaker{threshold: 5, cooldown: 30 * time.Second}
+)
+
+// InitializeMediaServerClient applies the configured retries and circuit breaker of media server requests.
+func InitializeMediaServerClient() error {
+	cfg := config.GetConfig()
+	if cfg.EmbyRetries < 0 || cfg.EmbyRetryBackoff < 0 || cfg.EmbyRetryMaxBackoff < 0 {
+		return errors.New("emby retries and retry backoff must not be negative")
+	}
+	if cfg.EmbyBreakerThreshold > 0 && cfg.EmbyBreakerCooldown <= 0 {
+		return errors.New("emby breaker cooldown must be positive")
+	}
+
+	mediaServerRetries = retryPolicy{
+		retries:    cfg.EmbyRetries,
+		backoff:    time.Duration(cfg.EmbyRetryBackoff) * time.Millisecond,
+		maxBackoff: time.Duration(cfg.EmbyRetryMaxBackoff) * time.Millisecond,
+	}
+	mediaServerBreaker = &circuitBreaker{
+		threshold: cfg.EmbyBreakerThreshold,
+		cooldown:  time.Duration(cfg.EmbyBreakerCooldown) * time.Second,
+	}
+	return nil
+}
+
+// delay returns the jittered backoff before the given retry, counted from 1. The exponential
+// delay is capped and then drawn uniformly from its upper half, so that clients that failed
+// together do not retry together.
+func (p retryPolicy) delay(retry int) time.Duration {
+	delay := p.backoff << (retry - 1)
+	if delay > p.maxBackoff || delay <= 0 {
+		delay = p.maxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// doIdempotent sends an idempotent request to the media server through the circuit breaker.
+// Network failures and 5xx responses are retried with backoff and returned as a *RequestError
+// once the retries are used up; every other response is returned for the caller to interpret.
+func doIdempotent(client *http.Client, req *http.Request) (*http.Response, error) {
+	if !mediaServerBreaker.allow(time.Now()) {
+		return nil, &RequestError{Kind: FailureNetwork, Err: ErrCircuitOpen}
+	}
+
+	for retry := 0; ; retry++ {
+		resp, err := client.Do(req)
+		var failure *RequestError
+		switch {
+		case err != nil:
+			if errors.Is(req.Context().Err(), context.Canceled) {
+				mediaServerBreaker.abandon()
+				return nil, err
+			}
+			failure = &RequestError{Kind: FailureNetwork, Err: err}
+		case resp.StatusCode >= http.StatusInternalServerError:
+			// Drain the body so that the connection goes back to the pool.
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			failure = statusError(resp.StatusCode, fmt.Errorf("media server answered %s", resp.Status))
+		default:
+			mediaServerBreaker.success()
+			return resp, nil
+		}
+
+		if retry >= mediaServerRetries.retries {
+			mediaServerBreaker.failure(time.Now())
+			return nil, failure
+		}
+		delay := mediaServerRetries.delay(retry + 1)
+		logger.Warn("Media server request %s failed, retrying in %v: %v", req.URL.Path, delay, failure)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			mediaServerBreaker.abandon()
+			return nil, req.Context().Err()
+		}
+	}
+}
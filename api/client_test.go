@@ -0,0 +1,195 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useTestRetries replaces the retry policy and circuit breaker of media server requests for the test.
+func useTestRetries(t *testing.T, policy retryPolicy, breaker *circuitBreaker) {
+	t.Helper()
+	previousPolicy, previousBreaker := mediaServerRetries, mediaServerBreaker
+	mediaServerRetries, mediaServerBreaker = policy, breaker
+	t.Cleanup(func() { mediaServerRetries, mediaServerBreaker = previousPolicy, previousBreaker })
+}
+
+// newFailingServer starts a server that answers the first failures requests with status,
+// and every later one with 200. It returns the server and its request counter.
+func newFailingServer(t *testing.T, failures int32, status int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+// getTestServer sends an idempotent GET request to the server.
+func getTestServer(t *testing.T, server *httptest.Server) (*http.Response, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := doIdempotent(server.Client(), req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestDoIdempotentRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int32
+		status    int
+		wantCalls int32
+		wantKind  string // Empty when the request succeeds
+		wantCode  int
+	}{
+		{name: "recovers within the retries", failures: 2, status: http.StatusServiceUnavailable, wantCalls: 3, wantCode: http.StatusOK},
+		{name: "5xx after the retries", failures: 3, status: http.StatusBadGateway, wantCalls: 3, wantKind: FailureServer},
+		{name: "4xx is not retried", failures: 1, status: http.StatusForbidden, wantCalls: 1, wantCode: http.StatusForbidden},
+		{name: "not found is not retried", failures: 1, status: http.StatusNotFound, wantCalls: 1, wantCode: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestRetries(t, retryPolicy{retries: 2, backoff: time.Millisecond, maxBackoff: time.Millisecond}, &circuitBreaker{})
+			server, calls := newFailingServer(t, test.failures, test.status)
+
+			resp, err := getTestServer(t, server)
+			if got := calls.Load(); got != test.wantCalls {
+				t.Errorf("Made %d requests, want %d", got, test.wantCalls)
+			}
+			if test.wantKind != "" {
+				var requestErr *RequestError
+				if !errors.As(err, &requestErr) || requestErr.Kind != test.wantKind || requestErr.StatusCode != test.status {
+					t.Errorf("doIdempotent returned %v, want a %s failure with status %d", err, test.wantKind, test.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("doIdempotent returned error: %v", err)
+			}
+			if resp.StatusCode != test.wantCode {
+				t.Errorf("doIdempotent returned status %d, want %d", resp.StatusCode, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestDoIdempotentNetworkFailure(t *testing.T) {
+	useTestRetries(t, retryPolicy{retries: 1, backoff: time.Millisecond, maxBackoff: time.Millisecond}, &circuitBreaker{})
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	_, err := getTestServer(t, server)
+	if FailureKind(err) != FailureNetwork || !IsTransient(err) {
+		t.Errorf("doIdempotent against a closed server returned %v, want a network failure", err)
+	}
+}
+
+func TestDoIdempotentOpensBreaker(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 2, cooldown: time.Hour}
+	useTestRetries(t, retryPolicy{}, breaker)
+	server, calls := newFailingServer(t, 100, http.StatusInternalServerError)
+
+	for i := 0; i < 2; i++ {
+		if _, err := getTestServer(t, server); FailureKind(err) != FailureServer {
+			t.Fatalf("Request %d returned %v, want a 5xx failure", i, err)
+		}
+	}
+	_, err := getTestServer(t, server)
+	if !errors.Is(err, ErrCircuitOpen) || !IsTransient(err) {
+		t.Errorf("Request with an open breaker returned %v, want ErrCircuitOpen", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("Made %d requests, the open breaker should have stopped the third", got)
+	}
+}
+
+func TestDoIdempotentAbandonsProbeOnCancel(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 1, cooldown: time.Millisecond}
+	breaker.failure(time.Now().Add(-time.Second))
+	useTestRetries(t, retryPolicy{retries: 2, backoff: time.Hour, maxBackoff: time.Hour}, breaker)
+	server, _ := newFailingServer(t, 100, http.StatusServiceUnavailable)
+
+	// The client goes away during the backoff after the first attempt.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := doIdempotent(server.Client(), req); !errors.Is(err, context.Canceled) {
+		t.Errorf("doIdempotent returned %v, want context.Canceled", err)
+	}
+
+	if !breaker.allow(time.Now()) {
+		t.Error("A cancelled probe kept the breaker from probing again")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := retryPolicy{retries: 5, backoff: 100 * time.Millisecond, maxBackoff: time.Second}
+
+	tests := []struct {
+		retry int
+		want  time.Duration // Upper bound, the delay is drawn from its upper half
+	}{
+		{retry: 1, want: 100 * time.Millisecond},
+		{retry: 2, want: 200 * time.Millisecond},
+		{retry: 3, want: 400 * time.Millisecond},
+		{retry: 4, want: 800 * time.Millisecond},
+		{retry: 5, want: time.Second},
+		{retry: 64, want: time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 1000; i++ {
+			if delay := policy.delay(test.retry); delay < test.want/2 || delay > test.want {
+				t.Fatalf("delay(%d) = %v, want within [%v, %v]", test.retry, delay, test.want/2, test.want)
+			}
+		}
+	}
+
+	if delay := (retryPolicy{}).delay(1); delay != 0 {
+		t.Errorf("delay without backoff = %v, want 0", delay)
+	}
+}
+
+func TestStatusErrorKinds(t *testing.T) {
+	tests := []struct {
+		status    int
+		kind      string
+		transient bool
+	}{
+		{status: http.StatusBadRequest, kind: FailureClient},
+		{status: http.StatusUnauthorized, kind: FailureClient},
+		{status: http.StatusNotFound, kind: FailureNotFound},
+		{status: http.StatusInternalServerError, kind: FailureServer, transient: true},
+		{status: http.StatusGatewayTimeout, kind: FailureServer, transient: true},
+	}
+
+	for _, test := range tests {
+		err := statusError(test.status, errors.New("failed"))
+		if err.Kind != test.kind || IsTransient(err) != test.transient {
+			t.Errorf("statusError(%d) has kind %s (transient %v), want %s (transient %v)",
+				test.status, err.Kind, IsTransient(err), test.kind, test.transient)
+		}
+	}
+	if FailureKind(errors.New("other")) != "" || IsTransient(errors.New("other")) {
+		t.Error("An error that is not a RequestError has a failure kind")
+	}
+}
@@ -1,4 +1,4 @@
-// Package api provides functions to interact with the Emby API.
+// Package api provides functions to interact with the Emby and Jellyfin APIs.
 package api
 
 import (
@@ -9,7 +9,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"time"
+	neturl "net/url"
+)
+
+var (
+	// ErrUnauthorized is returned when Emby rejects the supplied token.
+	ErrUnauthorized = errors.New("emby token is invalid or expired")
+	// ErrForbidden is returned when the user is not allowed to see the requested item.
+	ErrForbidden = errors.New("user has no access to the item")
 )
 
 // EmbyAPI provides methods to interact with the Emby API.
@@ -25,20 +32,27 @@ func NewEmbyAPI() *EmbyAPI {
 	return &EmbyAPI{
 		EmbyURL: config.GetFullEmbyURL(),
 		APIKey:  cfg.EmbyAPIKey,
-		Client: &http.Client{
-			Timeout: 10 * time.Second,
-		},
+		Client:  mediaServerClient,
 	}
 }
 
 // GetMediaPath fetches the media file path from Emby using the provided item ID and MediaSourceID.
-func (api *EmbyAPI) GetMediaPath(apiKey, itemID, mediaSourceID string) (string, error) {
+// When userID is set, the playback info is resolved on behalf of that user.
+func (api *EmbyAPI) GetMediaPath(apiKey, userID, itemID, mediaSourceID string) (string, error) {
 	url := fmt.Sprintf("%s/Items/%s/PlaybackInfo?MediaSourceId=%s&api_key=%s",
-		api.EmbyURL, itemID, mediaSourceID, apiKey)
+		api.EmbyURL, neturl.PathEscape(itemID), neturl.QueryEscape(mediaSourceID), neturl.QueryEscape(apiKey))
+	if userID != "" {
+		url += "&UserId=" + neturl.QueryEscape(userID)
+	}
 
 	logger.Info("Fetching media path from Emby: %s", url)
 
-	resp, err := api.Client.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := doIdempotent(api.Client, req)
 	if err != nil {
 		logger.Error("Failed to fetch media path: %v", err)
 		return "", err
@@ -52,13 +66,13 @@ func (api *EmbyAPI) GetMediaPath(apiKey, itemID, mediaSourceID string) (string,
 
 	if resp.StatusCode != http.StatusOK {
 		logger.Error("Received non-200 response from Emby: %d", resp.StatusCode)
-		return "", errors.New("failed to fetch media path")
+		return "", statusError(resp.StatusCode, errors.New("failed to fetch media path"))
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		logger.Error("Error reading response body: %v", err)
-		return "", err
+		return "", &RequestError{Kind: FailureNetwork, Err: err}
 	}
 
 	var result struct {
@@ -69,7 +83,7 @@ func (api *EmbyAPI) GetMediaPath(apiKey, itemID, mediaSourceID string) (string,
 	}
 	if err := json.Unmarshal(body, &result); err != nil {
 		logger.Error("Error parsing JSON response: %v", err)
-		return "", err
+		return "", &RequestError{Kind: FailureServer, Err: err}
 	}
 
 	for _, source := range result.MediaSources {
@@ -80,5 +94,144 @@ func (api *EmbyAPI) GetMediaPath(apiKey, itemID, mediaSourceID string) (string,
 	}
 
 	logger.Warn("MediaSourceId not found in response")
-	return "", errors.New("media source not found")
+	return "", &RequestError{Kind: FailureNotFound, Err: errors.New("media source not found")}
+}
+
+// User describes the Emby user that owns an access token.
+type User struct {
+	ID   string // Emby user ID, empty for API keys that are not bound to a user
+	Name string // Emby user name
+}
+
+// GetCurrentUser validates the given access token against Emby and returns the user that owns it.
+// The user is resolved through Users/Me, which answers for the token itself, so that neither what
+// the client claims about itself (e.g. its device ID) nor the sessions an admin token can see decide
+// whose user it is. A token that is accepted but not bound to a user (e.g. a server API key) yields
+// a User with an empty ID.
+// Returns ErrUnauthorized if Emby rejects the token.
+func (api *EmbyAPI) GetCurrentUser(token string) (*User, error) {
+	url := fmt.Sprintf("%s/Users/Me", api.EmbyURL)
+
+	logger.Debug("Resolving token owner from Emby: %s", url)
+
+	resp, err := api.get(url, token)
+	if err != nil {
+		logger.Error("Failed to resolve token owner: %v", err)
+		return nil, err
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Error("Failed to close response body: %v", err)
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		logger.Warn("Emby rejected token with status: %d", resp.StatusCode)
+		return nil, statusError(resp.StatusCode, ErrUnauthorized)
+	case http.StatusBadRequest, http.StatusNotFound:
+		// API keys are not bound to a user, so Users/Me has nobody to return.
+		return api.validateAPIKey(token)
+	default:
+		logger.Error("Received unexpected response from Emby while validating token: %d", resp.StatusCode)
+		return nil, statusError(resp.StatusCode, errors.New("failed to validate token"))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		logger.Error("Error reading response body: %v", err)
+		return nil, &RequestError{Kind: FailureNetwork, Err: err}
+	}
+
+	var user struct {
+		ID   string `json:"Id"`
+		Name string `json:"Name"`
+	}
+	if err := json.Unmarshal(body, &user); err != nil {
+		logger.Error("Error parsing JSON response: %v", err)
+		return nil, &RequestError{Kind: FailureServer, Err: err}
+	}
+
+	logger.Debug("Token belongs to user: %s (%s)", user.Name, user.ID)
+	return &User{ID: user.ID, Name: user.Name}, nil
+}
+
+// validateAPIKey checks a token that is not bound to a user against an authenticated endpoint.
+func (api *EmbyAPI) validateAPIKey(token string) (*User, error) {
+	resp, err := api.get(fmt.Sprintf("%s/System/Info", api.EmbyURL), token)
+	if err != nil {
+		logger.Error("Failed to validate token: %v", err)
+		return nil, err
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Error("Failed to close response body: %v", err)
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		logger.Debug("Token is valid but not bound to a user")
+		return &User{}, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		logger.Warn("Emby rejected token with status: %d", resp.StatusCode)
+		return nil, statusError(resp.StatusCode, ErrUnauthorized)
+	default:
+		logger.Error("Received unexpected response from Emby while validating token: %d", resp.StatusCode)
+		return nil, statusError(resp.StatusCode, errors.New("failed to validate token"))
+	}
+}
+
+// get performs an authenticated GET request against Emby, with retries and the circuit breaker.
+func (api *EmbyAPI) get(url, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Emby-Token", token)
+	return doIdempotent(api.Client, req)
+}
+
+// CheckItemAccess confirms through the Users/Items API that the given user can see the item.
+// Library restrictions and parental controls of the user are applied by Emby.
+// Returns ErrForbidden if the user cannot see the item and ErrUnauthorized if the token is rejected.
+func (api *EmbyAPI) CheckItemAccess(token, userID, itemID string) error {
+	url := fmt.Sprintf("%s/Users/%s/Items/%s", api.EmbyURL, neturl.PathEscape(userID), neturl.PathEscape(itemID))
+
+	logger.Debug("Checking item access in Emby: %s", url)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Emby-Token", token)
+
+	resp, err := doIdempotent(api.Client, req)
+	if err != nil {
+		logger.Error("Failed to check item access: %v", err)
+		return err
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Error("Failed to close response body: %v", err)
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		logger.Warn("Emby rejected token with status: %d", resp.StatusCode)
+		return statusError(resp.StatusCode, ErrUnauthorized)
+	case http.StatusForbidden, http.StatusNotFound:
+		logger.Warn("User %s has no access to item %s: %d", userID, itemID, resp.StatusCode)
+		return statusError(resp.StatusCode, ErrForbidden)
+	default:
+		logger.Error("Received unexpected response from Emby while checking item access: %d", resp.StatusCode)
+		return statusError(resp.StatusCode, errors.New("failed to check item access"))
+	}
 }
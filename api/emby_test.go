@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestEmby starts an Emby stub knowing a user token, an admin token and a server API key.
+// Like Emby, the stub lists the sessions of every user to the admin.
+func newTestEmby(t *testing.T) *EmbyAPI {
+	t.Helper()
+	users := map[string]map[string]string{
+		"user-token":  {"Id": "user-id", "Name": "alice"},
+		"admin-token": {"Id": "admin-id", "Name": "admin"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Emby-Token")
+		_, isUser := users[token]
+		if !isUser && token != "server-api-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/Users/Me":
+			if !isUser {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(users[token])
+		case "/System/Info":
+			json.NewEncoder(w).Encode(map[string]string{"Id": "server-id"})
+		case "/Sessions":
+			json.NewEncoder(w).Encode([]map[string]string{
+				{"UserId": "user-id", "UserName": "alice"},
+				{"UserId": "admin-id", "UserName": "admin"},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return &EmbyAPI{EmbyURL: server.URL, Client: server.Client()}
+}
+
+func TestEmbyGetCurrentUser(t *testing.T) {
+	emby := newTestEmby(t)
+
+	tests := []struct {
+		name  string
+		token string
+		want  User
+	}{
+		{name: "user token", token: "user-token", want: User{ID: "user-id", Name: "alice"}},
+		{name: "admin token", token: "admin-token", want: User{ID: "admin-id", Name: "admin"}},
+		{name: "api key", token: "server-api-key", want: User{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := emby.GetCurrentUser(test.token)
+			if err != nil {
+				t.Fatalf("GetCurrentUser returned error: %v", err)
+			}
+			if *user != test.want {
+				t.Errorf("GetCurrentUser(%q)\n got: %+v\nwant: %+v", test.token, *user, test.want)
+			}
+		})
+	}
+
+	if _, err := emby.GetCurrentUser("revoked-token"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("GetCurrentUser of a rejected token returned %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestEmbyGetMediaPathEscapesIDs(t *testing.T) {
+	const itemID = "1/../../Users/admin?api_key=x#"
+	const mediaSourceID = "source&api_key=other&UserId=admin"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/Items/"+itemID+"/PlaybackInfo" || len(query) != 2 ||
+			query.Get("MediaSourceId") != mediaSourceID || query.Get("api_key") != "server-api-key" {
+			t.Errorf("Request was rewritten to %s", r.URL.RequestURI())
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"MediaSources": []map[string]string{{"Id": mediaSourceID, "Path": "/media/movie.mkv"}},
+		})
+	}))
+	t.Cleanup(server.Close)
+	emby := &EmbyAPI{EmbyURL: server.URL, Client: server.Client()}
+
+	mediaPath, err := emby.GetMediaPath("server-api-key", "", itemID, mediaSourceID)
+	if err != nil || mediaPath != "/media/movie.mkv" {
+		t.Errorf("GetMediaPath returned %q, %v", mediaPath, err)
+	}
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Kinds of media server failures, see RequestError.
+const (
+	FailureNetwork  = "network"   // The media server could not be reached or did not answer in time
+	FailureClient   = "4xx"       // The media server rejected the request
+	FailureServer   = "5xx"       // The media server failed to handle the request
+	FailureNotFound = "not-found" // The item or media source does not exist
+)
+
+// ErrCircuitOpen is returned without contacting the media server while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("media server circuit breaker is open")
+
+// RequestError is a failed media server request, classified by Kind so that callers can tell
+// transient failures from answers that retrying will not change.
+type RequestError struct {
+	Kind       string
+	StatusCode int // HTTP status of the response, 0 when there was none
+	Err        error
+}
+
+// Error implements the error interface.
+func (e *RequestError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s failure (status %d): %v", e.Kind, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("%s failure: %v", e.Kind, e.Err)
+}
+
+// Unwrap returns the underlying error, so that errors.Is matches ErrUnauthorized and friends.
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// FailureKind returns the kind of a media server failure, or an empty string for errors that
+// did not come from a media server request.
+func FailureKind(err error) string {
+	var requestErr *RequestError
+	if errors.As(err, &requestErr) {
+		return requestErr.Kind
+	}
+	return ""
+}
+
+// IsTransient reports whether a failure may go away on its own: the media server was unreachable,
+// failed with a 5xx status or is held off by the circuit breaker.
+func IsTransient(err error) bool {
+	kind := FailureKind(err)
+	return kind == FailureNetwork || kind == FailureServer
+}
+
+// statusError classifies an unexpected response status.
+func statusError(statusCode int, err error) *RequestError {
+	kind := FailureClient
+	switch {
+	case statusCode == http.StatusNotFound:
+		kind = FailureNotFound
+	case statusCode >= http.StatusInternalServerError:
+		kind = FailureServer
+	}
+	return &RequestError{Kind: kind, StatusCode: statusCode, Err: err}
+}
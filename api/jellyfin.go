@@ -0,0 +1,215 @@
+package api
+
+import (
+	"PiliPili_Frontend/config"
+	"PiliPili_Frontend/logger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// JellyfinAPI provides methods to interact with the Jellyfin API.
+type JellyfinAPI struct {
+	JellyfinURL string
+	APIKey      string
+	Client      *http.Client
+}
+
+// NewJellyfinAPI initializes a new JellyfinAPI instance.
+func NewJellyfinAPI() *JellyfinAPI {
+	cfg := config.GetConfig()
+	return &JellyfinAPI{
+		JellyfinURL: config.GetFullEmbyURL(),
+		APIKey:      cfg.EmbyAPIKey,
+		Client:      mediaServerClient,
+	}
+}
+
+// GetMediaPath fetches the media file path from Jellyfin using the provided item ID and MediaSourceID.
+// When userID is set, the playback info is resolved on behalf of that user.
+func (api *JellyfinAPI) GetMediaPath(apiKey, userID, itemID, mediaSourceID string) (string, error) {
+	url := fmt.Sprintf("%s/Items/%s/PlaybackInfo?MediaSourceId=%s",
+		api.JellyfinURL, neturl.PathEscape(itemID), neturl.QueryEscape(mediaSourceID))
+	if userID != "" {
+		url += "&UserId=" + neturl.QueryEscape(userID)
+	}
+
+	logger.Info("Fetching media path from Jellyfin: %s", url)
+
+	resp, err := api.get(url, apiKey)
+	if err != nil {
+		logger.Error("Failed to fetch media path: %v", err)
+		return "", err
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Error("Failed to close response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		logger.Error("Received non-200 response from Jellyfin: %d", resp.StatusCode)
+		return "", statusError(resp.StatusCode, errors.New("failed to fetch media path"))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		logger.Error("Error reading response body: %v", err)
+		return "", &RequestError{Kind: FailureNetwork, Err: err}
+	}
+
+	var result struct {
+		MediaSources []struct {
+			ID   string `json:"Id"`
+			Path string `json:"Path"`
+		} `json:"MediaSources"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		logger.Error("Error parsing JSON response: %v", err)
+		return "", &RequestError{Kind: FailureServer, Err: err}
+	}
+
+	// Jellyfin IDs are GUIDs that clients send both with and without dashes.
+	for _, source := range result.MediaSources {
+		if normalizeJellyfinID(source.ID) == normalizeJellyfinID(mediaSourceID) {
+			logger.Debug("Found media path: %s", source.Path)
+			return source.Path, nil
+		}
+	}
+
+	logger.Warn("MediaSourceId not found in response")
+	return "", &RequestError{Kind: FailureNotFound, Err: errors.New("media source not found")}
+}
+
+// GetCurrentUser validates the given access token against Jellyfin and returns the user that owns it.
+// API keys are accepted but yield a User with an empty ID.
+// Returns ErrUnauthorized if Jellyfin rejects the token.
+func (api *JellyfinAPI) GetCurrentUser(token string) (*User, error) {
+	url := fmt.Sprintf("%s/Users/Me", api.JellyfinURL)
+
+	logger.Debug("Resolving token owner from Jellyfin: %s", url)
+
+	resp, err := api.get(url, token)
+	if err != nil {
+		logger.Error("Failed to resolve token owner: %v", err)
+		return nil, err
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Error("Failed to close response body: %v", err)
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		logger.Warn("Jellyfin rejected token with status: %d", resp.StatusCode)
+		return nil, statusError(resp.StatusCode, ErrUnauthorized)
+	case http.StatusBadRequest, http.StatusNotFound:
+		// API keys are not bound to a user, so Users/Me has nobody to return.
+		return api.validateAPIKey(token)
+	default:
+		logger.Error("Received unexpected response from Jellyfin while validating token: %d", resp.StatusCode)
+		return nil, statusError(resp.StatusCode, errors.New("failed to validate token"))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		logger.Error("Error reading response body: %v", err)
+		return nil, &RequestError{Kind: FailureNetwork, Err: err}
+	}
+
+	var user struct {
+		ID   string `json:"Id"`
+		Name string `json:"Name"`
+	}
+	if err := json.Unmarshal(body, &user); err != nil {
+		logger.Error("Error parsing JSON response: %v", err)
+		return nil, &RequestError{Kind: FailureServer, Err: err}
+	}
+
+	logger.Debug("Token belongs to user: %s (%s)", user.Name, user.ID)
+	return &User{ID: user.ID, Name: user.Name}, nil
+}
+
+// CheckItemAccess confirms through the Users/Items API that the given user can see the item.
+// Returns ErrForbidden if the user cannot see the item and ErrUnauthorized if the token is rejected.
+func (api *JellyfinAPI) CheckItemAccess(token, userID, itemID string) error {
+	url := fmt.Sprintf("%s/Users/%s/Items/%s", api.JellyfinURL, neturl.PathEscape(userID), neturl.PathEscape(itemID))
+
+	logger.Debug("Checking item access in Jellyfin: %s", url)
+
+	resp, err := api.get(url, token)
+	if err != nil {
+		logger.Error("Failed to check item access: %v", err)
+		return err
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Error("Failed to close response body: %v", err)
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		logger.Warn("Jellyfin rejected token with status: %d", resp.StatusCode)
+		return statusError(resp.StatusCode, ErrUnauthorized)
+	case http.StatusForbidden, http.StatusNotFound:
+		logger.Warn("User %s has no access to item %s: %d", userID, itemID, resp.StatusCode)
+		return statusError(resp.StatusCode, ErrForbidden)
+	default:
+		logger.Error("Received unexpected response from Jellyfin while checking item access: %d", resp.StatusCode)
+		return statusError(resp.StatusCode, errors.New("failed to check item access"))
+	}
+}
+
+// validateAPIKey checks a token that is not bound to a user against an authenticated endpoint.
+func (api *JellyfinAPI) validateAPIKey(token string) (*User, error) {
+	resp, err := api.get(fmt.Sprintf("%s/System/Info", api.JellyfinURL), token)
+	if err != nil {
+		logger.Error("Failed to validate token: %v", err)
+		return nil, err
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Error("Failed to close response body: %v", err)
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		logger.Debug("Token is valid but not bound to a user")
+		return &User{}, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		logger.Warn("Jellyfin rejected token with status: %d", resp.StatusCode)
+		return nil, statusError(resp.StatusCode, ErrUnauthorized)
+	default:
+		logger.Error("Received unexpected response from Jellyfin while validating token: %d", resp.StatusCode)
+		return nil, statusError(resp.StatusCode, errors.New("failed to validate token"))
+	}
+}
+
+// get performs an authenticated GET request against Jellyfin, with retries and the circuit breaker.
+func (api *JellyfinAPI) get(url, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(`MediaBrowser Token="%s"`, token))
+	return doIdempotent(api.Client, req)
+}
+
+// normalizeJellyfinID strips dashes and lowercases a Jellyfin GUID.
+func normalizeJellyfinID(id string) string {
+	return strings.ToLower(strings.ReplaceAll(id, "-", ""))
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"PiliPili_Frontend/config"
+	"strings"
+)
+
+// Media server types supported by NewMediaServer.
+const (
+	MediaServerEmby     = "emby"
+	MediaServerJellyfin = "jellyfin"
+)
+
+// MediaServer abstracts the media server the frontend sits in front of.
+type MediaServer interface {
+	// GetMediaPath resolves the file path of a media source, on behalf of userID when it is set.
+	GetMediaPath(apiKey, userID, itemID, mediaSourceID string) (string, error)
+	// GetCurrentUser validates the token and returns the user that owns it.
+	// Returns ErrUnauthorized if the token is rejected.
+	GetCurrentUser(token string) (*User, error)
+	// CheckItemAccess confirms that the user can see the item.
+	// Returns ErrForbidden if the user cannot see it.
+	CheckItemAccess(token, userID, itemID string) error
+}
+
+// NewMediaServer returns the MediaServer implementation selected in the configuration.
+func NewMediaServer() MediaServer {
+	if IsJellyfin() {
+		return NewJellyfinAPI()
+	}
+	return NewEmbyAPI()
+}
+
+// IsJellyfin reports whether the configured media server is Jellyfin.
+func IsJellyfin() bool {
+	return strings.EqualFold(config.GetConfig().MediaServerType, MediaServerJellyfin)
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3DefaultRegion is used when no region is configured.
+	s3DefaultRegion = "us-east-1"
+	// s3MaxPresignExpiry is the longest lifetime SigV4 accepts for a presigned URL.
+	s3MaxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// S3API presigns requests for Amazon S3 and S3-compatible object storage such as MinIO.
+type S3API struct {
+	Endpoint     *neturl.URL
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	PathStyle    bool
+}
+
+// NewS3API initializes a new S3API instance. An empty endpoint selects the AWS endpoint of the region.
+func NewS3API(endpoint, region, accessKey, secretKey, sessionToken string, pathStyle bool) (*S3API, error) {
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+
+	parsedEndpoint, err := neturl.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if parsedEndpoint.Host == "" {
+		return nil, errors.New("s3 endpoint has no host: " + endpoint)
+	}
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("s3 credentials are missing")
+	}
+
+	return &S3API{
+		Endpoint:     parsedEndpoint,
+		Region:       region,
+		AccessKey:    accessKey,
+		SecretKey:    secretKey,
+		SessionToken: sessionToken,
+		PathStyle:    pathStyle,
+	}, nil
+}
+
+// PresignGetObject returns an AWS Signature Version 4 presigned GET URL for the object,
+// valid for the given duration from now, and the time it expires at. The duration is capped at seven days.
+func (api *S3API) PresignGetObject(bucket, key string, expires time.Duration, now time.Time) (string, time.Time, error) {
+	if bucket == "" || key == "" {
+		return "", time.Time{}, errors.New("s3 bucket and key are required")
+	}
+	if expires > s3MaxPresignExpiry {
+		expires = s3MaxPresignExpiry
+	}
+	if expires < time.Second {
+		expires = time.Second
+	}
+
+	host := api.Endpoint.Host
+	path := strings.TrimSuffix(api.Endpoint.Path, "/") + "/" + bucket + "/" + key
+	if !api.PathStyle {
+		host = bucket + "." + host
+		path = strings.TrimSuffix(api.Endpoint.Path, "/") + "/" + key
+	}
+
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+	scope := shortDate + "/" + api.Region + "/s3/aws4_request"
+
+	query := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    api.AccessKey + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       strconv.Itoa(int(expires / time.Second)),
+		"X-Amz-SignedHeaders": "host",
+	}
+	if api.SessionToken != "" {
+		query["X-Amz-Security-Token"] = api.SessionToken
+	}
+
+	canonicalURI := s3EscapePath(path)
+	canonicalQuery := s3CanonicalQuery(query)
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		canonicalURI,
+		canonicalQuery,
+		"host:" + host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+
+	signingKey := s3HMAC([]byte("AWS4"+api.SecretKey), shortDate)
+	signingKey = s3HMAC(signingKey, api.Region)
+	signingKey = s3HMAC(signingKey, "s3")
+	signingKey = s3HMAC(signingKey, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(signingKey, stringToSign))
+
+	return fmt.Sprintf(
+		"%s://%s%s?%s&X-Amz-Signature=%s",
+		api.Endpoint.Scheme,
+		host,
+		canonicalURI,
+		canonicalQuery,
+		signature,
+	), now.Add(expires), nil
+}
+
+// s3HMAC returns HMAC-SHA256(key, data).
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes the query parameters sorted by name, as SigV4 requires.
+func s3CanonicalQuery(query map[string]string) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, s3Escape(key, true)+"="+s3Escape(query[key], true))
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3EscapePath URI-encodes every segment of the object path, keeping the slashes.
+func s3EscapePath(path string) string {
+	return s3Escape(path, false)
+}
+
+// s3Escape URI-encodes everything but the RFC 3986 unreserved characters.
+// Slashes are only encoded when encodeSlash is set.
+func s3Escape(value string, encodeSlash bool) string {
+	var builder strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			builder.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			builder.WriteByte(c)
+		default:
+			fmt.Fprintf(&builder, "%%%02X", c)
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"PiliPili_Frontend/logger"
+	"net/http"
+	"time"
+)
+
+// HealthCheckOptions controls the active health checks of a Pool.
+type HealthCheckOptions struct {
+	Interval           time.Duration // Time between two probes of the same backend
+	Timeout            time.Duration // Timeout of a single probe
+	UnhealthyThreshold int           // Consecutive failures before a backend leaves rotation
+	HealthyThreshold   int           // Consecutive successes before a backend rejoins rotation
+}
+
+// StartHealthChecks probes the health URL of every backend in the background.
+// Backends without a health URL are never probed and stay in rotation.
+func (p *Pool) StartHealthChecks(options HealthCheckOptions) {
+	if options.Interval <= 0 {
+		options.Interval = 10 * time.Second
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 3 * time.Second
+	}
+	if options.UnhealthyThreshold <= 0 {
+		options.UnhealthyThreshold = 1
+	}
+	if options.HealthyThreshold <= 0 {
+		options.HealthyThreshold = 1
+	}
+
+	client := &http.Client{Timeout: options.Timeout}
+	for _, b := range p.backends {
+		if b.HealthURL == "" {
+			continue
+		}
+		logger.Info("Starting health checks for backend %s: %s", b.Name, b.HealthURL)
+		go p.probeLoop(client, b, options)
+	}
+}
+
+// probeLoop probes a single backend until the process exits.
+func (p *Pool) probeLoop(client *http.Client, b *Backend, options HealthCheckOptions) {
+	ticker := time.NewTicker(options.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.recordProbe(b, probe(client, b.HealthURL), options)
+		<-ticker.C
+	}
+}
+
+// probe performs one health check request and reports whether it succeeded.
+func probe(client *http.Client, healthURL string) bool {
+	resp, err := client.Get(healthURL)
+	if err != nil {
+		logger.Debug("Health check of %s failed: %v", healthURL, err)
+		return false
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Error("Failed to close response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		logger.Debug("Health check of %s returned status: %d", healthURL, resp.StatusCode)
+		return false
+	}
+	return true
+}
+
+// recordProbe updates the health state of a backend with the result of a probe.
+func (p *Pool) recordProbe(b *Backend, ok bool, options HealthCheckOptions) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ok {
+		b.failures = 0
+		b.successes++
+		if !b.healthy && b.successes >= options.HealthyThreshold {
+			b.healthy = true
+			logger.Info("Backend %s is healthy again and back in rotation", b.Name)
+		}
+		return
+	}
+
+	b.successes = 0
+	b.failures++
+	b.lastFailure = time.Now()
+	if b.healthy && b.failures >= options.UnhealthyThreshold {
+		b.healthy = false
+		logger.Warn("Backend %s failed %d health checks and was taken out of rotation", b.Name, b.failures)
+	}
+}
@@ -0,0 +1,96 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRecordProbeThresholds(t *testing.T) {
+	pool := newTestPool(t, StrategyRoundRobin,
+		&Backend{Name: "a", URL: "https://a.example.com/stream"},
+		&Backend{Name: "b", URL: "https://b.example.com/stream"},
+	)
+	a := pool.backends[0]
+	options := HealthCheckOptions{UnhealthyThreshold: 2, HealthyThreshold: 2}
+
+	pool.recordProbe(a, false, options)
+	if !a.healthy {
+		t.Fatal("Backend left rotation after one failed probe, threshold is 2")
+	}
+	pool.recordProbe(a, true, options)
+	pool.recordProbe(a, false, options)
+	if !a.healthy {
+		t.Fatal("A successful probe did not reset the failure count")
+	}
+	pool.recordProbe(a, false, options)
+	if a.healthy || a.lastFailure.IsZero() {
+		t.Fatal("Backend stayed in rotation after two failed probes in a row")
+	}
+	if got := selectNames(pool, 3); got != "b,b,b" {
+		t.Errorf("Selected %s while a is out of rotation", got)
+	}
+	if pool.IsHealthyURL("https://a.example.com/stream/a.mkv") {
+		t.Error("IsHealthyURL reports the evicted backend as healthy")
+	}
+
+	pool.recordProbe(a, true, options)
+	if a.healthy {
+		t.Fatal("Backend rejoined rotation after one successful probe, threshold is 2")
+	}
+	pool.recordProbe(a, true, options)
+	if !a.healthy {
+		t.Fatal("Backend did not rejoin rotation after two successful probes")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	if !probe(server.Client(), server.URL) {
+		t.Error("A 200 probe failed")
+	}
+	status.Store(http.StatusServiceUnavailable)
+	if probe(server.Client(), server.URL) {
+		t.Error("A 503 probe succeeded")
+	}
+	server.Close()
+	if probe(server.Client(), server.URL) {
+		t.Error("A probe of a closed server succeeded")
+	}
+}
+
+func TestHealthChecksEvictAndRecover(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	pool := newTestPool(t, StrategyRoundRobin,
+		&Backend{Name: "a", URL: "https://a.example.com/stream", HealthURL: server.URL},
+	)
+	pool.StartHealthChecks(HealthCheckOptions{Interval: 10 * time.Millisecond, Timeout: time.Second})
+
+	waitForHealth := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for pool.IsHealthyURL("https://a.example.com/stream/a.mkv") != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Backend health did not become %v", want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitForHealth(false)
+	status.Store(http.StatusOK)
+	waitForHealth(true)
+}
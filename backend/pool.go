@@ -0,0 +1,259 @@
+// Package backend manages the pool of PiliPili streaming backends.
+package backend
+
+import (
+	"PiliPili_Frontend/cdn"
+	"PiliPili_Frontend/config"
+	"PiliPili_Frontend/logger"
+	"PiliPili_Frontend/util"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Load balancing strategies supported by Pool.
+const (
+	StrategyRoundRobin         = "round-robin"          // Cycle through healthy backends in order
+	StrategyWeighted           = "weighted"             // Smooth weighted round-robin
+	StrategyLeastRecentFailure = "least-recent-failure" // Prefer the backend whose last failure is the oldest
+)
+
+// Backend describes a single streaming backend.
+type Backend struct {
+	Name      string     // Unique name of the backend
+	URL       string     // Streaming URL of the backend
+	Host      string     // Host (and port) of the streaming URL
+	Weight    int        // Relative weight used by the weighted strategy
+	HealthURL string     // URL probed by the health checker, empty to disable probing
+	Signer    cdn.Signer // URL signer of the CDN in front of the backend, nil without CDN
+
+	healthy       bool      // Whether the backend is currently in rotation
+	failures      int       // Consecutive failed probes
+	successes     int       // Consecutive successful probes
+	lastFailure   time.Time // Time of the most recent failed probe
+	currentWeight int       // Running weight of the smooth weighted round-robin
+}
+
+// Pool selects healthy backends according to a load balancing strategy.
+type Pool struct {
+	mu       sync.Mutex
+	backends []*Backend
+	strategy string
+	next     int // Cursor of the round-robin strategy
+}
+
+var poolInstance *Pool
+
+// NewPool creates a pool for the given backends. All backends start healthy.
+// The pool may be empty when every path is served by Alist, S3 or remote targets.
+func NewPool(backends []*Backend, strategy string) (*Pool, error) {
+	switch strategy {
+	case "":
+		strategy = StrategyRoundRobin
+	case StrategyRoundRobin, StrategyWeighted, StrategyLeastRecentFailure:
+	default:
+		return nil, errors.New("unsupported load balancing strategy: " + strategy)
+	}
+
+	for _, b := range backends {
+		if b.Weight <= 0 {
+			b.Weight = 1
+		}
+		b.URL = util.BuildFullURL(b.URL, 0)
+		b.Host = util.ExtractHost(b.URL)
+		if b.Name == "" {
+			b.Name = b.Host
+		}
+		b.healthy = true
+	}
+
+	return &Pool{backends: backends, strategy: strategy}, nil
+}
+
+// SetPool replaces the global pool instance.
+func SetPool(pool *Pool) {
+	poolInstance = pool
+}
+
+// GetPool returns the global pool instance.
+func GetPool() (*Pool, error) {
+	if poolInstance == nil {
+		return nil, errors.New("backend pool is not initialized")
+	}
+	return poolInstance, nil
+}
+
+// Backends returns the backends of the pool.
+func (p *Pool) Backends() []*Backend {
+	return p.backends
+}
+
+// Select picks a healthy backend according to the pool strategy.
+// When names are given, only the backends with those names are considered.
+// If every candidate is unhealthy, one is still returned so playback is attempted rather than refused.
+// Returns nil if the pool is empty.
+func (p *Pool) Select(names ...string) *Backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	members := p.backends
+	if len(names) > 0 {
+		members = make([]*Backend, 0, len(names))
+		for _, b := range p.backends {
+			if slices.Contains(names, b.Name) {
+				members = append(members, b)
+			}
+		}
+		if len(members) == 0 {
+			logger.Warn("No backend named %v found, falling back to the whole pool", names)
+			members = p.backends
+		}
+	}
+
+	if len(members) == 0 {
+		return nil
+	}
+
+	candidates := make([]*Backend, 0, len(members))
+	for _, b := range members {
+		if b.healthy {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		logger.Warn("No healthy backend available, falling back to all candidates")
+		candidates = members
+	}
+
+	var selected *Backend
+	switch p.strategy {
+	case StrategyWeighted:
+		selected = selectWeighted(candidates)
+	case StrategyLeastRecentFailure:
+		selected = selectLeastRecentFailure(candidates)
+	default:
+		selected = candidates[p.next%len(candidates)]
+		p.next++
+	}
+
+	logger.Debug("Selected backend: %s (%s)", selected.Name, selected.URL)
+	return selected
+}
+
+// IsHealthyURL reports whether the URL points to a backend that is currently in rotation.
+// URLs that do not belong to any backend of the pool are considered healthy.
+func (p *Pool) IsHealthyURL(rawURL string) bool {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// The scheme and host identify the backend, since CDN auth types B and C move the path.
+	// Backends sharing a host are told apart by the longest base path the URL lies under.
+	var matched *Backend
+	matchedPath := -1
+	for _, b := range p.backends {
+		base, err := url.Parse(b.URL)
+		if err != nil || !strings.EqualFold(base.Scheme, target.Scheme) || !strings.EqualFold(base.Host, target.Host) {
+			continue
+		}
+		basePath := strings.TrimSuffix(base.Path, "/")
+		underBase := target.Path == basePath || strings.HasPrefix(target.Path, basePath+"/")
+		if matched == nil || (underBase && len(basePath) > matchedPath) {
+			matched = b
+			if underBase {
+				matchedPath = len(basePath)
+			}
+		}
+	}
+	if matched == nil {
+		return true
+	}
+	return matched.healthy
+}
+
+// SignURL adds the authentication of the backend's CDN to a URL of the backend, valid until expireAt.
+// URLs of backends without CDN are returned unchanged.
+func (b *Backend) SignURL(rawURL string, expireAt time.Time) (string, error) {
+	if b.Signer == nil {
+		return rawURL, nil
+	}
+	return b.Signer.SignURL(rawURL, expireAt)
+}
+
+// selectWeighted implements nginx's smooth weighted round-robin.
+func selectWeighted(candidates []*Backend) *Backend {
+	total := 0
+	var selected *Backend
+	for _, b := range candidates {
+		b.currentWeight += b.Weight
+		total += b.Weight
+		if selected == nil || b.currentWeight > selected.currentWeight {
+			selected = b
+		}
+	}
+	selected.currentWeight -= total
+	return selected
+}
+
+// selectLeastRecentFailure picks the backend whose last failure is the oldest,
+// preferring the higher weight among backends that never failed.
+func selectLeastRecentFailure(candidates []*Backend) *Backend {
+	selected := candidates[0]
+	for _, b := range candidates[1:] {
+		if b.lastFailure.Before(selected.lastFailure) ||
+			(b.lastFailure.Equal(selected.lastFailure) && b.Weight > selected.Weight) {
+			selected = b
+		}
+	}
+	return selected
+}
+
+// Initialize builds the global pool from the configuration and starts its health checks.
+// Without Backend.servers, the pool consists of the single Backend.url.
+func Initialize() error {
+	cfg := config.GetConfig()
+
+	var backends []*Backend
+	for _, server := range cfg.BackendServers {
+		signer, err := cdn.NewSigner(server.CDN)
+		if err != nil {
+			return fmt.Errorf("backend %s has an invalid cdn configuration: %w", server.Name, err)
+		}
+		backends = append(backends, &Backend{
+			Name:      server.Name,
+			URL:       server.URL,
+			Weight:    server.Weight,
+			HealthURL: server.HealthURL,
+			Signer:    signer,
+		})
+	}
+	if len(backends) == 0 && cfg.BackendURL != "" {
+		backends = append(backends, &Backend{URL: cfg.BackendURL})
+	}
+
+	pool, err := NewPool(backends, cfg.BackendBalance)
+	if err != nil {
+		return err
+	}
+	if len(backends) == 0 {
+		logger.Warn("No backend configured, set Backend.url or Backend.servers to sign PiliPili streaming URLs")
+	}
+
+	pool.StartHealthChecks(HealthCheckOptions{
+		Interval:           time.Duration(cfg.BackendHealthCheck.Interval) * time.Second,
+		Timeout:            time.Duration(cfg.BackendHealthCheck.Timeout) * time.Second,
+		UnhealthyThreshold: cfg.BackendHealthCheck.UnhealthyThreshold,
+		HealthyThreshold:   cfg.BackendHealthCheck.HealthyThreshold,
+	})
+
+	SetPool(pool)
+	return nil
+}
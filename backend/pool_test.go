@@ -0,0 +1,143 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T, strategy string, backends ...*Backend) *Pool {
+	t.Helper()
+	pool, err := NewPool(backends, strategy)
+	if err != nil {
+		t.Fatalf("NewPool returned error: %v", err)
+	}
+	return pool
+}
+
+// selectNames returns the names of n backends selected in a row.
+func selectNames(pool *Pool, n int, names ...string) string {
+	selected := make([]string, n)
+	for i := range selected {
+		selected[i] = pool.Select(names...).Name
+	}
+	return strings.Join(selected, ",")
+}
+
+func TestNewPoolStrategies(t *testing.T) {
+	if pool := newTestPool(t, ""); pool.strategy != StrategyRoundRobin {
+		t.Errorf("Default strategy is %s, want %s", pool.strategy, StrategyRoundRobin)
+	}
+	if _, err := NewPool(nil, "random"); err == nil {
+		t.Error("NewPool accepted an unsupported strategy")
+	}
+}
+
+func TestSelectRoundRobin(t *testing.T) {
+	pool := newTestPool(t, StrategyRoundRobin,
+		&Backend{Name: "a", URL: "https://a.example.com/stream"},
+		&Backend{Name: "b", URL: "https://b.example.com/stream"},
+		&Backend{Name: "c", URL: "https://c.example.com/stream"},
+	)
+	if got := selectNames(pool, 4); got != "a,b,c,a" {
+		t.Errorf("Round-robin selected %s, want a,b,c,a", got)
+	}
+
+	pool.backends[1].healthy = false
+	if got := selectNames(pool, 4); strings.Contains(got, "b") {
+		t.Errorf("Round-robin selected the unhealthy backend: %s", got)
+	}
+}
+
+func TestSelectWeighted(t *testing.T) {
+	pool := newTestPool(t, StrategyWeighted,
+		&Backend{Name: "a", URL: "https://a.example.com/stream", Weight: 5},
+		&Backend{Name: "b", URL: "https://b.example.com/stream", Weight: 1},
+		&Backend{Name: "c", URL: "https://c.example.com/stream", Weight: 1},
+	)
+	// The sequence of nginx's smooth weighted round-robin for weights 5, 1 and 1.
+	if got := selectNames(pool, 7); got != "a,a,b,a,c,a,a" {
+		t.Errorf("Weighted selected %s, want a,a,b,a,c,a,a", got)
+	}
+
+	pool.backends[0].healthy = false
+	if got := selectNames(pool, 4); strings.Contains(got, "a") {
+		t.Errorf("Weighted selected the unhealthy backend: %s", got)
+	}
+}
+
+func TestSelectLeastRecentFailure(t *testing.T) {
+	now := time.Now()
+	pool := newTestPool(t, StrategyLeastRecentFailure,
+		&Backend{Name: "a", URL: "https://a.example.com/stream", Weight: 1},
+		&Backend{Name: "b", URL: "https://b.example.com/stream", Weight: 1},
+		&Backend{Name: "c", URL: "https://c.example.com/stream", Weight: 2},
+	)
+	pool.backends[0].lastFailure = now.Add(-time.Hour)
+	pool.backends[1].lastFailure = now.Add(-time.Minute)
+	pool.backends[2].lastFailure = now
+
+	if got := pool.Select().Name; got != "a" {
+		t.Errorf("Selected %s, want a whose failure is the oldest", got)
+	}
+
+	// Among backends that never failed, the higher weight wins.
+	pool.backends[0].lastFailure, pool.backends[2].lastFailure = time.Time{}, time.Time{}
+	if got := pool.Select().Name; got != "c" {
+		t.Errorf("Selected %s, want c with the higher weight", got)
+	}
+}
+
+func TestSelectByName(t *testing.T) {
+	pool := newTestPool(t, StrategyRoundRobin,
+		&Backend{Name: "a", URL: "https://a.example.com/stream"},
+		&Backend{Name: "b", URL: "https://b.example.com/stream"},
+		&Backend{Name: "c", URL: "https://c.example.com/stream"},
+	)
+	if got := selectNames(pool, 4, "b", "c"); strings.Contains(got, "a") {
+		t.Errorf("Selected %s, want only b and c", got)
+	}
+	if got := pool.Select("unknown"); got == nil {
+		t.Error("Unknown names did not fall back to the whole pool")
+	}
+
+	// Playback is attempted rather than refused when every candidate is unhealthy.
+	pool.backends[1].healthy = false
+	if got := pool.Select("b").Name; got != "b" {
+		t.Errorf("Selected %s, want the only, unhealthy candidate b", got)
+	}
+
+	if got := newTestPool(t, StrategyRoundRobin).Select(); got != nil {
+		t.Errorf("Empty pool selected %v", got)
+	}
+}
+
+func TestIsHealthyURL(t *testing.T) {
+	pool := newTestPool(t, StrategyRoundRobin,
+		&Backend{Name: "hk", URL: "https://cdn.example.com/hk"},
+		&Backend{Name: "jp", URL: "https://cdn.example.com/jp"},
+		&Backend{Name: "sg", URL: "https://sg.example.com/stream"},
+	)
+	pool.backends[0].healthy = false
+
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{url: "https://cdn.example.com/hk/Movies/a.mkv?signature=x", want: false},
+		{url: "https://cdn.example.com/jp/Movies/a.mkv?signature=x", want: true},
+		{url: "https://sg.example.com/stream/Movies/a.mkv", want: true},
+		// CDN auth types B and C move the path, the host still identifies the backend.
+		{url: "https://cdn.example.com/1700000000/abc/hk/Movies/a.mkv", want: false},
+		{url: "http://cdn.example.com/hk/Movies/a.mkv", want: true},
+		// URLs of other hosts, e.g. Alist or S3 links, are not the pool's business.
+		{url: "https://unknown.example.com/hk/Movies/a.mkv", want: true},
+		{url: "://not a url", want: true},
+	}
+
+	for _, test := range tests {
+		if got := pool.IsHealthyURL(test.url); got != test.want {
+			t.Errorf("IsHealthyURL(%q) = %v, want %v", test.url, got, test.want)
+		}
+	}
+}
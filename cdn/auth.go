@@ -0,0 +1,89 @@
+package cdn
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// now returns the current time, replaced in tests.
+var now = time.Now
+
+// authTypeBLocation is the time zone of type B timestamps (UTC+8).
+var authTypeBLocation = time.FixedZone("UTC+8", 8*60*60)
+
+// AuthSigner implements the URL authentication types A, B and C shared by
+// Alibaba Cloud CDN and Tencent Cloud CDN.
+//
+// The CDN considers a link valid for a console-configured period after its timestamp, so the
+// timestamp is set ValidityPeriod before expireAt. Without ValidityPeriod, the current time is used.
+type AuthSigner struct {
+	Type           string        // TypeAuthA, TypeAuthB or TypeAuthC
+	Key            string        // Private key configured in the CDN console
+	ParamName      string        // Query parameter of type A, auth_key when empty (Tencent defaults to sign)
+	ValidityPeriod time.Duration // Validity period configured in the CDN console
+}
+
+// SignURL signs the path of the URL. Type A adds a query parameter, types B and C prefix the path.
+func (s *AuthSigner) SignURL(rawURL string, expireAt time.Time) (string, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	timestamp := now()
+	if s.ValidityPeriod > 0 {
+		timestamp = expireAt.Add(-s.ValidityPeriod)
+	}
+
+	uri := parsedURL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+
+	switch s.Type {
+	case TypeAuthA:
+		paramName := s.ParamName
+		if paramName == "" {
+			paramName = "auth_key"
+		}
+		return appendQuery(parsedURL, paramName+"="+s.authTypeA(uri, timestamp.Unix(), "0", "0")), nil
+	case TypeAuthB:
+		formatted := timestamp.In(authTypeBLocation).Format("200601021504")
+		return s.prefixPath(parsedURL, formatted+"/"+md5Hex(s.Key+formatted+uri), uri), nil
+	case TypeAuthC:
+		hexTimestamp := strings.ToUpper(strconv.FormatInt(timestamp.Unix(), 16))
+		return s.prefixPath(parsedURL, md5Hex(s.Key+uri+hexTimestamp)+"/"+hexTimestamp, uri), nil
+	default:
+		return "", fmt.Errorf("unsupported cdn auth type: %s", s.Type)
+	}
+}
+
+// authTypeA returns the "timestamp-rand-uid-md5hash" value of type A.
+func (s *AuthSigner) authTypeA(uri string, timestamp int64, random, uid string) string {
+	prefix := fmt.Sprintf("%d-%s-%s", timestamp, random, uid)
+	return prefix + "-" + md5Hex(uri+"-"+prefix+"-"+s.Key)
+}
+
+// prefixPath places the authentication segments in front of the original path.
+func (s *AuthSigner) prefixPath(parsedURL *url.URL, segments, uri string) string {
+	signedURL := *parsedURL
+	signedURL.Path = ""
+	signedURL.RawPath = ""
+	signedURL.RawQuery = ""
+	result := signedURL.String() + "/" + segments + uri
+	if parsedURL.RawQuery != "" {
+		result += "?" + parsedURL.RawQuery
+	}
+	return result
+}
+
+// md5Hex returns the lowercase hex md5 of the value.
+func md5Hex(value string) string {
+	sum := md5.Sum([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,82 @@
+package cdn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthSignerSignURL(t *testing.T) {
+	// The inputs are the ones of the Alibaba Cloud CDN documentation: private key aliyuncdnexp1234,
+	// timestamp 1444435200 for type A and 2015-08-15 08:00 (UTC+8) for types B and C.
+	tests := []struct {
+		name     string
+		signer   AuthSigner
+		rawURL   string
+		signedAt time.Time
+		want     string
+	}{
+		{
+			name:     "type A",
+			signer:   AuthSigner{Type: TypeAuthA, Key: "aliyuncdnexp1234"},
+			rawURL:   "http://example.com/video/standard/1K.html",
+			signedAt: time.Unix(1444435200, 0),
+			want:     "http://example.com/video/standard/1K.html?auth_key=1444435200-0-0-80cd3862d699b7118eed99103f2a3a4f",
+		},
+		{
+			name:     "type A with query and parameter name",
+			signer:   AuthSigner{Type: TypeAuthA, Key: "aliyuncdnexp1234", ParamName: "sign"},
+			rawURL:   "http://example.com/video/standard/1K.html?a=1",
+			signedAt: time.Unix(1444435200, 0),
+			want:     "http://example.com/video/standard/1K.html?a=1&sign=1444435200-0-0-80cd3862d699b7118eed99103f2a3a4f",
+		},
+		{
+			name:     "type B",
+			signer:   AuthSigner{Type: TypeAuthB, Key: "aliyuncdnexp1234"},
+			rawURL:   "http://example.com/4/44/44c0909bcfc20a01afaf256ca99a8b8b.mp3",
+			signedAt: time.Unix(1439596800, 0),
+			want:     "http://example.com/201508150800/9044548ef1527deadafa49a890a377f0/4/44/44c0909bcfc20a01afaf256ca99a8b8b.mp3",
+		},
+		{
+			name:     "type C",
+			signer:   AuthSigner{Type: TypeAuthC, Key: "aliyuncdnexp1234"},
+			rawURL:   "http://example.com/4/44/44c0909bcfc20a01afaf256ca99a8b8b.mp3?a=1",
+			signedAt: time.Unix(1439596800, 0),
+			want:     "http://example.com/745eab552f1dfa73534c0b83add39c06/55CE8100/4/44/44c0909bcfc20a01afaf256ca99a8b8b.mp3?a=1",
+		},
+		{
+			name:     "type C from validity period",
+			signer:   AuthSigner{Type: TypeAuthC, Key: "aliyuncdnexp1234", ValidityPeriod: time.Hour},
+			rawURL:   "http://example.com/4/44/44c0909bcfc20a01afaf256ca99a8b8b.mp3?a=1",
+			signedAt: time.Unix(1439596800+3600, 0),
+			want:     "http://example.com/745eab552f1dfa73534c0b83add39c06/55CE8100/4/44/44c0909bcfc20a01afaf256ca99a8b8b.mp3?a=1",
+		},
+	}
+
+	defer func() { now = time.Now }()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signedAt := test.signedAt
+			expireAt := signedAt
+			if test.signer.ValidityPeriod > 0 {
+				// The timestamp is derived from expireAt, the clock must not be used.
+				signedAt = time.Unix(0, 0)
+			}
+			now = func() time.Time { return signedAt }
+
+			got, err := test.signer.SignURL(test.rawURL, expireAt)
+			if err != nil {
+				t.Fatalf("SignURL returned error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("SignURL(%q)\n got: %s\nwant: %s", test.rawURL, got, test.want)
+			}
+		})
+	}
+}
+
+func TestAuthSignerUnsupportedType(t *testing.T) {
+	signer := AuthSigner{Type: "auth-d", Key: "key"}
+	if _, err := signer.SignURL("http://example.com/a", time.Now()); err == nil {
+		t.Error("SignURL accepted an unsupported type")
+	}
+}
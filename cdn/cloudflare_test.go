@@ -0,0 +1,42 @@
+package cdn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCloudflareSignURL(t *testing.T) {
+	expireAt := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name   string
+		signer CloudflareSigner
+		rawURL string
+		want   string
+	}{
+		{
+			name:   "default parameter",
+			signer: CloudflareSigner{Key: []byte("secret")},
+			rawURL: "https://cdn.example.com/videos/movie.mp4",
+			want:   "https://cdn.example.com/videos/movie.mp4?verify=1700000000-mSGNKOngDSluCsk9uo01s%2B0OLvHj5dNtMVRJxa84HPI%3D",
+		},
+		{
+			name:   "query is not signed",
+			signer: CloudflareSigner{Key: []byte("secret"), ParamName: "token"},
+			rawURL: "https://cdn.example.com/videos/movie.mp4?a=1",
+			want:   "https://cdn.example.com/videos/movie.mp4?a=1&token=1700000000-mSGNKOngDSluCsk9uo01s%2B0OLvHj5dNtMVRJxa84HPI%3D",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.signer.SignURL(test.rawURL, expireAt)
+			if err != nil {
+				t.Fatalf("SignURL returned error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("SignURL(%q)\n got: %s\nwant: %s", test.rawURL, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package cdn
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"math/big"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRSAKey is the RSA key of the CloudFront signer tests of the AWS SDK for Go,
+// so that the signatures below are the ones published with it.
+var testRSAKey = &rsa.PrivateKey{
+	PublicKey: rsa.PublicKey{
+		N: fromBase10(
+			"1431413293124100665099808488927402060891804903267185832598839685133412424518821425195619873133346421" +
+				"7832226406088020736932173064754214329009979944037640912127943488972644697423190955557435910767690712" +
+				"7784635249836678528190102594996951773131154471161103585245583079476134228977873292214788609079638271" +
+				"6022355969052366057432901192753128965571186050463057376660923933256921083132563384017468394455366735" +
+				"2219670930408593321661375473885147973879086994006440025257225431977751512374815915392249179976902953" +
+				"7214860407877928018498182544654866337918267668730766171167270730778215846767156099857775639582866371" +
+				"85868165868520557"),
+		E: 3,
+	},
+	D: fromBase10(
+		"9542755287494004433998723259516013739278699355114572217325597900889416163458809501304132487555642811" +
+			"8881509373920138246214487098361428860066532960250939414186289926484297982821273037049572738451271418" +
+			"5230901665577856854600683966646345154207696474407357234970553863174228193185821948098590727197588477" +
+			"3482372966847639853897890615456605598071088189838676728836833012254065983259638538107719766738032720" +
+			"2398920941961087133788228823836944560300434925710634419438471959395497732716946476575496586033656294" +
+			"5861027382129223264633471761267451999753390105279033427966175417649059304194186393230868719761867152" +
+			"8035670452762731"),
+	Primes: []*big.Int{
+		fromBase10(
+			"1309032551829967224267716136060777552955833291350673401529471728684158090275373763061931796242988742" +
+				"1560827080205434760983677647393007241195875304456221453701387410380200636963476107437721399598387678" +
+				"8718033850153719421695468704276694983032644416930879093914927146648402139231293035971427838068945045" +
+				"019075433"),
+		fromBase10(
+			"1093489456104854535775747676525274729242892295382866496612409389880203670054757279882534386475609585" +
+				"7350615944953879354047282981590394934319109181777924010105455274866526757427116361769464051354969384" +
+				"1337820602726596756351006149518830932261246698766355347898158548465400674856021497190430791824869615" +
+				"170301029"),
+	},
+}
+
+func fromBase10(value string) *big.Int {
+	number, ok := new(big.Int).SetString(value, 10)
+	if !ok {
+		panic("invalid number: " + value)
+	}
+	return number
+}
+
+func TestCloudFrontSignURL(t *testing.T) {
+	signer := &CloudFrontSigner{KeyPairID: "KeyID", PrivateKey: testRSAKey}
+	expireAt := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		rawURL string
+		want   string
+	}{
+		{
+			rawURL: "http://example.com/a",
+			want: "http://example.com/a?Expires=1257894000&Signature=" +
+				"cMutWOvPMOPuh0KFDsOdbML~1fe0eEBC1hdMLGRbYr3mTRrVbKDdUXL6l3vlbE0Og3rTRS6mlaSORTwesN1srESH1pXFUyCVba8tWqNy1frEiL7jZLyzA1KndH0olfJDfgHXdw-Edtk0m8mqY~AnGIYGYDu659dWeP49jVeYn30XF9sYkRCdS5IezAkqh8TO9tTDNGS4Ic6DQue4agHUFLNv1VErTafUxlSBp8hlPCuMdtZLEBLr9UJVc3oWJI3zc1~9JgVTDjbXYV1-HgTn8qQsbAU2KcieUonIzTme2td-7c2FCC0EAbOF~6QXTHWcAiSB5nVmbxn-Mx-QMVsiLw__" +
+				"&Key-Pair-Id=KeyID",
+		},
+		{
+			rawURL: "https://example.com/a?b=1&c=2",
+			want: "https://example.com/a?b=1&c=2&Expires=1257894000&Signature=" +
+				"E6xB7RtIDvx8AxM1Wuup3ROYTQwBDW-qqcrb8lSUvtL78wenjh3P0YLXK-mFK0PSzdNtzI2ZIXja6Nh2yma0IVQiZMjn3wijvVsMy9fRXyusVXB1zYSfiInVr2uhqSb-ZCn1RD32ebyMD6IWn5Kss1fT4wefc8Q76J0Y4jprAvmLCtGnrW~quZdOg~KKmY-qK11ifNwv2ECADBxZeEx1PIDHdWuXYrCBJIwSl-bVscwQWDm2BzeYuHCaLuAVDuc62JJzc7nX3E1CA1VRHY~vegYjOV6zVxtp7aBV4RJUY4yfHNM4n640FXUPPwMacqE-lnNOfx704YVTl4tjzuvzuA__" +
+				"&Key-Pair-Id=KeyID",
+		},
+	}
+
+	for _, test := range tests {
+		got, err := signer.SignURL(test.rawURL, expireAt)
+		if err != nil {
+			t.Fatalf("SignURL(%q) returned error: %v", test.rawURL, err)
+		}
+		if got != test.want {
+			t.Errorf("SignURL(%q)\n got: %s\nwant: %s", test.rawURL, got, test.want)
+		}
+	}
+}
+
+func TestCannedPolicy(t *testing.T) {
+	expireAt := time.Unix(1357034400, 0)
+
+	tests := []struct {
+		resource string
+		want     string
+	}{
+		{
+			resource: "http://d111111abcdef8.cloudfront.net/horizon.jpg?large=yes&license=yes",
+			want: `{"Statement":[{"Resource":"http://d111111abcdef8.cloudfront.net/horizon.jpg?large=yes&license=yes",` +
+				`"Condition":{"DateLessThan":{"AWS:EpochTime":1357034400}}}]}`,
+		},
+		{
+			resource: `http://example.com/a"b\c`,
+			want: `{"Statement":[{"Resource":"http://example.com/a\"b\\c",` +
+				`"Condition":{"DateLessThan":{"AWS:EpochTime":1357034400}}}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := cannedPolicy(test.resource, expireAt)
+		if err != nil {
+			t.Fatalf("cannedPolicy(%q) returned error: %v", test.resource, err)
+		}
+		if string(got) != test.want {
+			t.Errorf("cannedPolicy(%q)\n got: %s\nwant: %s", test.resource, got, test.want)
+		}
+	}
+}
+
+func TestCloudFrontSignatureVerifies(t *testing.T) {
+	signer := &CloudFrontSigner{KeyPairID: "KeyID", PrivateKey: testRSAKey}
+	expireAt := time.Unix(1357034400, 0)
+	rawURL := `http://example.com/a"b?c=1`
+
+	signedURL, err := signer.SignURL(rawURL, expireAt)
+	if err != nil {
+		t.Fatalf("SignURL returned error: %v", err)
+	}
+	signature, err := decodeCloudFrontSignature(signedURL)
+	if err != nil {
+		t.Fatalf("Failed to decode signature of %s: %v", signedURL, err)
+	}
+
+	policy, err := cannedPolicy(rawURL, expireAt)
+	if err != nil {
+		t.Fatalf("cannedPolicy returned error: %v", err)
+	}
+	hashed := sha1.Sum(policy)
+	if err := rsa.VerifyPKCS1v15(&testRSAKey.PublicKey, crypto.SHA1, hashed[:], signature); err != nil {
+		t.Errorf("Signature does not verify against the escaped policy: %v", err)
+	}
+}
+
+// decodeCloudFrontSignature extracts the raw signature from a signed URL.
+func decodeCloudFrontSignature(signedURL string) ([]byte, error) {
+	parsedURL, err := url.Parse(signedURL)
+	if err != nil {
+		return nil, err
+	}
+	encoded := strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(parsedURL.Query().Get("Signature"))
+	return base64.StdEncoding.DecodeString(encoded)
+}
@@ -0,0 +1,61 @@
+// Package cdn signs streaming URLs for the URL authentication schemes of CDN providers.
+package cdn
+
+import (
+	"PiliPili_Frontend/config"
+	"errors"
+	"net/url"
+	"time"
+)
+
+// Signer types supported by NewSigner.
+const (
+	TypeCloudFront = "cloudfront" // CloudFront canned-policy signed URLs
+	TypeAuthA      = "auth-a"     // Alibaba Cloud / Tencent Cloud CDN authentication type A
+	TypeAuthB      = "auth-b"     // Alibaba Cloud / Tencent Cloud CDN authentication type B
+	TypeAuthC      = "auth-c"     // Alibaba Cloud / Tencent Cloud CDN authentication type C
+	TypeCloudflare = "cloudflare" // Cloudflare-style HMAC token
+)
+
+// Signer adds the authentication of a CDN to a URL so that the CDN serves it until expireAt.
+type Signer interface {
+	SignURL(rawURL string, expireAt time.Time) (string, error)
+}
+
+// NewSigner creates the signer described by the configuration.
+// An empty type returns a nil Signer, meaning URLs are left unchanged.
+func NewSigner(cfg config.CDNConfig) (Signer, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case TypeCloudFront:
+		return NewCloudFrontSigner(cfg.KeyPairID, cfg.PrivateKeyFile)
+	case TypeAuthA, TypeAuthB, TypeAuthC:
+		if cfg.Key == "" {
+			return nil, errors.New("cdn auth key is missing")
+		}
+		return &AuthSigner{
+			Type:           cfg.Type,
+			Key:            cfg.Key,
+			ParamName:      cfg.ParamName,
+			ValidityPeriod: time.Duration(cfg.ValidityPeriod) * time.Second,
+		}, nil
+	case TypeCloudflare:
+		if cfg.Key == "" {
+			return nil, errors.New("cloudflare hmac key is missing")
+		}
+		return &CloudflareSigner{Key: []byte(cfg.Key), ParamName: cfg.ParamName}, nil
+	default:
+		return nil, errors.New("unsupported cdn signer type: " + cfg.Type)
+	}
+}
+
+// appendQuery adds the encoded parameters to the query string of the URL.
+func appendQuery(parsedURL *url.URL, query string) string {
+	if parsedURL.RawQuery == "" {
+		parsedURL.RawQuery = query
+	} else {
+		parsedURL.RawQuery += "&" + query
+	}
+	return parsedURL.String()
+}
@@ -2,22 +2,163 @@ package config
 
 import (
 	"PiliPili_Frontend/util"
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
 // Config holds all configuration values.
 type Config struct {
-	LogLevel                string               // Log level (e.g., INFO, DEBUG, ERROR)
-	Encipher                string               // Key used for encryption and obfuscation
-	EmbyURL                 string               // Emby server URL
-	EmbyPort                int                  // Emby server port
-	EmbyAPIKey              string               // API key for Emby server
-	FrontendSymlinkBasePath string               // Frontend symlink base path
-	BackendURL              string               // Backend streaming server URL
-	BackendStorageBasePath  string               // Backend streaming storage base path
-	PlayURLMaxAliveTime     int                  // Maximum lifetime of the play URL
-	ServerPort              int                  // Server port
-	SpecialMedias           []SpecialMediaConfig // Special media configurations as a list
+	LogLevel                   string                     // Log level (e.g., INFO, DEBUG, ERROR)
+	Encipher                   string                     // Key used for encryption and obfuscation
+	SignatureVersion           int                        // Stream token version to issue (1 = legacy, 2 = path bound)
+	SignatureNotBefore         bool                       // Whether issued tokens carry a not-before time
+	SignatureClockSkew         int                        // Clock-skew tolerance in seconds for expireAt/nbf checks
+	SignatureLegacyGracePeriod int                        // Seconds after start-up during which legacy tokens still verify
+	SignatureKeys              []SignatureKeyConfig       // Signing keyring, overrides Encipher for stream tokens when set
+	SignaturePathEncryption    string                     // AEAD hiding the media path in the token: aes-gcm or chacha20-poly1305, empty to disable
+	SignatureBindClientIP      bool                       // Whether tokens are bound to the network of the requesting client
+	SignatureIPv4Prefix        int                        // Prefix length of the bound IPv4 network, 32 for the exact address
+	SignatureIPv6Prefix        int                        // Prefix length of the bound IPv6 network, 128 for the exact address
+	MediaServerType            string                     // Media server type: emby or jellyfin
+	EmbyURL                    string                     // Emby server URL
+	EmbyPort                   int                        // Emby server port
+	EmbyAPIKey                 string                     // API key for Emby server
+	EmbyRetries                int                        // Retries of failed idempotent media server requests
+	EmbyRetryBackoff           int                        // Milliseconds before the first retry, doubled for every further retry and jittered
+	EmbyRetryMaxBackoff        int                        // Upper bound in milliseconds of the retry backoff
+	EmbyBreakerThreshold       int                        // Consecutive failed requests opening the circuit breaker, 0 to disable it
+	EmbyBreakerCooldown        int                        // Seconds the circuit breaker stays open before a request probes the media server
+	AuthTokenCacheTTL          int                        // Seconds a validated client token stays cached
+	CacheType                  string                     // Cache backend: memory (per instance) or redis (shared)
+	CacheMemoryLimit           int                        // Size limit shared by all in-memory caches in MiB
+	CacheSafetyMargin          int                        // Seconds before the expiry of a streaming URL at which it leaves the cache
+	MediaPathCacheTTL          int                        // Seconds resolved media paths are cached, 0 to always ask the media server
+	MediaPathStaleTTL          int                        // Seconds expired media paths are kept to be served while the media server is unavailable
+	MediaPathWebhookToken      string                     // Token query parameter required by the media server webhook, which is disabled when empty
+	MediaPathWebhookEvents     []string                   // Webhook events invalidating the cached paths of their item
+	CacheRedis                 RedisConfig                // Redis connection of the redis cache backend
+	FrontendSymlinkBasePath    string                     // Frontend symlink base path
+	StrmRewrites               []RemoteRewriteConfig      // Rewrite rules of remote URLs and .strm targets
+	BackendURL                 string                     // Backend streaming server URL
+	BackendStorageBasePath     string                     // Backend streaming storage base path
+	BackendServers             []BackendServerConfig      // Pool of streaming backends, overrides BackendURL when set
+	BackendBalance             string                     // Load balancing strategy of the backend pool
+	BackendHealthCheck         HealthCheckConfig          // Active health checks of the backend pool
+	PlayURLMaxAliveTime        int                        // Maximum lifetime of the play URL
+	ProxyMode                  string                     // Streaming mode: redirect (302) or proxy
+	ProxyUserAgents            []string                   // User-Agent patterns that are always proxied
+	ServerPort                 int                        // Server port
+	ServerTrustedProxies       []string                   // Proxies (IPs or CIDRs) whose forwarding headers are trusted for the client IP
+	ServerRemoteIPHeaders      []string                   // Headers carrying the client IP, read when the peer is a trusted proxy
+	AdminToken                 string                     // Bearer token of the admin endpoints, which are disabled when empty
+	RevocationFile             string                     // File the token revocation list is persisted to, empty to keep it in memory; unused with a redis cache
+	RevocationPollToken        string                     // Bearer token backends send when polling the revocation list, which is not served when empty
+	PathMappings               []PathMappingConfig        // Ordered rules routing media paths to backends
+	PlaybackInfoEnabled        bool                       // Whether intercepted PlaybackInfo responses are rewritten
+	PlaybackInfoDirectStream   string                     // Default direct stream mode: force, keep or disable
+	PlaybackInfoTranscoding    string                     // Default transcoding mode: keep or disable
+	PlaybackInfoPolicies       []PlaybackInfoPolicyConfig // Per-user and per-client PlaybackInfo modes
+	SpecialMedias              []SpecialMediaConfig       // Special media configurations as a list
+}
+
+// SignatureKeyConfig describes one key of the signing keyring.
+type SignatureKeyConfig struct {
+	ID        string // Key ID carried by the tokens signed with the key
+	Algorithm string // hmac-sha256 (default) or ed25519
+	Key       string // 16-byte HMAC key, or base64-encoded 32-byte ed25519 seed
+	State     string // active (signs and verifies) or verify (verifies only)
+}
+
+// BackendServerConfig describes one streaming backend of the pool.
+type BackendServerConfig struct {
+	Name      string    // Unique name of the backend
+	URL       string    // Backend streaming server URL
+	Weight    int       // Relative weight used by the weighted strategy
+	HealthURL string    // URL probed by the health checker, empty to disable probing
+	CDN       CDNConfig // URL authentication of the CDN in front of the backend
+}
+
+// CDNConfig describes the URL authentication scheme of a CDN in front of a backend.
+type CDNConfig struct {
+	Type           string // cloudfront, auth-a, auth-b, auth-c or cloudflare, empty for no CDN signing
+	Key            string // Private key of the auth types, HMAC key of cloudflare
+	KeyPairID      string // CloudFront key pair (public key) ID
+	PrivateKeyFile string // PEM RSA private key of the CloudFront key pair
+	ParamName      string // Query parameter of auth-a (auth_key) and cloudflare (verify)
+	ValidityPeriod int    // Seconds the CDN console lets auth-a/b/c links live after their timestamp
+}
+
+// HealthCheckConfig holds the active health check settings of the backend pool.
+type HealthCheckConfig struct {
+	Interval           int // Seconds between two probes
+	Timeout            int // Timeout of a single probe in seconds
+	UnhealthyThreshold int // Consecutive failures before a backend leaves rotation
+	HealthyThreshold   int // Consecutive successes before a backend rejoins rotation
+}
+
+// RedisConfig holds the connection settings of the Redis cache backend.
+type RedisConfig struct {
+	Addr     string // host:port of the Redis server
+	Username string // ACL user name, empty for the default user
+	Password string // Password, empty when Redis has none
+	DB       int    // Database number
+	Prefix   string // Prefix of every key, separating deployments sharing a Redis
+}
+
+// PathMappingConfig describes a rule that routes matching media paths to specific backends.
+type PathMappingConfig struct {
+	Name     string      // Description of the rule, used in logs
+	Prefix   string      // Path prefix to match, ignored when Regex is set
+	Regex    string      // Regular expression to match
+	Rewrite  string      // Replacement for the matched prefix, or regex replacement (supports $1 etc.)
+	Backends []string    // Names of the Backend.servers serving this rule, empty for the whole pool
+	Encipher string      // Signing key of the rule's backends, empty to use the global Encipher
+	Kind     string      // Backend kind: pilipili (default), alist, s3 or nginx
+	Alist    AlistConfig // Alist server resolving direct links, used by the alist kind
+	S3       S3Config    // Object storage presigning URLs, used by the s3 kind
+	Nginx    NginxConfig // nginx secure_link settings, used by the nginx kind
+}
+
+// AlistConfig describes an Alist / OpenList server that resolves direct links.
+type AlistConfig struct {
+	URL      string // Alist server URL
+	Token    string // Alist API token
+	Password string // Meta password of protected folders
+	CacheTTL int    // Maximum seconds a resolved link is cached, capped by the link's own expiry
+}
+
+// S3Config describes an S3-compatible bucket whose objects are served through presigned URLs.
+type S3Config struct {
+	Endpoint     string // Endpoint URL, empty for the AWS endpoint of the region
+	Region       string // Signing region, us-east-1 when empty
+	Bucket       string // Bucket name, empty to take it from the first segment of the mapped path
+	AccessKey    string // Access key ID
+	SecretKey    string // Secret access key
+	SessionToken string // Session token of temporary credentials
+	PathStyle    bool   // Address the bucket in the path instead of the host name (MinIO)
+}
+
+// NginxConfig describes plain nginx servers protected by the secure_link module.
+type NginxConfig struct {
+	SkipRemoteAddr bool   // Leave $remote_addr out of the hash, required when streams are proxied
+	Root           string // Directory nginx serves the mapped paths from, only used by nginx-snippet
+}
+
+// RemoteRewriteConfig rewrites the remote URL of a .strm file or http(s) media path.
+type RemoteRewriteConfig struct {
+	Match    string            // Regular expression matched against the remote URL
+	Template string            // New URL, supports $1 and the {scheme}, {host}, {path}, {query} placeholders
+	Headers  map[string]string // Headers sent upstream when the target is proxied
+	Proxy    bool              // Always proxy the target, e.g. because it needs Headers
+}
+
+// PlaybackInfoPolicyConfig overrides the PlaybackInfo modes for some users or clients.
+type PlaybackInfoPolicyConfig struct {
+	Name         string   // Description of the policy, used in logs
+	Users        []string // Emby user IDs or names the policy applies to
+	Clients      []string // Regular expressions matched against the client name and User-Agent
+	DirectStream string   // Direct stream mode: force, keep or disable
+	Transcoding  string   // Transcoding mode: keep or disable
 }
 
 // SpecialMediaConfig holds the media path and source ID for a specific media.
@@ -32,6 +173,15 @@ type SpecialMediaConfig struct {
 // globalConfig stores the loaded configuration.
 var globalConfig Config
 
+var (
+	// defaultTrustedProxies trusts the nginx instance running next to the frontend.
+	defaultTrustedProxies = []string{"127.0.0.1", "::1"}
+	// defaultRemoteIPHeaders are the headers set by the nginx.conf shipped with the project.
+	defaultRemoteIPHeaders = []string{"X-Forwarded-For", "X-Real-IP"}
+	// defaultMediaPathWebhookEvents are the Emby and Jellyfin events that can change the files of an item.
+	defaultMediaPathWebhookEvents = []string{"library.new", "library.deleted", "ItemAdded", "ItemUpdated", "ItemDeleted"}
+)
+
 // Initialize loads the configuration from the provided config file and initializes the logger.
 func Initialize(configFile string, loglevel string) error {
 	viper.SetConfigType("yaml")
@@ -43,38 +193,175 @@ func Initialize(configFile string, loglevel string) error {
 	if err := viper.ReadInConfig(); err != nil {
 		// Default configuration
 		globalConfig = Config{
-			LogLevel:                defaultLogLevel(loglevel),
-			Encipher:                "vPQC5LWCN2CW2opz",
-			EmbyURL:                 "http://127.0.0.1",
-			EmbyPort:                8096,
-			EmbyAPIKey:              "",
-			FrontendSymlinkBasePath: "",
-			BackendURL:              "",
-			BackendStorageBasePath:  "",
-			PlayURLMaxAliveTime:     6 * 60 * 60,
-			ServerPort:              60002,
-			SpecialMedias:           []SpecialMediaConfig{},
+			LogLevel:                   defaultLogLevel(loglevel),
+			Encipher:                   "vPQC5LWCN2CW2opz",
+			SignatureVersion:           2,
+			SignatureNotBefore:         false,
+			SignatureClockSkew:         30,
+			SignatureLegacyGracePeriod: 6 * 60 * 60,
+			SignatureKeys:              []SignatureKeyConfig{},
+			SignaturePathEncryption:    "",
+			SignatureBindClientIP:      false,
+			SignatureIPv4Prefix:        32,
+			SignatureIPv6Prefix:        64,
+			MediaServerType:            "emby",
+			EmbyURL:                    "http://127.0.0.1",
+			EmbyPort:                   8096,
+			EmbyAPIKey:                 "",
+			EmbyRetries:                2,
+			EmbyRetryBackoff:           200,
+			EmbyRetryMaxBackoff:        2000,
+			EmbyBreakerThreshold:       5,
+			EmbyBreakerCooldown:        30,
+			AuthTokenCacheTTL:          60,
+			CacheType:                  "memory",
+			CacheMemoryLimit:           64,
+			CacheSafetyMargin:          60,
+			MediaPathCacheTTL:          24 * 60 * 60,
+			MediaPathStaleTTL:          7 * 24 * 60 * 60,
+			MediaPathWebhookToken:      "",
+			MediaPathWebhookEvents:     defaultMediaPathWebhookEvents,
+			CacheRedis:                 RedisConfig{Addr: "127.0.0.1:6379", Prefix: "pilipili:"},
+			FrontendSymlinkBasePath:    "",
+			StrmRewrites:               []RemoteRewriteConfig{},
+			BackendURL:                 "",
+			BackendStorageBasePath:     "",
+			BackendServers:             []BackendServerConfig{},
+			BackendBalance:             "round-robin",
+			BackendHealthCheck:         HealthCheckConfig{Interval: 10, Timeout: 3, UnhealthyThreshold: 2, HealthyThreshold: 1},
+			PlayURLMaxAliveTime:        6 * 60 * 60,
+			ProxyMode:                  "redirect",
+			ProxyUserAgents:            []string{},
+			ServerPort:                 60002,
+			ServerTrustedProxies:       defaultTrustedProxies,
+			ServerRemoteIPHeaders:      defaultRemoteIPHeaders,
+			AdminToken:                 "",
+			RevocationFile:             "",
+			RevocationPollToken:        "",
+			PathMappings:               []PathMappingConfig{},
+			PlaybackInfoEnabled:        false,
+			PlaybackInfoDirectStream:   "force",
+			PlaybackInfoTranscoding:    "keep",
+			PlaybackInfoPolicies:       []PlaybackInfoPolicyConfig{},
+			SpecialMedias:              []SpecialMediaConfig{},
 		}
 	} else {
 		// Load configuration from file
 		globalConfig = Config{
-			LogLevel:                getLogLevel(loglevel),
-			Encipher:                viper.GetString("Encipher"),
-			EmbyURL:                 viper.GetString("Emby.url"),
-			EmbyPort:                viper.GetInt("Emby.port"),
-			EmbyAPIKey:              viper.GetString("Emby.apiKey"),
-			FrontendSymlinkBasePath: viper.GetString("Frontend.symlinkBasePath"),
-			BackendURL:              viper.GetString("Backend.url"),
-			BackendStorageBasePath:  viper.GetString("Backend.storageBasePath"),
-			PlayURLMaxAliveTime:     viper.GetInt("PlayURLMaxAliveTime"),
-			ServerPort:              viper.GetInt("Server.port"),
-			SpecialMedias:           loadSpecialMedias(),
+			LogLevel:                   getLogLevel(loglevel),
+			Encipher:                   viper.GetString("Encipher"),
+			SignatureVersion:           viper.GetInt("Signature.version"),
+			SignatureNotBefore:         viper.GetBool("Signature.notBefore"),
+			SignatureClockSkew:         viper.GetInt("Signature.clockSkew"),
+			SignatureLegacyGracePeriod: getLegacyGracePeriod(),
+			SignatureKeys:              loadSignatureKeys(),
+			SignaturePathEncryption:    viper.GetString("Signature.pathEncryption"),
+			SignatureBindClientIP:      viper.GetBool("Signature.bindClientIP"),
+			SignatureIPv4Prefix:        getIntOrDefault("Signature.ipv4Prefix", 32),
+			SignatureIPv6Prefix:        getIntOrDefault("Signature.ipv6Prefix", 64),
+			MediaServerType:            viper.GetString("Emby.type"),
+			EmbyURL:                    viper.GetString("Emby.url"),
+			EmbyPort:                   viper.GetInt("Emby.port"),
+			EmbyAPIKey:                 viper.GetString("Emby.apiKey"),
+			EmbyRetries:                getIntOrDefault("Emby.retries", 2),
+			EmbyRetryBackoff:           getIntOrDefault("Emby.retryBackoff", 200),
+			EmbyRetryMaxBackoff:        getIntOrDefault("Emby.retryMaxBackoff", 2000),
+			EmbyBreakerThreshold:       getIntOrDefault("Emby.breakerThreshold", 5),
+			EmbyBreakerCooldown:        getIntOrDefault("Emby.breakerCooldown", 30),
+			AuthTokenCacheTTL:          viper.GetInt("Auth.tokenCacheTTL"),
+			CacheType:                  viper.GetString("Cache.type"),
+			CacheMemoryLimit:           getIntOrDefault("Cache.memoryLimit", 64),
+			CacheSafetyMargin:          getIntOrDefault("Cache.safetyMargin", 60),
+			MediaPathCacheTTL:          getIntOrDefault("MediaPathCache.ttl", 24*60*60),
+			MediaPathStaleTTL:          getIntOrDefault("MediaPathCache.staleTTL", 7*24*60*60),
+			MediaPathWebhookToken:      viper.GetString("MediaPathCache.webhookToken"),
+			MediaPathWebhookEvents:     getStringSliceOrDefault("MediaPathCache.webhookEvents", defaultMediaPathWebhookEvents),
+			CacheRedis:                 loadRedisConfig(),
+			FrontendSymlinkBasePath:    viper.GetString("Frontend.symlinkBasePath"),
+			StrmRewrites:               loadStrmRewrites(),
+			BackendURL:                 viper.GetString("Backend.url"),
+			BackendStorageBasePath:     viper.GetString("Backend.storageBasePath"),
+			BackendServers:             loadBackendServers(),
+			BackendBalance:             viper.GetString("Backend.balance"),
+			BackendHealthCheck:         loadHealthCheck(),
+			PlayURLMaxAliveTime:        viper.GetInt("PlayURLMaxAliveTime"),
+			ProxyMode:                  viper.GetString("Proxy.mode"),
+			ProxyUserAgents:            viper.GetStringSlice("Proxy.userAgents"),
+			ServerPort:                 viper.GetInt("Server.port"),
+			ServerTrustedProxies:       getStringSliceOrDefault("Server.trustedProxies", defaultTrustedProxies),
+			ServerRemoteIPHeaders:      getStringSliceOrDefault("Server.remoteIPHeaders", defaultRemoteIPHeaders),
+			AdminToken:                 viper.GetString("Admin.token"),
+			RevocationFile:             viper.GetString("Revocation.file"),
+			RevocationPollToken:        viper.GetString("Revocation.pollToken"),
+			PathMappings:               loadPathMappings(),
+			PlaybackInfoEnabled:        viper.GetBool("PlaybackInfo.enabled"),
+			PlaybackInfoDirectStream:   viper.GetString("PlaybackInfo.directStream"),
+			PlaybackInfoTranscoding:    viper.GetString("PlaybackInfo.transcoding"),
+			PlaybackInfoPolicies:       loadPlaybackInfoPolicies(),
+			SpecialMedias:              loadSpecialMedias(),
 		}
 	}
 
 	return nil
 }
 
+// loadPathMappings parses the PathMappings configuration from viper.
+func loadPathMappings() []PathMappingConfig {
+	var mappings []PathMappingConfig
+
+	if err := viper.UnmarshalKey("PathMappings", &mappings); err != nil {
+		return []PathMappingConfig{}
+	}
+
+	return mappings
+}
+
+// loadSignatureKeys parses the Signature.keys configuration from viper.
+func loadSignatureKeys() []SignatureKeyConfig {
+	var keys []SignatureKeyConfig
+
+	if err := viper.UnmarshalKey("Signature.keys", &keys); err != nil {
+		return []SignatureKeyConfig{}
+	}
+
+	return keys
+}
+
+// WatchSignatureKeys re-reads Signature.keys whenever the configuration file changes and passes
+// them to onChange. Other settings still require a restart. Nothing is watched without a config file.
+func WatchSignatureKeys(onChange func([]SignatureKeyConfig)) {
+	if viper.ConfigFileUsed() == "" {
+		return
+	}
+
+	viper.OnConfigChange(func(event fsnotify.Event) {
+		onChange(loadSignatureKeys())
+	})
+	viper.WatchConfig()
+}
+
+// loadStrmRewrites parses the Frontend.strmRewrites configuration from viper.
+func loadStrmRewrites() []RemoteRewriteConfig {
+	var rewrites []RemoteRewriteConfig
+
+	if err := viper.UnmarshalKey("Frontend.strmRewrites", &rewrites); err != nil {
+		return []RemoteRewriteConfig{}
+	}
+
+	return rewrites
+}
+
+// loadPlaybackInfoPolicies parses the PlaybackInfo.policies configuration from viper.
+func loadPlaybackInfoPolicies() []PlaybackInfoPolicyConfig {
+	var policies []PlaybackInfoPolicyConfig
+
+	if err := viper.UnmarshalKey("PlaybackInfo.policies", &policies); err != nil {
+		return []PlaybackInfoPolicyConfig{}
+	}
+
+	return policies
+}
+
 // loadSpecialMedias parses the SpecialMedias configuration from viper.
 func loadSpecialMedias() []SpecialMediaConfig {
 	var specialMedias []SpecialMediaConfig
@@ -86,11 +373,74 @@ func loadSpecialMedias() []SpecialMediaConfig {
 	return specialMedias
 }
 
+// loadBackendServers parses the Backend.servers configuration from viper.
+func loadBackendServers() []BackendServerConfig {
+	var servers []BackendServerConfig
+
+	if err := viper.UnmarshalKey("Backend.servers", &servers); err != nil {
+		return []BackendServerConfig{}
+	}
+
+	return servers
+}
+
+// loadHealthCheck parses the Backend.healthCheck configuration from viper.
+func loadHealthCheck() HealthCheckConfig {
+	return HealthCheckConfig{
+		Interval:           viper.GetInt("Backend.healthCheck.interval"),
+		Timeout:            viper.GetInt("Backend.healthCheck.timeout"),
+		UnhealthyThreshold: viper.GetInt("Backend.healthCheck.unhealthyThreshold"),
+		HealthyThreshold:   viper.GetInt("Backend.healthCheck.healthyThreshold"),
+	}
+}
+
+// loadRedisConfig parses the Cache.redis configuration from viper.
+func loadRedisConfig() RedisConfig {
+	return RedisConfig{
+		Addr:     viper.GetString("Cache.redis.addr"),
+		Username: viper.GetString("Cache.redis.username"),
+		Password: viper.GetString("Cache.redis.password"),
+		DB:       viper.GetInt("Cache.redis.db"),
+		Prefix:   viper.GetString("Cache.redis.prefix"),
+	}
+}
+
+// getLegacyGracePeriod returns the legacy token grace period, defaulting to the play URL lifetime
+// so that every legacy URL issued before an upgrade keeps working until it expires on its own.
+func getLegacyGracePeriod() int {
+	if viper.IsSet("Signature.legacyGracePeriod") {
+		return viper.GetInt("Signature.legacyGracePeriod")
+	}
+	return viper.GetInt("PlayURLMaxAliveTime")
+}
+
+// getIntOrDefault returns the integer at key, or fallback when the key is not set.
+func getIntOrDefault(key string, fallback int) int {
+	if viper.IsSet(key) {
+		return viper.GetInt(key)
+	}
+	return fallback
+}
+
+// getStringSliceOrDefault returns the list at key, or fallback when the key is not set.
+// An explicitly empty list is kept so that it can disable the default.
+func getStringSliceOrDefault(key string, fallback []string) []string {
+	if viper.IsSet(key) {
+		return viper.GetStringSlice(key)
+	}
+	return fallback
+}
+
 // GetConfig returns the global configuration.
 func GetConfig() Config {
 	return globalConfig
 }
 
+// SetConfig replaces the global configuration, e.g. with one prepared by a test.
+func SetConfig(cfg Config) {
+	globalConfig = cfg
+}
+
 // IsValid checks if all fields in SpecialMediaConfig are non-empty and valid.
 func (config SpecialMediaConfig) IsValid() bool {
 	return config.Key != "" &&
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"PiliPili_Frontend/api"
+	"PiliPili_Frontend/backend"
 	"PiliPili_Frontend/config"
 	"PiliPili_Frontend/logger"
 	"PiliPili_Frontend/middleware"
@@ -10,6 +12,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"time"
 )
 
 // initializeConfig initializes the configuration from the config file.
@@ -29,13 +32,111 @@ func initializeConfig(configFile string) error {
 	logger.InitializeLogger(loglevel)
 
 	// Initialize the Signature instance
-	encipher := config.GetConfig().Encipher
-	if err := stream.InitializeSignature(encipher); err != nil {
-		logger.Error("Failed to initialize Signature", "error", err)
+	cfg := config.GetConfig()
+	signatureOptions := stream.SignatureOptions{
+		Version:           cfg.SignatureVersion,
+		NotBefore:         cfg.SignatureNotBefore,
+		ClockSkew:         time.Duration(cfg.SignatureClockSkew) * time.Second,
+		LegacyGracePeriod: time.Duration(cfg.SignatureLegacyGracePeriod) * time.Second,
+		PathEncryption:    cfg.SignaturePathEncryption,
+	}
+	if err := stream.InitializeSignature(cfg.Encipher, cfg.SignatureKeys, signatureOptions); err != nil {
+		logger.Error("Failed to initialize Signature: %v", err)
 		return err
 	}
 	logger.Info("Signature initialized successfully")
 
+	// Reload the signing keyring whenever the configuration file changes
+	config.WatchSignatureKeys(func(keys []config.SignatureKeyConfig) {
+		if err := stream.ReloadSignatureKeys(keys); err != nil {
+			logger.Error("Failed to reload signature keys, keeping the current ones: %v", err)
+			return
+		}
+		logger.Info("Signature keys reloaded: %d key(s)", len(keys))
+	})
+
+	// Connect the cache backend shared by the caches below
+	if err := stream.InitializeCache(); err != nil {
+		logger.Error("Failed to initialize cache: %v", err)
+		return err
+	}
+	logger.Info("Cache initialized successfully")
+
+	// Configure retries and the circuit breaker of media server requests
+	if err := api.InitializeMediaServerClient(); err != nil {
+		logger.Error("Failed to initialize media server client: %v", err)
+		return err
+	}
+	logger.Info("Media server client initialized successfully")
+
+	// Initialize the validated token cache
+	if err := stream.InitializeAuth(time.Duration(cfg.AuthTokenCacheTTL) * time.Second); err != nil {
+		logger.Error("Failed to initialize token cache: %v", err)
+		return err
+	}
+	logger.Info("Token cache initialized successfully")
+
+	// Initialize the backend pool and its health checks
+	if err := backend.Initialize(); err != nil {
+		logger.Error("Failed to initialize backend pool: %v", err)
+		return err
+	}
+	logger.Info("Backend pool initialized successfully")
+
+	// Compile the path mapping rules
+	if err := stream.InitializePathMappings(); err != nil {
+		logger.Error("Failed to initialize path mappings: %v", err)
+		return err
+	}
+	logger.Info("Path mappings initialized successfully")
+
+	// Compile the remote URL rewrite rules
+	if err := stream.InitializeStrm(); err != nil {
+		logger.Error("Failed to initialize strm rewrites: %v", err)
+		return err
+	}
+	logger.Info("Strm rewrites initialized successfully")
+
+	// Initialize the Alist link cache
+	if err := stream.InitializeAlist(); err != nil {
+		logger.Error("Failed to initialize Alist link cache: %v", err)
+		return err
+	}
+	logger.Info("Alist link cache initialized successfully")
+
+	// Compile the proxy streaming rules
+	if err := stream.InitializeProxy(); err != nil {
+		logger.Error("Failed to initialize proxy streaming: %v", err)
+		return err
+	}
+	logger.Info("Proxy streaming initialized successfully")
+
+	// Compile the PlaybackInfo policies
+	if err := stream.InitializePlaybackInfo(); err != nil {
+		logger.Error("Failed to initialize PlaybackInfo policies: %v", err)
+		return err
+	}
+	logger.Info("PlaybackInfo policies initialized successfully")
+
+	// Initialize the media path cache
+	if err := stream.InitializeMediaPathCache(
+		time.Duration(cfg.MediaPathCacheTTL)*time.Second,
+		time.Duration(cfg.MediaPathStaleTTL)*time.Second,
+	); err != nil {
+		logger.Error("Failed to initialize media path cache: %v", err)
+		return err
+	}
+	logger.Info("Media path cache initialized successfully")
+
+	// Load the token revocation list
+	lifetime := time.Duration(cfg.PlayURLMaxAliveTime) * time.Second
+	clockSkew := time.Duration(cfg.SignatureClockSkew) * time.Second
+	if err := stream.InitializeRevocations(lifetime, clockSkew, cfg.RevocationFile); err != nil {
+		logger.Error("Failed to initialize revocation list: %v", err)
+		return err
+	}
+	logger.Info("Revocation list initialized successfully")
+
 	return nil
 }
 
@@ -49,26 +150,64 @@ func initializeRoutes(r *gin.Engine) {
 		"/emby/videos/:itemID/stream.:type",
 		"/emby/Videos/:itemID/stream.:type",
 		"/Videos/:itemID/stream",
+		"/Videos/:itemID/stream.:type",
+		"/Items/:itemID/Download",
+		"/Audio/:itemID/universal",
 	}
 
 	for _, path := range paths {
 		r.GET(path, stream.HandleStreamRequest)
+		r.HEAD(path, stream.HandleStreamRequest)
+	}
+
+	playbackInfoPaths := []string{
+		"/emby/Items/:itemID/PlaybackInfo",
+		"/Items/:itemID/PlaybackInfo",
+	}
+
+	for _, path := range playbackInfoPaths {
+		r.GET(path, stream.HandlePlaybackInfo)
+		r.POST(path, stream.HandlePlaybackInfo)
+	}
+
+	// The revocation feed, the media server webhook and the admin endpoints are only served with their token.
+	cfg := config.GetConfig()
+	if cfg.RevocationPollToken != "" {
+		r.GET("/revocations", middleware.BearerAuthMiddleware(cfg.RevocationPollToken), stream.HandleRevocations)
+	}
+	if cfg.MediaPathWebhookToken != "" {
+		r.POST("/webhooks/media", stream.HandleMediaWebhook)
+	}
+	if cfg.AdminToken != "" {
+		admin := r.Group("/admin", middleware.BearerAuthMiddleware(cfg.AdminToken))
+		admin.POST("/revocations", stream.HandleRevoke)
+		admin.GET("/cache/stats", stream.HandleCacheStats)
+		admin.DELETE("/media-paths/:itemID", stream.HandleInvalidateMediaPath)
 	}
 
 	logger.Info("Routes initialized successfully.")
 }
 
 // initializeGinEngine initializes the Gin engine with middlewares and routes.
-func initializeGinEngine() *gin.Engine {
+func initializeGinEngine() (*gin.Engine, error) {
 	logger.Info("Initializing Gin engine...")
 
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
+
+	// The client IP is only taken from forwarding headers set by trusted proxies, so that
+	// clients cannot pick the address their stream tokens are bound to.
+	cfg := config.GetConfig()
+	r.RemoteIPHeaders = cfg.ServerRemoteIPHeaders
+	if err := r.SetTrustedProxies(cfg.ServerTrustedProxies); err != nil {
+		logger.Error("Failed to set trusted proxies: %v", err)
+		return nil, err
+	}
 	r.Use(middleware.CorsMiddleware())
 	initializeRoutes(r)
 
 	logger.Info("Gin engine initialized successfully.")
-	return r
+	return r, nil
 }
 
 // startServer starts the Gin server on the configured port.
@@ -86,7 +225,7 @@ func startServer(r *gin.Engine) error {
 		return err
 	}
 
-	logger.Info("Server started successfully on port %s", port)
+	logger.Info("Server started successfully on port %d", port)
 	return nil
 }
 
@@ -100,7 +239,10 @@ func handleRequest(configFile string) error {
 		return err
 	}
 
-	r := initializeGinEngine()
+	r, err := initializeGinEngine()
+	if err != nil {
+		return err
+	}
 	if err := startServer(r); err != nil {
 		return err
 	}
@@ -110,12 +252,68 @@ func handleRequest(configFile string) error {
 	return nil
 }
 
+// printNginxSnippet prints the nginx secure_link location blocks matching the configuration.
+func printNginxSnippet(configFile string) error {
+	if err := config.Initialize(configFile, ""); err != nil {
+		return err
+	}
+
+	snippet, err := stream.NginxSnippet()
+	if err != nil {
+		return err
+	}
+	fmt.Print(snippet)
+	return nil
+}
+
+// printKeyPair generates an Ed25519 signing key and prints the keyring entry of the frontend
+// followed by the public key for the backend.
+func printKeyPair(keyID string) error {
+	keyPair, err := stream.GenerateEd25519KeyPair()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("# Frontend: add to Signature.keys")
+	fmt.Printf("- id: %q\n", keyID)
+	fmt.Printf("  algorithm: %q\n", stream.KeyAlgorithmEd25519)
+	fmt.Printf("  key: %q\n", keyPair.Seed)
+	fmt.Printf("  state: %q\n", stream.KeyStateActive)
+	fmt.Println()
+	fmt.Printf("# Backend: public key of %s (raw base64: %s)\n", keyID, keyPair.PublicKey)
+	fmt.Print(keyPair.PublicKeyPEM)
+	return nil
+}
+
 func main() {
 	args := os.Args[1:]
 	if len(args) == 0 {
 		fmt.Println("Please provide the configuration file as an argument.")
 		return
 	}
+
+	if args[0] == "nginx-snippet" {
+		if len(args) < 2 {
+			fmt.Println("Usage: pilipili nginx-snippet <config file>")
+			return
+		}
+		if err := printNginxSnippet(args[1]); err != nil {
+			log.Fatalf("Failed to generate nginx snippet: %v", err)
+		}
+		return
+	}
+
+	if args[0] == "keygen" {
+		keyID := time.Now().Format("20060102")
+		if len(args) > 1 {
+			keyID = args[1]
+		}
+		if err := printKeyPair(keyID); err != nil {
+			log.Fatalf("Failed to generate key pair: %v", err)
+		}
+		return
+	}
+
 	configFile := args[0]
 
 	if err := handleRequest(configFile); err != nil {
@@ -27,7 +27,7 @@ func CorsMiddleware() gin.HandlerFunc {
 
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Emby-Authorization, X-Emby-Token, X-MediaBrowser-Token")
 
 		logger.Info("Setting CORS headers for request: %s %s", c.Request.Method, c.Request.URL.Path)
 		logger.Info("Response Headers: %v", c.Writer.Header())
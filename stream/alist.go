@@ -0,0 +1,83 @@
+// Package stream handles processing of media streams.
+package stream
+
+import (
+	"PiliPili_Frontend/api"
+	"PiliPili_Frontend/logger"
+	"PiliPili_Frontend/util"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultAlistCacheTTL is used when a rule does not configure Alist.cacheTTL.
+	defaultAlistCacheTTL = 10 * time.Minute
+	// alistExpiryMargin keeps cached links from being handed out right before they expire.
+	alistExpiryMargin = 30 * time.Second
+)
+
+// alistCache remembers resolved Alist links as "<unix expiry>|<raw url>" until they expire.
+var alistCache Cache
+
+// InitializeAlist initializes the cache of resolved Alist links.
+func InitializeAlist() error {
+	var err error
+	alistCache, err = NewCache("alist", 24*time.Hour)
+	return err
+}
+
+// generateAlistURL resolves the direct link of the route's Alist path, using the cache when possible,
+// and returns it with the time until which it can be handed out.
+func generateAlistURL(route mediaRoute) (string, time.Time, error) {
+	cacheKey := route.Alist.URL + "|" + route.Path
+	if rawURL, expireAt, found := getCachedAlistURL(cacheKey); found {
+		logger.Info("Alist cache hit for path: %s", route.Path)
+		return rawURL, expireAt, nil
+	}
+
+	alistAPI := api.NewAlistAPI(route.Alist.URL, route.Alist.Token)
+	rawURL, err := alistAPI.GetRawURL(route.Path, route.Alist.Password)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	ttl := defaultAlistCacheTTL
+	if route.Alist.CacheTTL > 0 {
+		ttl = time.Duration(route.Alist.CacheTTL) * time.Second
+	}
+	expireAt := time.Now().Add(ttl)
+	if linkExpiry, ok := util.ParseURLExpiry(rawURL); ok && linkExpiry.Add(-alistExpiryMargin).Before(expireAt) {
+		expireAt = linkExpiry.Add(-alistExpiryMargin)
+	}
+
+	if expireAt.After(time.Now()) && alistCache != nil {
+		value := strconv.FormatInt(expireAt.Unix(), 10) + "|" + rawURL
+		if err := alistCache.SetUntil(cacheKey, value, expireAt); err != nil {
+			logger.Warn("Failed to cache Alist link for %s: %v", route.Path, err)
+		}
+	}
+
+	logger.Info("Resolved Alist link for %s: %s", route.Path, rawURL)
+	return rawURL, expireAt, nil
+}
+
+// getCachedAlistURL returns a cached Alist link and the time until which it can be handed out.
+func getCachedAlistURL(cacheKey string) (string, time.Time, bool) {
+	if alistCache == nil {
+		return "", time.Time{}, false
+	}
+
+	value, found := alistCache.Get(cacheKey)
+	if !found {
+		return "", time.Time{}, false
+	}
+
+	expiry, rawURL, ok := strings.Cut(value, "|")
+	expireAt, err := strconv.ParseInt(expiry, 10, 64)
+	if !ok || err != nil || expireAt <= time.Now().Unix() {
+		_ = alistCache.Delete(cacheKey)
+		return "", time.Time{}, false
+	}
+	return rawURL, time.Unix(expireAt, 0), true
+}
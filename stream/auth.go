@@ -0,0 +1,237 @@
+// Package stream handles processing of media streams.
+package stream
+
+import (
+	"PiliPili_Frontend/api"
+	"PiliPili_Frontend/config"
+	"PiliPili_Frontend/logger"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tokenCache remembers tokens that Emby has recently accepted.
+var tokenCache Cache
+
+// accessCache remembers items that Emby has recently confirmed a user can see.
+var accessCache Cache
+
+// InitializeAuth initializes the caches of validated client tokens and item access decisions
+// with the given lifetime.
+func InitializeAuth(tokenCacheTTL time.Duration) error {
+	if tokenCacheTTL <= 0 {
+		tokenCacheTTL = time.Minute
+	}
+
+	var err error
+	if tokenCache, err = NewCache("token", tokenCacheTTL); err != nil {
+		return err
+	}
+	accessCache, err = NewCache("access", tokenCacheTTL)
+	return err
+}
+
+// clientIdentity describes an authenticated caller.
+type clientIdentity struct {
+	Token    string // Emby token sent by the client
+	DeviceID string // Device ID sent by the client, if any
+	UserID   string // Emby user that owns the token, empty for the server API key
+	UserName string // Emby user name
+	IsAPIKey bool   // The token is the configured server API key
+}
+
+// cacheScope returns the key prefix that isolates cached URLs of this caller from other callers.
+// Callers without a resolved user are scoped by a digest of their token.
+func (identity clientIdentity) cacheScope() string {
+	if identity.UserID != "" {
+		return "user:" + identity.UserID
+	}
+	digest := sha256.Sum256([]byte(identity.Token))
+	return "token:" + hex.EncodeToString(digest[:8])
+}
+
+// tokenCacheKey returns the key of a token in the token cache. Tokens are cached by their digest,
+// so that they never appear in the clear in a shared Redis.
+func tokenCacheKey(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+// authenticateRequest extracts the client token from the request and validates it against Emby.
+// Responds with 401 and returns false if the token is missing or rejected.
+func authenticateRequest(c *gin.Context) (clientIdentity, bool) {
+	token := extractClientToken(c.Request)
+	if token == "" {
+		logger.Error("Missing emby token")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing emby token"})
+		return clientIdentity{}, false
+	}
+
+	identity, err := resolveClientIdentity(token, extractDeviceID(c.Request))
+	if err != nil {
+		if errors.Is(err, api.ErrUnauthorized) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid emby token"})
+		} else {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to validate emby token"})
+		}
+		return clientIdentity{}, false
+	}
+
+	return identity, true
+}
+
+// resolveClientIdentity checks the token against the cache first and falls back to Emby.
+// The user is resolved from the token alone; the device ID is only carried along. Apart from the
+// configured server API key, tokens that Emby accepts but cannot tie to a user are rejected.
+func resolveClientIdentity(token, deviceID string) (clientIdentity, error) {
+	identity := clientIdentity{Token: token, DeviceID: deviceID}
+
+	if apiKey := config.GetConfig().EmbyAPIKey; apiKey != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(apiKey)) == 1 {
+		identity.IsAPIKey = true
+		return identity, nil
+	}
+
+	if tokenCache != nil {
+		if cached, found := tokenCache.Get(tokenCacheKey(token)); found {
+			logger.Debug("Token found in validated token cache")
+			identity.UserID, identity.UserName, _ = strings.Cut(cached, ":")
+			return identity, nil
+		}
+	}
+
+	user, err := api.NewMediaServer().GetCurrentUser(token)
+	if err != nil {
+		return clientIdentity{}, err
+	}
+	if user.ID == "" {
+		logger.Warn("Rejecting token that is not bound to an Emby user")
+		return clientIdentity{}, fmt.Errorf("token is not bound to a user: %w", api.ErrUnauthorized)
+	}
+	identity.UserID = user.ID
+	identity.UserName = user.Name
+
+	if tokenCache != nil {
+		if err := tokenCache.Set(tokenCacheKey(token), user.ID+":"+user.Name); err != nil {
+			logger.Warn("Failed to cache validated token: %v", err)
+		}
+	}
+	return identity, nil
+}
+
+// authorizeItemAccess confirms that the caller's Emby user can see the requested item.
+// Responds with 403 and returns false if the user has no access to it, or is unknown.
+func authorizeItemAccess(c *gin.Context, parameters RequestParameters) bool {
+	// Special media is configured by the administrator and the server API key sees every item.
+	if parameters.IsSpecialDate || parameters.IsAPIKey {
+		return true
+	}
+	if parameters.UserID == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No access to the requested item"})
+		return false
+	}
+
+	cacheKey := parameters.UserID + ":" + parameters.ItemId
+	if accessCache != nil {
+		if _, found := accessCache.Get(cacheKey); found {
+			logger.Debug("Item access found in access cache: %s", cacheKey)
+			return true
+		}
+	}
+
+	err := api.NewMediaServer().CheckItemAccess(parameters.EmbyApiKey, parameters.UserID, parameters.ItemId)
+	switch {
+	case err == nil:
+	case errors.Is(err, api.ErrForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": "No access to the requested item"})
+		return false
+	case errors.Is(err, api.ErrUnauthorized):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid emby token"})
+		return false
+	default:
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to check item access"})
+		return false
+	}
+
+	if accessCache != nil {
+		if err := accessCache.Set(cacheKey, "1"); err != nil {
+			logger.Warn("Failed to cache item access: %v", err)
+		}
+	}
+	return true
+}
+
+// extractDeviceID returns the device ID sent by the client, if any.
+func extractDeviceID(r *http.Request) string {
+	query := r.URL.Query()
+	for _, key := range []string{"DeviceId", "X-Emby-Device-Id"} {
+		if deviceID := query.Get(key); deviceID != "" {
+			return deviceID
+		}
+	}
+
+	if deviceID := r.Header.Get("X-Emby-Device-Id"); deviceID != "" {
+		return deviceID
+	}
+
+	for _, header := range []string{"Authorization", "X-Emby-Authorization"} {
+		if deviceID := parseAuthorizationHeader(r.Header.Get(header))["DeviceId"]; deviceID != "" {
+			return deviceID
+		}
+	}
+
+	return ""
+}
+
+// extractClientToken returns the Emby or Jellyfin token sent by the client.
+// The token is looked up in the api_key and ApiKey query parameters, the X-Emby-Token and
+// X-MediaBrowser-Token headers, and the MediaBrowser Authorization header, in that order.
+func extractClientToken(r *http.Request) string {
+	query := r.URL.Query()
+	for _, key := range []string{"api_key", "ApiKey"} {
+		if token := query.Get(key); token != "" {
+			return token
+		}
+	}
+
+	for _, header := range []string{"X-Emby-Token", "X-MediaBrowser-Token"} {
+		if token := r.Header.Get(header); token != "" {
+			return token
+		}
+	}
+
+	for _, header := range []string{"Authorization", "X-Emby-Authorization"} {
+		if token := parseAuthorizationHeader(r.Header.Get(header))["Token"]; token != "" {
+			return token
+		}
+	}
+
+	return ""
+}
+
+// parseAuthorizationHeader parses a header of the form
+// `MediaBrowser Client="Emby Web", DeviceId="abc", Token="xyz"` into its key/value pairs.
+func parseAuthorizationHeader(header string) map[string]string {
+	values := map[string]string{}
+
+	scheme, params, found := strings.Cut(strings.TrimSpace(header), " ")
+	if !found || (!strings.EqualFold(scheme, "MediaBrowser") && !strings.EqualFold(scheme, "Emby")) {
+		return values
+	}
+
+	for _, param := range strings.Split(params, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if !found {
+			continue
+		}
+		values[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+
+	return values
+}
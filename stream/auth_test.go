@@ -0,0 +1,214 @@
+package stream
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestExtractClientToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		headers map[string]string
+		want    string
+	}{
+		{name: "api_key", query: "api_key=query-token", want: "query-token"},
+		{name: "ApiKey", query: "ApiKey=query-token", want: "query-token"},
+		{name: "X-Emby-Token", headers: map[string]string{"X-Emby-Token": "header-token"}, want: "header-token"},
+		{name: "X-MediaBrowser-Token", headers: map[string]string{"X-MediaBrowser-Token": "header-token"}, want: "header-token"},
+		{
+			name:    "MediaBrowser Authorization",
+			headers: map[string]string{"Authorization": `MediaBrowser Client="Emby Web", DeviceId="abc", Token="auth-token"`},
+			want:    "auth-token",
+		},
+		{
+			name:    "Emby X-Emby-Authorization",
+			headers: map[string]string{"X-Emby-Authorization": `Emby UserId="u", Token="auth-token", Version="4.8"`},
+			want:    "auth-token",
+		},
+		{name: "unquoted value", headers: map[string]string{"Authorization": "MediaBrowser Token=auth-token"}, want: "auth-token"},
+		{name: "other scheme", headers: map[string]string{"Authorization": `Bearer Token="auth-token"`}, want: ""},
+		{
+			name:    "query before headers",
+			query:   "api_key=query-token",
+			headers: map[string]string{"X-Emby-Token": "header-token", "Authorization": `MediaBrowser Token="auth-token"`},
+			want:    "query-token",
+		},
+		{
+			name:    "token header before Authorization",
+			headers: map[string]string{"X-Emby-Token": "header-token", "Authorization": `MediaBrowser Token="auth-token"`},
+			want:    "header-token",
+		},
+		{name: "missing", want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/videos/1/stream?"+test.query, nil)
+			for key, value := range test.headers {
+				r.Header.Set(key, value)
+			}
+			if got := extractClientToken(r); got != test.want {
+				t.Errorf("extractClientToken\n got: %q\nwant: %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseAuthorizationHeader(t *testing.T) {
+	got := parseAuthorizationHeader(` mediabrowser Client="Emby Theater" , DeviceId="a=b", Token=xyz, Broken `)
+	want := map[string]string{"Client": "Emby Theater", "DeviceId": "a=b", "Token": "xyz"}
+	if len(got) != len(want) {
+		t.Fatalf("parseAuthorizationHeader\n got: %v\nwant: %v", got, want)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("parseAuthorizationHeader(%s)\n got: %q\nwant: %q", key, got[key], value)
+		}
+	}
+
+	for _, header := range []string{"", "MediaBrowser", `Basic Token="xyz"`} {
+		if values := parseAuthorizationHeader(header); len(values) != 0 {
+			t.Errorf("parseAuthorizationHeader(%q) = %v, want no values", header, values)
+		}
+	}
+}
+
+// useTestAuthServer starts a fake Emby knowing the tokens "user-token", "expired-token" and "broken-token",
+// and the items "allowed", "hidden" and "missing".
+func useTestAuthServer(t *testing.T) {
+	t.Helper()
+	useTestMediaServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("X-Emby-Token") {
+		case "user-token", "server-key":
+		case "broken-token":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/Users/Me":
+			json.NewEncoder(w).Encode(map[string]string{"Id": "user-id", "Name": "alice"})
+		case "/Users/user-id/Items/allowed":
+			json.NewEncoder(w).Encode(map[string]string{"Id": "allowed"})
+		case "/Users/user-id/Items/hidden":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
+
+func TestAuthenticateRequest(t *testing.T) {
+	useTestAuthServer(t)
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int // 0 when the request is authenticated
+		wantUser   string
+	}{
+		{name: "user token", token: "user-token", wantUser: "user-id"},
+		{name: "server api key", token: "server-key"},
+		{name: "missing token", wantStatus: http.StatusUnauthorized},
+		{name: "rejected token", token: "expired-token", wantStatus: http.StatusUnauthorized},
+		{name: "media server failure", token: "broken-token", wantStatus: http.StatusBadGateway},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodGet, "/videos/1/stream", nil)
+			if test.token != "" {
+				c.Request.Header.Set("X-Emby-Token", test.token)
+			}
+
+			identity, ok := authenticateRequest(c)
+			if test.wantStatus != 0 {
+				if ok || recorder.Code != test.wantStatus {
+					t.Errorf("authenticateRequest answered %d (ok %v), want %d", recorder.Code, ok, test.wantStatus)
+				}
+				return
+			}
+			if !ok || identity.UserID != test.wantUser || identity.Token != test.token {
+				t.Errorf("authenticateRequest returned %+v (ok %v), want user %q", identity, ok, test.wantUser)
+			}
+		})
+	}
+}
+
+func TestAuthorizeItemAccess(t *testing.T) {
+	useTestAuthServer(t)
+
+	tests := []struct {
+		name       string
+		parameters RequestParameters
+		wantStatus int // 0 when access is granted
+	}{
+		{name: "allowed", parameters: RequestParameters{EmbyApiKey: "user-token", UserID: "user-id", ItemId: "allowed"}},
+		{name: "hidden", parameters: RequestParameters{EmbyApiKey: "user-token", UserID: "user-id", ItemId: "hidden"}, wantStatus: http.StatusForbidden},
+		{name: "missing", parameters: RequestParameters{EmbyApiKey: "user-token", UserID: "user-id", ItemId: "missing"}, wantStatus: http.StatusForbidden},
+		{name: "unknown user", parameters: RequestParameters{EmbyApiKey: "user-token", ItemId: "allowed"}, wantStatus: http.StatusForbidden},
+		{name: "expired token", parameters: RequestParameters{EmbyApiKey: "expired-token", UserID: "user-id", ItemId: "allowed"}, wantStatus: http.StatusUnauthorized},
+		{name: "media server failure", parameters: RequestParameters{EmbyApiKey: "broken-token", UserID: "user-id", ItemId: "allowed"}, wantStatus: http.StatusBadGateway},
+		{name: "server api key", parameters: RequestParameters{EmbyApiKey: "server-key", IsAPIKey: true, ItemId: "hidden"}},
+		{name: "special media", parameters: RequestParameters{IsSpecialDate: true, ItemId: "hidden"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+
+			ok := authorizeItemAccess(c, test.parameters)
+			if test.wantStatus == 0 {
+				if !ok {
+					t.Errorf("authorizeItemAccess denied access with %d", recorder.Code)
+				}
+				return
+			}
+			if ok || recorder.Code != test.wantStatus {
+				t.Errorf("authorizeItemAccess answered %d (ok %v), want %d", recorder.Code, ok, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestTokenCacheStoresTokenDigests(t *testing.T) {
+	server := useTestRedis(t)
+	useTestMediaServer(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"Id": "user-id", "Name": "alice"})
+	})
+	previous := tokenCache
+	tokenCache = NewRedisCache(redisClient, redisPrefix+"token:", time.Minute)
+	t.Cleanup(func() { tokenCache = previous })
+
+	const token = "c0ffee-user-token"
+	for i := 0; i < 2; i++ {
+		identity, err := resolveClientIdentity(token, "")
+		if err != nil || identity.UserID != "user-id" {
+			t.Fatalf("resolveClientIdentity returned %+v, %v", identity, err)
+		}
+	}
+
+	keys := server.Keys()
+	if len(keys) != 1 {
+		t.Fatalf("Token cache holds keys %v, want one", keys)
+	}
+	if strings.Contains(keys[0], token) {
+		t.Errorf("Token cache key %q contains the token", keys[0])
+	}
+}
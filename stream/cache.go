@@ -2,56 +2,224 @@
 package stream
 
 import (
-	"github.com/allegro/bigcache"
+	"PiliPili_Frontend/config"
+	"PiliPili_Frontend/logger"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Cache wraps the bigcache instance for easier use.
-type Cache struct {
-	cache *bigcache.BigCache
+// Cache backends selectable with Cache.type.
+const (
+	CacheTypeMemory = "memory" // Process-local LRU cache
+	CacheTypeRedis  = "redis"  // Redis shared by every frontend instance
+)
+
+// Cache stores string values that expire after the lifetime the cache was created with,
+// or at the time they were stored with.
+type Cache interface {
+	// Get retrieves the value associated with the key from the cache.
+	// Returns the value and a boolean indicating whether the key was found.
+	Get(key string) (string, bool)
+	// Set adds a new key-value pair to the cache.
+	Set(key string, value string) error
+	// SetUntil adds a new key-value pair to the cache that expires at expireAt.
+	SetUntil(key string, value string, expireAt time.Time) error
+	// Delete removes a key-value pair from the cache.
+	Delete(key string) error
+	// Stats returns the counters of the cache.
+	Stats() CacheStats
+}
+
+// CacheStats holds the counters of a cache. Redis caches only count hits and misses.
+type CacheStats struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"`   // Live entries dropped to make room
+	Expirations uint64 `json:"expirations"` // Expired entries dropped
+	Entries     int64  `json:"entries"`
+	Bytes       int64  `json:"bytes"` // Approximate memory taken by the entries
+}
+
+// redisClient is shared by the Redis caches, nil when Cache.type is memory.
+var redisClient *redis.Client
+
+// redisPrefix is prepended to the keys of every Redis cache.
+var redisPrefix string
+
+// memoryStore holds the entries of every in-memory cache, which share its byte budget.
+var memoryStore *lruStore
+
+// caches holds every cache created with NewCache by name, for their stats.
+var (
+	caches   = map[string]Cache{}
+	cachesMu sync.Mutex
+)
+
+// InitializeCache connects the configured cache backend and creates the streaming URL cache.
+// Caches created afterwards with NewCache use the same backend.
+func InitializeCache() error {
+	cfg := config.GetConfig()
+	switch cfg.CacheType {
+	case "", CacheTypeMemory:
+		if cfg.CacheMemoryLimit <= 0 {
+			return errors.New("cache memory limit must be positive")
+		}
+		redisClient = nil
+		memoryStore = newLRUStore(int64(cfg.CacheMemoryLimit) << 20)
+	case CacheTypeRedis:
+		client := redis.NewClient(&redis.Options{
+			Addr:     cfg.CacheRedis.Addr,
+			Username: cfg.CacheRedis.Username,
+			Password: cfg.CacheRedis.Password,
+			DB:       cfg.CacheRedis.DB,
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := client.Ping(ctx).Err(); err != nil {
+			client.Close()
+			return fmt.Errorf("failed to connect to redis at %s: %w", cfg.CacheRedis.Addr, err)
+		}
+		redisClient, redisPrefix = client, cfg.CacheRedis.Prefix
+	default:
+		return fmt.Errorf("unsupported cache type %q", cfg.CacheType)
+	}
+
+	var err error
+	cache, err = NewCache("url", time.Duration(cfg.PlayURLMaxAliveTime)*time.Second)
+	return err
 }
 
-// NewCache initializes a new Cache instance with the specified expiration time.
-func NewCache(expiration time.Duration) (*Cache, error) {
-	config := bigcache.Config{
-		Shards:             4096,           // Number of cache shards (divisions for concurrency)
-		LifeWindow:         expiration,     // Cache expiration duration
-		CleanWindow:        expiration / 2, // Frequency of clean-up tasks
-		MaxEntriesInWindow: 1000 * 10 * 60, // Max entries in the given time window
-		MaxEntrySize:       500,            // Max size of a single entry
-		Verbose:            false,          // Toggle additional logging
-		HardMaxCacheSize:   0,              // Set max cache size in MB (0 means unlimited)
+// NewCache creates a cache on the configured backend whose entries expire after the given time.
+// The name keeps the keys of different caches apart when they share Redis. In-memory caches share
+// the configured memory limit, so the least recently used entries of any of them are evicted first.
+func NewCache(name string, expiration time.Duration) (Cache, error) {
+	var created Cache
+	if redisClient != nil {
+		created = NewRedisCache(redisClient, redisPrefix+name+":", expiration)
+	} else {
+		if memoryStore == nil {
+			return nil, errors.New("cache is not initialized")
+		}
+		created = newSharedLRUCache(memoryStore, expiration)
 	}
 
-	cacheInstance, err := bigcache.NewBigCache(config)
-	if err != nil {
-		return nil, err
+	cachesMu.Lock()
+	caches[name] = created
+	cachesMu.Unlock()
+	return created, nil
+}
+
+// cacheStats returns the stats of every cache created with NewCache by name.
+func cacheStats() map[string]CacheStats {
+	cachesMu.Lock()
+	defer cachesMu.Unlock()
+
+	stats := make(map[string]CacheStats, len(caches))
+	for name, created := range caches {
+		stats[name] = created.Stats()
 	}
+	return stats
+}
 
-	return &Cache{cache: cacheInstance}, nil
+// HandleCacheStats returns the counters of every cache by name.
+func HandleCacheStats(c *gin.Context) {
+	c.JSON(http.StatusOK, cacheStats())
+}
+
+// RedisCache stores its entries in Redis with a native expiry, under a common key prefix.
+type RedisCache struct {
+	client     *redis.Client
+	prefix     string
+	expiration time.Duration
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+}
+
+// redisTimeout bounds every Redis command so that a slow Redis degrades to cache misses.
+const redisTimeout = 2 * time.Second
+
+// NewRedisCache creates a cache storing its entries in Redis under prefix for the given time.
+func NewRedisCache(client *redis.Client, prefix string, expiration time.Duration) *RedisCache {
+	return &RedisCache{client: client, prefix: prefix, expiration: expiration}
 }
 
 // Set adds a new key-value pair to the cache.
-func (c *Cache) Set(key string, value string) error {
-	return c.cache.Set(key, []byte(value))
+func (c *RedisCache) Set(key string, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return c.client.Set(ctx, c.prefix+key, value, c.expiration).Err()
 }
 
 // Get retrieves the value associated with the key from the cache.
-// Returns the value and a boolean indicating whether the key was found.
-func (c *Cache) Get(key string) (string, bool) {
-	value, err := c.cache.Get(key)
+// Returns the value and a boolean indicating whether the key was found. Redis errors count as misses.
+func (c *RedisCache) Get(key string) (string, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	value, err := c.client.Get(ctx, c.prefix+key).Result()
 	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			logger.Warn("Failed to read key %s from redis: %v", c.prefix+key, err)
+		}
+		c.misses.Add(1)
 		return "", false
 	}
-	return string(value), true
+	c.hits.Add(1)
+	return value, true
+}
+
+// SetUntil adds a new key-value pair to the cache that expires at expireAt.
+func (c *RedisCache) SetUntil(key string, value string, expireAt time.Time) error {
+	ttl := time.Until(expireAt)
+	if ttl <= 0 {
+		return c.Delete(key)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return c.client.Set(ctx, c.prefix+key, value, ttl).Err()
+}
+
+// Stats returns the hits and misses of the cache.
+func (c *RedisCache) Stats() CacheStats {
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
 }
 
 // Delete removes a key-value pair from the cache.
-func (c *Cache) Delete(key string) error {
-	return c.cache.Delete(key)
+func (c *RedisCache) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return c.client.Del(ctx, c.prefix+key).Err()
+}
+
+// DeletePrefix removes every entry whose key starts with prefix.
+func (c *RedisCache) DeletePrefix(prefix string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*redisTimeout)
+	defer cancel()
+
+	iterator := c.client.Scan(ctx, 0, escapeRedisPattern(c.prefix+prefix)+"*", 100).Iterator()
+	var keys []string
+	for iterator.Next(ctx) {
+		keys = append(keys, iterator.Val())
+	}
+	if err := iterator.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return c.client.Del(ctx, keys...).Err()
 }
 
-// Cleanup clears all expired entries from the cache.
-func (c *Cache) Cleanup() {
-	// bigcache handles cleanup automatically based on the configured LifeWindow.
+// escapeRedisPattern escapes the glob characters of a Redis MATCH pattern.
+func escapeRedisPattern(value string) string {
+	return redisPatternEscaper.Replace(value)
 }
+
+var redisPatternEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
@@ -0,0 +1,123 @@
+package stream
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"testing"
+	"time"
+)
+
+func newTestRedisCache(t *testing.T, expiration time.Duration) (*RedisCache, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisCache(client, "pilipili:url:", expiration), server
+}
+
+func TestRedisCacheSetGetDelete(t *testing.T) {
+	cache, server := newTestRedisCache(t, time.Minute)
+
+	if _, found := cache.Get("a"); found {
+		t.Fatal("Get found a key that was never set")
+	}
+	if err := cache.Set("a", "1"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if value, found := cache.Get("a"); !found || value != "1" {
+		t.Fatalf("Get returned %q, %v", value, found)
+	}
+	if !server.Exists("pilipili:url:a") {
+		t.Error("Set did not store the key under the cache prefix")
+	}
+
+	if err := cache.Delete("a"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	if _, found := cache.Get("a"); found {
+		t.Error("Get found a deleted key")
+	}
+
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("Stats returned %d hits and %d misses", stats.Hits, stats.Misses)
+	}
+}
+
+func TestRedisCacheExpiry(t *testing.T) {
+	cache, server := newTestRedisCache(t, time.Minute)
+
+	if err := cache.Set("a", "1"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if ttl := server.TTL("pilipili:url:a"); ttl != time.Minute {
+		t.Errorf("Set stored a TTL of %v", ttl)
+	}
+
+	if err := cache.SetUntil("b", "2", time.Now().Add(10*time.Second)); err != nil {
+		t.Fatalf("SetUntil returned error: %v", err)
+	}
+	if ttl := server.TTL("pilipili:url:b"); ttl <= 0 || ttl > 10*time.Second {
+		t.Errorf("SetUntil stored a TTL of %v", ttl)
+	}
+
+	server.FastForward(11 * time.Second)
+	if _, found := cache.Get("b"); found {
+		t.Error("Get found a key past its SetUntil expiry")
+	}
+	if _, found := cache.Get("a"); !found {
+		t.Error("Get lost a key before its expiry")
+	}
+
+	server.FastForward(time.Minute)
+	if _, found := cache.Get("a"); found {
+		t.Error("Get found a key past its expiry")
+	}
+
+	if err := cache.Set("c", "3"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if err := cache.SetUntil("c", "3", time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("SetUntil returned error: %v", err)
+	}
+	if _, found := cache.Get("c"); found {
+		t.Error("SetUntil in the past did not remove the key")
+	}
+}
+
+func TestRedisCacheDeletePrefix(t *testing.T) {
+	cache, server := newTestRedisCache(t, time.Minute)
+
+	for _, key := range []string{"user:1:a", "user:1:b", "user:10:a", "user:*:a", "user:2:a"} {
+		if err := cache.Set(key, "1"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	if err := server.Set("pilipili:token:user:1:a", "1"); err != nil {
+		t.Fatalf("Failed to seed another cache: %v", err)
+	}
+
+	if err := cache.DeletePrefix("user:1:"); err != nil {
+		t.Fatalf("DeletePrefix returned error: %v", err)
+	}
+	if err := cache.DeletePrefix("user:*"); err != nil {
+		t.Fatalf("DeletePrefix returned error: %v", err)
+	}
+	if err := cache.DeletePrefix("user:3:"); err != nil {
+		t.Fatalf("DeletePrefix without matches returned error: %v", err)
+	}
+
+	for key, want := range map[string]bool{
+		"user:1:a":  false,
+		"user:1:b":  false,
+		"user:*:a":  false,
+		"user:10:a": true,
+		"user:2:a":  true,
+	} {
+		if _, found := cache.Get(key); found != want {
+			t.Errorf("Get(%q) found %v after DeletePrefix, want %v", key, found, want)
+		}
+	}
+	if !server.Exists("pilipili:token:user:1:a") {
+		t.Error("DeletePrefix removed a key of another cache")
+	}
+}
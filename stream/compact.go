@@ -0,0 +1,257 @@
+// Package stream handles processing of media streams.
+package stream
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"sync"
+	"time"
+)
+
+// Layout of a compact token, before base64url encoding:
+//
+//	ver(1) | alg(1) | flags(1) | keyTag(4) | nbf(4) | exp(4) | mac(16, or a 64-byte Ed25519 signature)
+//	[ | nonce | encrypted path ]
+//
+// Integers are big-endian Unix seconds, nbf is 0 when absent. keyTag is the first four bytes of
+// SHA-256(kid). The MAC covers the header followed by path, host, itemId, mediaId and uid, each
+// prefixed with its uvarint length; those fields travel in the URL as path, host, item, media and uid.
+// Tokens bound to a client network or a device append them, in that order, to the signed fields and
+// carry them in the URL as ip and did.
+// With path encryption, the path is sealed after the MAC with the header as additional data
+// and left out of the URL.
+const (
+	compactHeaderSize  = 15
+	compactMACSize     = 16
+	compactMaxSize     = compactHeaderSize + ed25519.SignatureSize
+	compactMaxEncoded  = (compactMaxSize*8 + 5) / 6 // Unpadded base64 length of compactMaxSize bytes
+	compactAlgHMAC     = 1                          // HMAC-SHA256 truncated to 128 bits
+	compactAlgEd25519  = 2                          // Ed25519
+	compactFlagUser    = 1 << 0                     // The token requires uid
+	compactFlagPath    = 1 << 1                     // The token carries the encrypted path
+	compactFlagNetwork = 1 << 2                     // The token is bound to a client network
+	compactFlagDevice  = 1 << 3                     // The token carries the device ID
+	compactMaxInputLen = 4096                       // Upper bound of the signed fields, larger claims are rejected
+)
+
+var (
+	errCompactMalformed = errors.New("malformed compact token")
+	errCompactTooLarge  = errors.New("compact token claims are too large")
+)
+
+// compactSigner holds the reusable state of a key: its HMAC and the buffer the signed input is built in.
+type compactSigner struct {
+	mac   hash.Hash
+	input []byte
+	raw   []byte // Token bytes of tokens carrying an encrypted path
+	sum   [sha256.Size]byte
+}
+
+// keyTag returns the tag identifying a key ID in compact tokens.
+func keyTag(id string) [4]byte {
+	sum := sha256.Sum256([]byte(id))
+	return [4]byte{sum[0], sum[1], sum[2], sum[3]}
+}
+
+// newCompactPool returns the pool of compactSigners of an HMAC key.
+func newCompactPool(secret []byte) *sync.Pool {
+	return &sync.Pool{New: func() any {
+		return &compactSigner{mac: hmac.New(sha256.New, secret), input: make([]byte, 0, 512)}
+	}}
+}
+
+// IsCompactToken reports whether the token uses the compact format rather than the JSON envelope.
+func IsCompactToken(token string) bool {
+	// JSON envelopes always start with the base64 encoding of `{"`.
+	return len(token) > 0 && token[0] == 'A'
+}
+
+// AppendCompact appends the compact token of the claims to dst using the active key.
+// With enough capacity in dst, an HMAC key and no path encryption it does not allocate.
+func (s *Signature) AppendCompact(dst []byte, claims *StreamClaims) ([]byte, error) {
+	key := s.ring.Load().active
+
+	var raw [compactMaxSize]byte
+	raw[0] = TokenVersionCompact
+	raw[1] = compactAlgHMAC
+	if key.algorithm == KeyAlgorithmEd25519 {
+		raw[1] = compactAlgEd25519
+	}
+	if claims.UserId != "" {
+		raw[2] |= compactFlagUser
+	}
+	if key.pathAEAD != nil {
+		raw[2] |= compactFlagPath
+	}
+	if claims.ClientNet != "" {
+		raw[2] |= compactFlagNetwork
+	}
+	if claims.DeviceId != "" {
+		raw[2] |= compactFlagDevice
+	}
+	copy(raw[3:7], key.tag[:])
+	binary.BigEndian.PutUint32(raw[7:11], uint32(claims.NotBefore))
+	binary.BigEndian.PutUint32(raw[11:15], uint32(claims.ExpireAt))
+
+	signer := key.compact.Get().(*compactSigner)
+	defer key.compact.Put(signer)
+
+	input, ok := appendCompactInput(signer.input[:0], raw[:compactHeaderSize], claims)
+	if !ok {
+		return dst, errCompactTooLarge
+	}
+	signer.input = input
+
+	size := compactHeaderSize + compactMACSize
+	if key.algorithm == KeyAlgorithmEd25519 {
+		copy(raw[compactHeaderSize:], ed25519.Sign(key.privateKey, input))
+		size = compactMaxSize
+	} else {
+		copy(raw[compactHeaderSize:], signer.hmacSum(input))
+	}
+
+	if key.pathAEAD == nil {
+		return base64.RawURLEncoding.AppendEncode(dst, raw[:size]), nil
+	}
+
+	// The header is passed from the copy in signer.raw: handing raw to the AEAD would move it to the heap.
+	sealed := append(signer.raw[:0], raw[:size]...)
+	sealed, err := sealPath(sealed, key.pathAEAD, claims.Path, sealed[:compactHeaderSize])
+	if err != nil {
+		return dst, err
+	}
+	signer.raw = sealed
+	return base64.RawURLEncoding.AppendEncode(dst, sealed), nil
+}
+
+// VerifyCompact checks a compact token against the claims carried next to it in the URL.
+// Path, Host, ItemId, MediaId, UserId, ClientNet and DeviceId must be set by the caller; Version, NotBefore and ExpireAt
+// are filled from the token, and so is Path when the token carries it encrypted.
+// It does not allocate for HMAC keys without path encryption.
+func (s *Signature) VerifyCompact(token string, claims *StreamClaims, now time.Time) error {
+	// Tokens without an encrypted path fit on the stack; longer ones are decoded on the heap.
+	var encodedBuffer [compactMaxEncoded]byte
+	var rawBuffer [compactMaxSize]byte
+	encoded, raw := encodedBuffer[:], rawBuffer[:]
+	if len(token) > len(encodedBuffer) {
+		if len(token) > base64.RawURLEncoding.EncodedLen(compactMaxSize+compactMaxInputLen+64) {
+			return errCompactMalformed
+		}
+		encoded, raw = make([]byte, len(token)), make([]byte, base64.RawURLEncoding.DecodedLen(len(token)))
+	}
+	n := copy(encoded, token)
+
+	size, err := base64.RawURLEncoding.Decode(raw, encoded[:n])
+	if err != nil || size < compactHeaderSize || raw[0] != TokenVersionCompact {
+		return errCompactMalformed
+	}
+
+	algorithm, signatureSize := KeyAlgorithmHMAC, compactMACSize
+	switch raw[1] {
+	case compactAlgHMAC:
+	case compactAlgEd25519:
+		algorithm, signatureSize = KeyAlgorithmEd25519, ed25519.SignatureSize
+	default:
+		return errors.New("unsupported compact token algorithm")
+	}
+	end := compactHeaderSize + signatureSize
+	encryptedPath := raw[2]&compactFlagPath != 0
+	if size < end || (size != end && !encryptedPath) {
+		return errCompactMalformed
+	}
+	if raw[2]&compactFlagUser != 0 && claims.UserId == "" {
+		return errors.New("compact token requires a user")
+	}
+	if (raw[2]&compactFlagNetwork != 0) != (claims.ClientNet != "") {
+		return errors.New("compact token client network mismatch")
+	}
+	if (raw[2]&compactFlagDevice != 0) != (claims.DeviceId != "") {
+		return errors.New("compact token device mismatch")
+	}
+
+	// Like in AppendCompact, the AEAD gets a copy so that the buffers stay on the stack.
+	var sealed []byte
+	if encryptedPath {
+		sealed = append([]byte(nil), raw[:size]...)
+	}
+
+	verified := false
+	for _, key := range s.ring.Load().keys {
+		if key.algorithm != algorithm || [4]byte(raw[3:7]) != key.tag {
+			continue
+		}
+		if encryptedPath {
+			if key.pathAEAD == nil {
+				continue
+			}
+			if claims.Path, err = openPath(key.pathAEAD, sealed[end:], sealed[:compactHeaderSize]); err != nil {
+				continue
+			}
+		}
+		if key.verifyCompact(raw[:compactHeaderSize], raw[compactHeaderSize:end], claims) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errors.New("signature verification failed")
+	}
+
+	claims.Version = TokenVersionCompact
+	claims.NotBefore = int64(binary.BigEndian.Uint32(raw[7:11]))
+	claims.ExpireAt = int64(binary.BigEndian.Uint32(raw[11:15]))
+	return s.checkValidity(claims, now)
+}
+
+// verifyCompact reports whether the MAC or signature of a compact token is valid for the claims.
+func (key *signingKey) verifyCompact(header, signature []byte, claims *StreamClaims) bool {
+	signer := key.compact.Get().(*compactSigner)
+	defer key.compact.Put(signer)
+
+	input, ok := appendCompactInput(signer.input[:0], header, claims)
+	if !ok {
+		return false
+	}
+	signer.input = input
+
+	if key.algorithm == KeyAlgorithmEd25519 {
+		return ed25519.Verify(key.privateKey.Public().(ed25519.PublicKey), input, signature)
+	}
+	return hmac.Equal(signature, signer.hmacSum(input))
+}
+
+// hmacSum returns the truncated HMAC of the input. The result is only valid until the signer is reused.
+func (signer *compactSigner) hmacSum(input []byte) []byte {
+	signer.mac.Reset()
+	signer.mac.Write(input)
+	return signer.mac.Sum(signer.sum[:0])[:compactMACSize]
+}
+
+// appendCompactInput appends the header and the length-prefixed URL fields covered by the MAC.
+// The client network and device are only covered when the header flags them, so tokens without them keep their MAC.
+func appendCompactInput(dst, header []byte, claims *StreamClaims) ([]byte, bool) {
+	size := len(claims.Path) + len(claims.Host) + len(claims.ItemId) + len(claims.MediaId) + len(claims.UserId) + len(claims.ClientNet) + len(claims.DeviceId)
+	if size > compactMaxInputLen {
+		return dst, false
+	}
+
+	dst = append(dst, header...)
+	for _, field := range [...]string{claims.Path, claims.Host, claims.ItemId, claims.MediaId, claims.UserId} {
+		dst = binary.AppendUvarint(dst, uint64(len(field)))
+		dst = append(dst, field...)
+	}
+	if header[2]&compactFlagNetwork != 0 {
+		dst = binary.AppendUvarint(dst, uint64(len(claims.ClientNet)))
+		dst = append(dst, claims.ClientNet...)
+	}
+	if header[2]&compactFlagDevice != 0 {
+		dst = binary.AppendUvarint(dst, uint64(len(claims.DeviceId)))
+		dst = append(dst, claims.DeviceId...)
+	}
+	return dst, true
+}
@@ -0,0 +1,33 @@
+//go:build !race
+
+package stream
+
+import "testing"
+
+// The race detector makes sync.Pool drop objects at random, so allocations are only counted without it.
+func TestCompactDoesNotAllocate(t *testing.T) {
+	signature := newTestSignature(t, SignatureOptions{Version: TokenVersionCompact})
+	dst := make([]byte, 0, compactMaxEncoded)
+	token, err := signature.AppendCompact(dst, &testClaims)
+	if err != nil {
+		t.Fatalf("AppendCompact returned error: %v", err)
+	}
+	encoded := string(token)
+
+	if allocs := testing.AllocsPerRun(100, func() {
+		if _, err := signature.AppendCompact(dst, &testClaims); err != nil {
+			t.Fatal(err)
+		}
+	}); allocs != 0 {
+		t.Errorf("AppendCompact allocates %.1f times per token", allocs)
+	}
+
+	claims := urlClaims(testClaims)
+	if allocs := testing.AllocsPerRun(100, func() {
+		if err := signature.VerifyCompact(encoded, &claims, testNow); err != nil {
+			t.Fatal(err)
+		}
+	}); allocs != 0 {
+		t.Errorf("VerifyCompact allocates %.1f times per token", allocs)
+	}
+}
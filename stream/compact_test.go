@@ -0,0 +1,191 @@
+package stream
+
+import (
+	"testing"
+	"time"
+)
+
+var testClaims = StreamClaims{
+	ItemId:   "12345",
+	MediaId:  "mediasource_12345",
+	Path:     "/mnt/media/Movies/Example (2024)/Example (2024).mkv",
+	Host:     "stream.example.com",
+	UserId:   "e3b0c44298fc1c149afbf4c8996fb924",
+	ExpireAt: 1900000000,
+}
+
+var testNow = time.Unix(1800000000, 0)
+
+func newTestSignature(t testing.TB, options SignatureOptions) *Signature {
+	t.Helper()
+	signature, err := NewSignature("0123456789abcdef", options)
+	if err != nil {
+		t.Fatalf("NewSignature returned error: %v", err)
+	}
+	return signature
+}
+
+// urlClaims returns the claims a backend reads from the URL next to a compact token.
+func urlClaims(claims StreamClaims) StreamClaims {
+	return StreamClaims{
+		ItemId:    claims.ItemId,
+		MediaId:   claims.MediaId,
+		Path:      claims.Path,
+		Host:      claims.Host,
+		UserId:    claims.UserId,
+		ClientNet: claims.ClientNet,
+		DeviceId:  claims.DeviceId,
+	}
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		options SignatureOptions
+	}{
+		{name: "hmac", options: SignatureOptions{Version: TokenVersionCompact}},
+		{name: "encrypted path", options: SignatureOptions{Version: TokenVersionCompact, PathEncryption: PathEncryptionAESGCM}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signature := newTestSignature(t, test.options)
+			token, err := signature.Sign(testClaims)
+			if err != nil {
+				t.Fatalf("Sign returned error: %v", err)
+			}
+			if !IsCompactToken(token) {
+				t.Fatalf("Sign returned a token that is not compact: %s", token)
+			}
+
+			claims := urlClaims(testClaims)
+			if signature.EncryptsPath() {
+				claims.Path = ""
+			}
+			if err := signature.VerifyCompact(token, &claims, testNow); err != nil {
+				t.Fatalf("VerifyCompact returned error: %v", err)
+			}
+			if claims.Version != TokenVersionCompact || claims.ExpireAt != testClaims.ExpireAt || claims.Path != testClaims.Path {
+				t.Errorf("VerifyCompact filled version %d, expiry %d and path %q", claims.Version, claims.ExpireAt, claims.Path)
+			}
+		})
+	}
+}
+
+func TestCompactRejectsTampering(t *testing.T) {
+	signature := newTestSignature(t, SignatureOptions{Version: TokenVersionCompact})
+	token, err := signature.Sign(testClaims)
+	if err != nil {
+		t.Fatalf("Sign returned error: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		mutate func(*StreamClaims)
+	}{
+		{name: "path", token: token, mutate: func(c *StreamClaims) { c.Path += "x" }},
+		{name: "host", token: token, mutate: func(c *StreamClaims) { c.Host = "evil.example.com" }},
+		{name: "item", token: token, mutate: func(c *StreamClaims) { c.ItemId = "54321" }},
+		{name: "user", token: token, mutate: func(c *StreamClaims) { c.UserId = "other" }},
+		{name: "device", token: token, mutate: func(c *StreamClaims) { c.DeviceId = "device" }},
+		{name: "mac", token: flipChar(token, compactHeaderSize*4/3+2), mutate: func(*StreamClaims) {}},
+		{name: "truncated", token: token[:len(token)-4], mutate: func(*StreamClaims) {}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := urlClaims(testClaims)
+			test.mutate(&claims)
+			if err := signature.VerifyCompact(test.token, &claims, testNow); err == nil {
+				t.Error("VerifyCompact accepted a tampered token")
+			}
+		})
+	}
+
+	claims := urlClaims(testClaims)
+	if err := signature.VerifyCompact(token, &claims, time.Unix(testClaims.ExpireAt, 0)); err == nil {
+		t.Error("VerifyCompact accepted an expired token")
+	}
+}
+
+func TestLegacyAndV2TokensStillVerify(t *testing.T) {
+	compact := newTestSignature(t, SignatureOptions{Version: TokenVersionCompact, LegacyGracePeriod: time.Hour})
+
+	for _, version := range []int{TokenVersionLegacy, TokenVersionV2} {
+		token, err := newTestSignature(t, SignatureOptions{Version: version}).Sign(testClaims)
+		if err != nil {
+			t.Fatalf("Sign v%d returned error: %v", version, err)
+		}
+		if IsCompactToken(token) {
+			t.Fatalf("v%d token is mistaken for a compact token", version)
+		}
+
+		claims, err := compact.Verify(token, time.Now())
+		if err != nil {
+			t.Fatalf("v%d token does not verify once compact tokens are issued: %v", version, err)
+		}
+		if claims.Version != version || claims.ItemId != testClaims.ItemId || claims.MediaId != testClaims.MediaId {
+			t.Errorf("v%d token verified with claims %+v", version, claims)
+		}
+	}
+}
+
+func BenchmarkCompactEncode(b *testing.B) {
+	signature := newTestSignature(b, SignatureOptions{Version: TokenVersionCompact})
+	dst := make([]byte, 0, compactMaxEncoded)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := signature.AppendCompact(dst, &testClaims); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompactDecode(b *testing.B) {
+	signature := newTestSignature(b, SignatureOptions{Version: TokenVersionCompact})
+	token, err := signature.Sign(testClaims)
+	if err != nil {
+		b.Fatal(err)
+	}
+	claims := urlClaims(testClaims)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := signature.VerifyCompact(token, &claims, testNow); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkV2Encode(b *testing.B) {
+	signature := newTestSignature(b, SignatureOptions{Version: TokenVersionV2})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := signature.Sign(testClaims); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkV2Decode(b *testing.B) {
+	signature := newTestSignature(b, SignatureOptions{Version: TokenVersionV2})
+	token, err := signature.Sign(testClaims)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := signature.Verify(token, testNow); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// flipChar changes the character at index i of a base64url token.
+func flipChar(token string, i int) string {
+	replacement := byte('A')
+	if token[i] == 'A' {
+		replacement = 'B'
+	}
+	return token[:i] + string(replacement) + token[i+1:]
+}
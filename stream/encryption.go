@@ -0,0 +1,93 @@
+// Package stream handles processing of media streams.
+package stream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Media path encryption algorithms.
+const (
+	PathEncryptionAESGCM   = "aes-gcm"           // AES-256-GCM
+	PathEncryptionChaCha20 = "chacha20-poly1305" // ChaCha20-Poly1305
+)
+
+// pathKeyLabel separates the path encryption key from the signing key it is derived from.
+const pathKeyLabel = "PiliPili path encryption"
+
+// newPathAEAD derives the path encryption key of an HMAC signing key as
+// HMAC-SHA256(secret, "PiliPili path encryption") and returns the AEAD of the algorithm.
+// An empty algorithm disables path encryption.
+func newPathAEAD(algorithm string, key *signingKey) (cipher.AEAD, error) {
+	if algorithm == "" {
+		return nil, nil
+	}
+	if key.algorithm != KeyAlgorithmHMAC {
+		return nil, errors.New("path encryption requires hmac-sha256 keys, backends cannot decrypt with a public key")
+	}
+
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write([]byte(pathKeyLabel))
+	derived := mac.Sum(nil)
+
+	switch algorithm {
+	case PathEncryptionAESGCM:
+		block, err := aes.NewCipher(derived)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case PathEncryptionChaCha20:
+		return chacha20poly1305.New(derived)
+	default:
+		return nil, errors.New("unsupported path encryption: " + algorithm)
+	}
+}
+
+// sealPath appends a random nonce followed by the encrypted path to dst.
+func sealPath(dst []byte, aead cipher.AEAD, path string, additionalData []byte) ([]byte, error) {
+	start := len(dst)
+	dst = append(dst, make([]byte, aead.NonceSize())...)
+	nonce := dst[start:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(dst, nonce, []byte(path), additionalData), nil
+}
+
+// openPath decrypts a nonce followed by an encrypted path.
+func openPath(aead cipher.AEAD, sealed, additionalData []byte) (string, error) {
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return "", errors.New("encrypted path is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return "", errors.New("failed to decrypt path")
+	}
+	return string(plaintext), nil
+}
+
+// encryptPathClaim returns the base64url-encoded encrypted path carried by JSON tokens as epath.
+func encryptPathClaim(aead cipher.AEAD, path string) (string, error) {
+	sealed, err := sealPath(nil, aead, path, nil)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decryptPathClaim reverses encryptPathClaim.
+func decryptPathClaim(aead cipher.AEAD, encryptedPath string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(encryptedPath)
+	if err != nil {
+		return "", err
+	}
+	return openPath(aead, sealed, nil)
+}
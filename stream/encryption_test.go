@@ -0,0 +1,154 @@
+package stream
+
+import (
+	"PiliPili_Frontend/config"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+var pathEncryptions = []string{PathEncryptionAESGCM, PathEncryptionChaCha20}
+
+func TestPathEncryptionRoundTrip(t *testing.T) {
+	for _, algorithm := range pathEncryptions {
+		t.Run(algorithm+"/v2", func(t *testing.T) {
+			signature := newTestSignature(t, SignatureOptions{Version: TokenVersionV2, PathEncryption: algorithm})
+			token := mustSign(t, signature, testClaims)
+			if token == mustSign(t, signature, testClaims) {
+				t.Error("Two tokens of the same claims carry the same encrypted path")
+			}
+
+			// The path only travels encrypted.
+			sealed := tokenClaims(t, token)
+			if sealed.Path != "" || sealed.EncryptedPath == "" || strings.Contains(sealed.EncryptedPath, "Example") {
+				t.Errorf("Token carries path %q and encrypted path %q", sealed.Path, sealed.EncryptedPath)
+			}
+
+			claims, err := signature.Verify(token, testNow)
+			if err != nil {
+				t.Fatalf("Verify returned error: %v", err)
+			}
+			if claims.Path != testClaims.Path || !claims.Matches(testClaims.Path, testClaims.Host) {
+				t.Errorf("Verify restored path %q, want %q", claims.Path, testClaims.Path)
+			}
+		})
+
+		t.Run(algorithm+"/compact", func(t *testing.T) {
+			signature := newTestSignature(t, SignatureOptions{Version: TokenVersionCompact, PathEncryption: algorithm})
+			token := mustSign(t, signature, testClaims)
+
+			claims := urlClaims(testClaims)
+			claims.Path = ""
+			if err := signature.VerifyCompact(token, &claims, testNow); err != nil {
+				t.Fatalf("VerifyCompact returned error: %v", err)
+			}
+			if claims.Path != testClaims.Path {
+				t.Errorf("VerifyCompact restored path %q, want %q", claims.Path, testClaims.Path)
+			}
+		})
+	}
+}
+
+func TestPathEncryptionRejectsTampering(t *testing.T) {
+	for _, algorithm := range pathEncryptions {
+		t.Run(algorithm, func(t *testing.T) {
+			signature := newTestSignature(t, SignatureOptions{Version: TokenVersionV2, PathEncryption: algorithm})
+			aead := signature.ring.Load().active.pathAEAD
+
+			encryptedPath, err := encryptPathClaim(aead, testClaims.Path)
+			if err != nil {
+				t.Fatalf("encryptPathClaim returned error: %v", err)
+			}
+			sealed, _ := base64.RawURLEncoding.DecodeString(encryptedPath)
+			sealed[len(sealed)/2] ^= 1
+			if _, err := decryptPathClaim(aead, base64.RawURLEncoding.EncodeToString(sealed)); err == nil {
+				t.Error("decryptPathClaim accepted a modified ciphertext")
+			}
+			if _, err := decryptPathClaim(aead, encryptedPath[:8]); err == nil {
+				t.Error("decryptPathClaim accepted a truncated ciphertext")
+			}
+
+			// A path encrypted with another key does not decrypt.
+			other := newOtherKeySignature(t)
+			foreign, err := encryptPathClaim(mustPathAEAD(t, algorithm, other), testClaims.Path)
+			if err != nil {
+				t.Fatalf("encryptPathClaim returned error: %v", err)
+			}
+			if _, err := decryptPathClaim(aead, foreign); err == nil {
+				t.Error("decryptPathClaim accepted a path encrypted with another key")
+			}
+
+			compact := newTestSignature(t, SignatureOptions{Version: TokenVersionCompact, PathEncryption: algorithm})
+			token := mustSign(t, compact, testClaims)
+			claims := urlClaims(testClaims)
+			claims.Path = ""
+			if err := compact.VerifyCompact(flipChar(token, len(token)-4), &claims, testNow); err == nil {
+				t.Error("VerifyCompact accepted a modified encrypted path")
+			}
+		})
+	}
+}
+
+func TestPathEncryptionRequiresHMACKeys(t *testing.T) {
+	signature := newTestSignature(t, SignatureOptions{Version: TokenVersionV2, PathEncryption: PathEncryptionAESGCM})
+	if err := signature.SetKeys([]config.SignatureKeyConfig{testEd25519Key}); err == nil {
+		t.Error("SetKeys accepted an Ed25519 key with path encryption")
+	}
+
+	if _, err := NewSignature("0123456789abcdef", SignatureOptions{Version: TokenVersionV2, PathEncryption: "rot13"}); err == nil {
+		t.Error("NewSignature accepted an unsupported path encryption")
+	}
+}
+
+func TestVerifyRejectsEncryptedPathWithoutPathEncryption(t *testing.T) {
+	for _, version := range []int{TokenVersionV2, TokenVersionCompact} {
+		signer := newTestSignature(t, SignatureOptions{Version: version, PathEncryption: PathEncryptionAESGCM})
+		verifier := newTestSignature(t, SignatureOptions{Version: version})
+		token := mustSign(t, signer, testClaims)
+
+		var err error
+		if version == TokenVersionCompact {
+			claims := urlClaims(testClaims)
+			err = verifier.VerifyCompact(token, &claims, testNow)
+		} else {
+			_, err = verifier.Verify(token, testNow)
+		}
+		if err == nil {
+			t.Errorf("v%d token with an encrypted path accepted without path encryption", version)
+		}
+	}
+}
+
+// mustPathAEAD returns the path encryption AEAD of the active key of signature.
+func mustPathAEAD(t *testing.T, algorithm string, signature *Signature) cipher.AEAD {
+	t.Helper()
+	aead, err := newPathAEAD(algorithm, signature.ring.Load().active)
+	if err != nil {
+		t.Fatalf("newPathAEAD returned error: %v", err)
+	}
+	return aead
+}
+
+// tokenClaims returns the claims signed into a JSON envelope token, without verifying it.
+func tokenClaims(t *testing.T, token string) StreamClaims {
+	t.Helper()
+	payloadJSON, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+		t.Fatal(err)
+	}
+	data, err := base64.StdEncoding.DecodeString(payload["data"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims StreamClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
@@ -0,0 +1,36 @@
+// Package stream handles processing of media streams.
+package stream
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+)
+
+// Ed25519KeyPair is a freshly generated signing key in the forms the frontend and backend consume.
+type Ed25519KeyPair struct {
+	Seed         string // Base64-encoded private seed, the key of a Signature.keys entry
+	PublicKey    string // Base64-encoded raw 32-byte public key
+	PublicKeyPEM string // PEM-encoded PKIX public key
+}
+
+// GenerateEd25519KeyPair generates a new Ed25519 signing key.
+func GenerateEd25519KeyPair() (*Ed25519KeyPair, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ed25519KeyPair{
+		Seed:         base64.StdEncoding.EncodeToString(privateKey.Seed()),
+		PublicKey:    base64.StdEncoding.EncodeToString(publicKey),
+		PublicKeyPEM: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	}, nil
+}
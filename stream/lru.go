@@ -0,0 +1,160 @@
+// Package stream provides functionality for processing media streams and caching.
+package stream
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruEntryOverhead approximates the bytes an entry costs besides its key and value:
+// the list element, the map slot and the entry itself.
+const lruEntryOverhead = 128
+
+// lruStore holds the entries of LRU caches sharing one byte budget. When the budget is exceeded,
+// the least recently used entries are evicted first, whichever cache they belong to.
+type lruStore struct {
+	mu      sync.Mutex
+	entries map[lruKey]*list.Element
+	order   *list.List // Most recently used first
+	size    int64
+	maxSize int64
+}
+
+// lruKey identifies an entry of a cache in the store.
+type lruKey struct {
+	cache *LRUCache
+	key   string
+}
+
+// lruEntry is an entry of the lruStore.
+type lruEntry struct {
+	lruKey
+	value    string
+	expireAt time.Time
+}
+
+// newLRUStore creates a store holding up to maxSize bytes.
+func newLRUStore(maxSize int64) *lruStore {
+	return &lruStore{
+		entries: make(map[lruKey]*list.Element),
+		order:   list.New(),
+		maxSize: maxSize,
+	}
+}
+
+// LRUCache is an in-memory cache bounded by the approximate bytes its entries take.
+// Every entry expires on its own, and the least recently used entries are evicted first
+// when the store the cache shares with other caches is full.
+type LRUCache struct {
+	store      *lruStore
+	expiration time.Duration
+	stats      CacheStats // Guarded by the lock of the store
+}
+
+// NewLRUCache creates a cache holding up to maxSize bytes whose entries expire after expiration
+// unless they are stored with SetUntil.
+func NewLRUCache(maxSize int64, expiration time.Duration) *LRUCache {
+	return newSharedLRUCache(newLRUStore(maxSize), expiration)
+}
+
+// newSharedLRUCache creates a cache whose entries count against the budget of the store.
+func newSharedLRUCache(store *lruStore, expiration time.Duration) *LRUCache {
+	return &LRUCache{store: store, expiration: expiration}
+}
+
+// Get retrieves the value associated with the key from the cache.
+// Returns the value and a boolean indicating whether the key was found.
+func (c *LRUCache) Get(key string) (string, bool) {
+	store := c.store
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	element, found := store.entries[lruKey{c, key}]
+	if !found {
+		c.stats.Misses++
+		return "", false
+	}
+	entry := element.Value.(*lruEntry)
+	if !time.Now().Before(entry.expireAt) {
+		store.remove(element)
+		c.stats.Expirations++
+		c.stats.Misses++
+		return "", false
+	}
+
+	store.order.MoveToFront(element)
+	c.stats.Hits++
+	return entry.value, true
+}
+
+// Set adds a new key-value pair to the cache.
+func (c *LRUCache) Set(key string, value string) error {
+	return c.SetUntil(key, value, time.Now().Add(c.expiration))
+}
+
+// SetUntil adds a new key-value pair to the cache that expires at expireAt.
+// Entries larger than the whole store are not stored.
+func (c *LRUCache) SetUntil(key string, value string, expireAt time.Time) error {
+	store := c.store
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if element, found := store.entries[lruKey{c, key}]; found {
+		store.remove(element)
+	}
+	entrySize := lruSize(key, value)
+	if !time.Now().Before(expireAt) || entrySize > store.maxSize {
+		return nil
+	}
+
+	store.entries[lruKey{c, key}] = store.order.PushFront(&lruEntry{lruKey: lruKey{c, key}, value: value, expireAt: expireAt})
+	store.size += entrySize
+	c.stats.Entries++
+	c.stats.Bytes += entrySize
+	for store.size > store.maxSize {
+		oldest := store.order.Back()
+		entry := oldest.Value.(*lruEntry)
+		if time.Now().Before(entry.expireAt) {
+			entry.cache.stats.Evictions++
+		} else {
+			entry.cache.stats.Expirations++
+		}
+		store.remove(oldest)
+	}
+	return nil
+}
+
+// Delete removes a key-value pair from the cache.
+func (c *LRUCache) Delete(key string) error {
+	store := c.store
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if element, found := store.entries[lruKey{c, key}]; found {
+		store.remove(element)
+	}
+	return nil
+}
+
+// Stats returns the counters of the cache. Bytes only counts the entries of this cache.
+func (c *LRUCache) Stats() CacheStats {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	return c.stats
+}
+
+// remove drops an element from the store. The caller must hold the lock.
+func (store *lruStore) remove(element *list.Element) {
+	entry := store.order.Remove(element).(*lruEntry)
+	delete(store.entries, entry.lruKey)
+	entrySize := lruSize(entry.key, entry.value)
+	store.size -= entrySize
+	entry.cache.stats.Entries--
+	entry.cache.stats.Bytes -= entrySize
+}
+
+// lruSize returns the approximate memory an entry takes.
+func lruSize(key, value string) int64 {
+	return int64(len(key) + len(value) + lruEntryOverhead)
+}
@@ -0,0 +1,49 @@
+package stream
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLRUCachesShareBudget(t *testing.T) {
+	value := strings.Repeat("v", 1000-lruEntryOverhead-1)
+	store := newLRUStore(3 * lruSize("a", value))
+	first := newSharedLRUCache(store, time.Minute)
+	second := newSharedLRUCache(store, time.Minute)
+
+	for _, key := range []string{"a", "b"} {
+		if err := first.Set(key, value); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	if _, found := first.Get("a"); !found {
+		t.Fatal("Get lost an entry within the budget")
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := second.Set(key, value); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+
+	// The store holds three entries: the least recently used one, "b" of the first cache, is evicted.
+	if _, found := first.Get("b"); found {
+		t.Error("The least recently used entry was kept beyond the shared budget")
+	}
+	for _, cache := range []*LRUCache{first, second} {
+		if _, found := cache.Get("a"); !found {
+			t.Error("Get lost a recently used entry")
+		}
+	}
+	if _, found := second.Get("b"); !found {
+		t.Error("Get lost a recently used entry")
+	}
+
+	firstStats, secondStats := first.Stats(), second.Stats()
+	if firstStats.Evictions != 1 || firstStats.Entries != 1 || secondStats.Entries != 2 {
+		t.Errorf("Stats returned %+v and %+v", firstStats, secondStats)
+	}
+	if firstStats.Bytes+secondStats.Bytes != store.size || store.size > store.maxSize {
+		t.Errorf("Caches account for %d bytes, the store for %d of %d", firstStats.Bytes+secondStats.Bytes, store.size, store.maxSize)
+	}
+}
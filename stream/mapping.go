@@ -0,0 +1,192 @@
+// Package stream handles processing of media streams.
+package stream
+
+import (
+	"PiliPili_Frontend/api"
+	"PiliPili_Frontend/config"
+	"PiliPili_Frontend/logger"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// pathMapping is a compiled PathMappingConfig.
+type pathMapping struct {
+	rule      config.PathMappingConfig
+	regex     *regexp.Regexp // Compiled Regex, nil for prefix rules
+	signature *Signature     // Signer of the rule's backends
+	s3        *api.S3API     // Presigner of the s3 kind
+}
+
+// Backend kinds a path mapping rule can route to.
+const (
+	BackendKindPiliPili = "pilipili" // Signed PiliPili backend URL
+	BackendKindAlist    = "alist"    // Direct link resolved through Alist
+	BackendKindS3       = "s3"       // Presigned URL of S3-compatible object storage
+	BackendKindNginx    = "nginx"    // Plain nginx protected by secure_link
+)
+
+// mediaRoute describes where a media file is served from.
+type mediaRoute struct {
+	Kind      string              // Backend kind serving the media
+	Path      string              // Path of the media file relative to the backend storage (or the Alist path)
+	Backends  []string            // Names of the candidate backends, empty for the whole pool
+	Signature *Signature          // Signer used for the streaming URL
+	Rule      string              // Name of the mapping rule that matched, empty for the default route
+	Alist     *config.AlistConfig // Alist server of the alist kind
+	Fallback  *mediaRoute         // PiliPili route used when a non-PiliPili kind fails
+	S3        *api.S3API          // Presigner of the s3 kind
+	S3Bucket  string              // Bucket of the s3 kind, empty when it is the first segment of Path
+	Nginx     *config.NginxConfig // secure_link settings of the nginx kind
+}
+
+// pathMappings holds the compiled PathMappings in configuration order.
+var pathMappings []pathMapping
+
+// InitializePathMappings compiles the configured path mapping rules.
+// Must be called after InitializeSignature, whose options are shared by rules with their own key.
+func InitializePathMappings() error {
+	defaultSignature, err := GetSignatureInstance()
+	if err != nil {
+		return err
+	}
+
+	cfg := config.GetConfig()
+	// Proxied streams reach nginx from the frontend, so $remote_addr never matches the client.
+	mayProxy := cfg.ProxyMode == StreamModeProxy || len(cfg.ProxyUserAgents) > 0
+
+	var mappings []pathMapping
+	for i, rule := range cfg.PathMappings {
+		if rule.Prefix == "" && rule.Regex == "" {
+			return fmt.Errorf("path mapping %d (%s) has neither prefix nor regex", i, rule.Name)
+		}
+
+		switch rule.Kind {
+		case "", BackendKindPiliPili:
+		case BackendKindAlist:
+			if rule.Alist.URL == "" {
+				return fmt.Errorf("path mapping %d (%s) has no alist url", i, rule.Name)
+			}
+		case BackendKindS3:
+		case BackendKindNginx:
+			if mayProxy && !rule.Nginx.SkipRemoteAddr {
+				return fmt.Errorf("path mapping %d (%s) binds $remote_addr, which proxied streams cannot match: set nginx.skipRemoteAddr", i, rule.Name)
+			}
+		default:
+			return fmt.Errorf("path mapping %d (%s) has an unsupported kind: %s", i, rule.Name, rule.Kind)
+		}
+
+		mapping := pathMapping{rule: rule, signature: defaultSignature}
+		if rule.Kind == BackendKindS3 {
+			s3 := rule.S3
+			if mapping.s3, err = api.NewS3API(s3.Endpoint, s3.Region, s3.AccessKey, s3.SecretKey, s3.SessionToken, s3.PathStyle); err != nil {
+				return fmt.Errorf("path mapping %d (%s) has an invalid s3 configuration: %w", i, rule.Name, err)
+			}
+		}
+		if rule.Regex != "" {
+			if mapping.regex, err = regexp.Compile(rule.Regex); err != nil {
+				return fmt.Errorf("path mapping %d (%s) has an invalid regex: %w", i, rule.Name, err)
+			}
+		}
+		if rule.Encipher != "" {
+			if mapping.signature, err = NewSignature(rule.Encipher, defaultSignature.options); err != nil {
+				return fmt.Errorf("path mapping %d (%s) has an invalid encipher: %w", i, rule.Name, err)
+			}
+		}
+
+		mappings = append(mappings, mapping)
+	}
+
+	pathMappings = mappings
+	return nil
+}
+
+// resolveMediaRoute maps a media path reported by Emby to a backend path.
+// The first matching rule decides; without a match, the storage and symlink base paths are stripped
+// and the whole pool serves the request with the global signing key.
+func resolveMediaRoute(mediaPath string) mediaRoute {
+	for _, mapping := range pathMappings {
+		path, ok := mapping.apply(mediaPath)
+		if !ok {
+			continue
+		}
+
+		logger.Info("Media path matched mapping rule: %s", mapping.rule.Name)
+		route := mediaRoute{
+			Kind:      BackendKindPiliPili,
+			Path:      strings.TrimPrefix(path, "/"),
+			Backends:  mapping.rule.Backends,
+			Signature: mapping.signature,
+			Rule:      mapping.rule.Name,
+		}
+
+		if mapping.rule.Kind == BackendKindAlist {
+			// Should Alist fail, the rule's backends serve the file from the regular storage layout.
+			fallback := route
+			fallback.Path = trimBasePaths(mediaPath)
+			route.Kind = BackendKindAlist
+			route.Path = "/" + strings.TrimPrefix(path, "/")
+			route.Alist = &mapping.rule.Alist
+			route.Fallback = &fallback
+		}
+		if mapping.rule.Kind == BackendKindS3 {
+			route.Kind = BackendKindS3
+			route.S3 = mapping.s3
+			route.S3Bucket = mapping.rule.S3.Bucket
+		}
+		if mapping.rule.Kind == BackendKindNginx {
+			route.Kind = BackendKindNginx
+			route.Nginx = &mapping.rule.Nginx
+		}
+		return route
+	}
+
+	signatureInstance, _ := GetSignatureInstance()
+	return mediaRoute{
+		Kind:      BackendKindPiliPili,
+		Path:      trimBasePaths(mediaPath),
+		Signature: signatureInstance,
+	}
+}
+
+// knownSignatures returns the global Signature followed by the signatures of the path mapping rules.
+func knownSignatures() []*Signature {
+	signatureInstance, _ := GetSignatureInstance()
+	signatures := []*Signature{signatureInstance}
+	for _, mapping := range pathMappings {
+		if !slices.Contains(signatures, mapping.signature) {
+			signatures = append(signatures, mapping.signature)
+		}
+	}
+	return signatures
+}
+
+// apply rewrites the media path if it matches the rule.
+func (mapping pathMapping) apply(mediaPath string) (string, bool) {
+	if mapping.regex != nil {
+		if !mapping.regex.MatchString(mediaPath) {
+			return "", false
+		}
+		return mapping.regex.ReplaceAllString(mediaPath, mapping.rule.Rewrite), true
+	}
+
+	if !strings.HasPrefix(mediaPath, mapping.rule.Prefix) {
+		return "", false
+	}
+	return mapping.rule.Rewrite + strings.TrimPrefix(mediaPath, mapping.rule.Prefix), true
+}
+
+// trimBasePaths strips the backend storage or frontend symlink base path from the media path.
+func trimBasePaths(mediaPath string) string {
+	backendStorageBasePath := config.GetConfig().BackendStorageBasePath
+	frontendSymlinkBasePath := config.GetConfig().FrontendSymlinkBasePath
+	if backendStorageBasePath != "" && strings.HasPrefix(mediaPath, backendStorageBasePath) {
+		mediaPath = strings.TrimPrefix(mediaPath, backendStorageBasePath)
+		mediaPath = strings.TrimPrefix(mediaPath, "/")
+	} else if frontendSymlinkBasePath != "" && strings.HasPrefix(mediaPath, frontendSymlinkBasePath) {
+		mediaPath = strings.TrimPrefix(mediaPath, frontendSymlinkBasePath)
+		mediaPath = strings.TrimPrefix(mediaPath, "/")
+	}
+	return mediaPath
+}
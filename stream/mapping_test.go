@@ -0,0 +1,128 @@
+package stream
+
+import (
+	"PiliPili_Frontend/config"
+	"testing"
+)
+
+// useTestPathMappings compiles rules as the path mappings of the test, with a test global signature
+// and the storage base path /mnt/anime.
+func useTestPathMappings(t *testing.T, rules ...config.PathMappingConfig) error {
+	t.Helper()
+	previousSignature, previousMappings := signatureInstance, pathMappings
+	signatureInstance = newTestSignature(t, SignatureOptions{Version: TokenVersionV2})
+	t.Cleanup(func() { signatureInstance, pathMappings = previousSignature, previousMappings })
+
+	useTestConfig(t, func(cfg *config.Config) {
+		cfg.PathMappings = rules
+		cfg.BackendStorageBasePath = "/mnt/anime"
+		cfg.FrontendSymlinkBasePath = "/mnt/symlink"
+	})
+	return InitializePathMappings()
+}
+
+func TestResolveMediaRoute(t *testing.T) {
+	err := useTestPathMappings(t,
+		config.PathMappingConfig{Name: "anime", Prefix: "/mnt/anime/hk", Rewrite: "/hk", Backends: []string{"hk-1"}},
+		config.PathMappingConfig{Name: "movies", Regex: `^/mnt/(movies|documentaries)/(.*)$`, Rewrite: "$1/$2", Encipher: "Zk3Q8vT1pW6nR2sY"},
+		config.PathMappingConfig{Name: "cloud", Prefix: "/mnt/cloud", Rewrite: "/115", Kind: BackendKindAlist,
+			Alist: config.AlistConfig{URL: "http://127.0.0.1:5244"}},
+		config.PathMappingConfig{Name: "minio", Prefix: "/mnt/s3/", Kind: BackendKindS3,
+			S3: config.S3Config{Endpoint: "http://minio:9000", AccessKey: "access", SecretKey: "secret", Bucket: "media"}},
+		config.PathMappingConfig{Name: "plain-nginx", Prefix: "/mnt/nginx", Kind: BackendKindNginx},
+		// Never reached, the first matching rule decides.
+		config.PathMappingConfig{Name: "shadowed", Prefix: "/mnt/movies", Rewrite: "/shadowed"},
+	)
+	if err != nil {
+		t.Fatalf("InitializePathMappings returned error: %v", err)
+	}
+
+	tests := []struct {
+		mediaPath string
+		rule      string
+		kind      string
+		path      string
+	}{
+		{mediaPath: "/mnt/anime/hk/Show/E01.mkv", rule: "anime", kind: BackendKindPiliPili, path: "hk/Show/E01.mkv"},
+		{mediaPath: "/mnt/movies/Example (2024)/Example.mkv", rule: "movies", kind: BackendKindPiliPili, path: "movies/Example (2024)/Example.mkv"},
+		{mediaPath: "/mnt/documentaries/Earth.mkv", rule: "movies", kind: BackendKindPiliPili, path: "documentaries/Earth.mkv"},
+		{mediaPath: "/mnt/cloud/Movies/a.mkv", rule: "cloud", kind: BackendKindAlist, path: "/115/Movies/a.mkv"},
+		{mediaPath: "/mnt/s3/Movies/a.mkv", rule: "minio", kind: BackendKindS3, path: "Movies/a.mkv"},
+		{mediaPath: "/mnt/nginx/Movies/a.mkv", rule: "plain-nginx", kind: BackendKindNginx, path: "Movies/a.mkv"},
+		// Paths matching no rule fall back to the base paths.
+		{mediaPath: "/mnt/anime/jp/Show/E01.mkv", kind: BackendKindPiliPili, path: "jp/Show/E01.mkv"},
+		{mediaPath: "/mnt/symlink/Show/E01.mkv", kind: BackendKindPiliPili, path: "Show/E01.mkv"},
+		{mediaPath: "/data/other.mkv", kind: BackendKindPiliPili, path: "/data/other.mkv"},
+	}
+
+	for _, test := range tests {
+		route := resolveMediaRoute(test.mediaPath)
+		if route.Rule != test.rule || route.Kind != test.kind || route.Path != test.path {
+			t.Errorf("resolveMediaRoute(%q)\n got: rule %q, kind %s, path %q\nwant: rule %q, kind %s, path %q",
+				test.mediaPath, route.Rule, route.Kind, route.Path, test.rule, test.kind, test.path)
+		}
+	}
+
+	if route := resolveMediaRoute("/mnt/anime/hk/a.mkv"); len(route.Backends) != 1 || route.Backends[0] != "hk-1" ||
+		route.Signature != signatureInstance {
+		t.Errorf("Prefix rule routed to backends %v with its own signature %v", route.Backends, route.Signature != signatureInstance)
+	}
+	if route := resolveMediaRoute("/mnt/movies/a.mkv"); route.Signature == signatureInstance || len(knownSignatures()) != 2 {
+		t.Error("The rule with its own encipher does not sign with its own key")
+	}
+	if route := resolveMediaRoute("/mnt/cloud/Movies/a.mkv"); route.Alist == nil || route.Fallback == nil ||
+		route.Fallback.Kind != BackendKindPiliPili || route.Fallback.Path != "/mnt/cloud/Movies/a.mkv" {
+		t.Errorf("Alist rule has no PiliPili fallback: %+v", route.Fallback)
+	}
+	if route := resolveMediaRoute("/mnt/s3/Movies/a.mkv"); route.S3 == nil || route.S3Bucket != "media" {
+		t.Errorf("S3 rule routed to bucket %q", route.S3Bucket)
+	}
+}
+
+func TestInitializePathMappingsRejectsInvalidRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    config.PathMappingConfig
+		proxied bool
+	}{
+		{name: "no prefix or regex", rule: config.PathMappingConfig{Name: "empty"}},
+		{name: "invalid regex", rule: config.PathMappingConfig{Regex: "^/mnt/(movies"}},
+		{name: "unsupported kind", rule: config.PathMappingConfig{Prefix: "/mnt", Kind: "ftp"}},
+		{name: "alist without url", rule: config.PathMappingConfig{Prefix: "/mnt", Kind: BackendKindAlist}},
+		{name: "s3 without credentials", rule: config.PathMappingConfig{Prefix: "/mnt", Kind: BackendKindS3}},
+		{name: "short encipher", rule: config.PathMappingConfig{Prefix: "/mnt", Encipher: "short"}},
+		{name: "nginx remote_addr with proxying", rule: config.PathMappingConfig{Prefix: "/mnt", Kind: BackendKindNginx}, proxied: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.proxied {
+				useTestConfig(t, func(cfg *config.Config) { cfg.ProxyMode = StreamModeProxy })
+			}
+			if err := useTestPathMappings(t, test.rule); err == nil {
+				t.Error("InitializePathMappings accepted an invalid rule")
+			}
+		})
+	}
+}
+
+func TestInitializePathMappingsNginxRemoteAddr(t *testing.T) {
+	rule := config.PathMappingConfig{Prefix: "/mnt/nginx", Kind: BackendKindNginx}
+
+	// Redirected streams reach nginx from the client, so $remote_addr may be bound.
+	useTestConfig(t, func(cfg *config.Config) { cfg.ProxyMode = StreamModeRedirect; cfg.ProxyUserAgents = nil })
+	if err := useTestPathMappings(t, rule); err != nil {
+		t.Errorf("InitializePathMappings rejected an nginx rule without proxying: %v", err)
+	}
+
+	// Proxying a few clients is enough to rule it out.
+	useTestConfig(t, func(cfg *config.Config) { cfg.ProxyUserAgents = []string{"(?i)tizen"} })
+	if err := useTestPathMappings(t, rule); err == nil {
+		t.Error("InitializePathMappings accepted an nginx rule binding $remote_addr with proxied user agents")
+	}
+
+	rule.Nginx.SkipRemoteAddr = true
+	if err := useTestPathMappings(t, rule); err != nil {
+		t.Errorf("InitializePathMappings rejected an nginx rule skipping $remote_addr: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+// Package stream handles processing of media streams.
+package stream
+
+import (
+	"PiliPili_Frontend/config"
+	"PiliPili_Frontend/logger"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mediaPathCache remembers the resolved media paths, keyed by item and media source, so that
+// fresh URLs can be signed without asking the media server again. The key of the item alone holds
+// the time its paths were last invalidated.
+var mediaPathCache Cache
+
+// mediaPathTTL is how long a resolved path is served from the cache. Older paths stay cached
+// for the stale lifetime, to be served only while the media server is unavailable.
+var mediaPathTTL time.Duration
+
+// mediaPathLookups coalesces concurrent media server lookups of the same media source.
+var mediaPathLookups singleflight.Group
+
+// mediaSourcePath is the cached value of a media source: its resolved path and when it was resolved.
+type mediaSourcePath struct {
+	Path       string `json:"path"`
+	ResolvedAt int64  `json:"resolvedAt"` // Unix milliseconds
+}
+
+// InitializeMediaPathCache creates the media path cache with the given lifetime, or disables it
+// when the lifetime is not positive. Paths are kept for staleTTL after they expire.
+func InitializeMediaPathCache(ttl, staleTTL time.Duration) error {
+	if ttl <= 0 {
+		mediaPathCache = nil
+		return nil
+	}
+
+	var err error
+	mediaPathTTL = ttl
+	mediaPathCache, err = NewCache("mediapath", ttl+max(staleTTL, 0))
+	return err
+}
+
+// mediaPathKey returns the cache key of an item. Emby and Jellyfin spell GUIDs with and without
+// dashes and in either case, so the ID is normalized.
+func mediaPathKey(itemID string) string {
+	return strings.ToLower(strings.ReplaceAll(itemID, "-", ""))
+}
+
+// mediaSourceKey returns the key of a media source, under which its path is cached and its lookups
+// are coalesced. Every source has its own entry, so that concurrent updates of the sources of an
+// item do not overwrite each other.
+func mediaSourceKey(itemID, mediaSourceID string) string {
+	return mediaPathKey(itemID) + "/" + mediaSourceID
+}
+
+// getCachedMediaPath returns the cached path of a media source, unless it has expired.
+func getCachedMediaPath(itemID, mediaSourceID string) (string, bool) {
+	source, found := loadMediaSourcePath(itemID, mediaSourceID)
+	if !found || !source.isFresh(time.Now()) {
+		return "", false
+	}
+	return source.Path, true
+}
+
+// getStaleMediaPath returns the cached path of a media source, even if it has expired.
+func getStaleMediaPath(itemID, mediaSourceID string) (string, bool) {
+	source, found := loadMediaSourcePath(itemID, mediaSourceID)
+	return source.Path, found
+}
+
+// loadMediaSourcePath reads the cached path of a media source. Paths resolved before the item was
+// last invalidated are ignored.
+func loadMediaSourcePath(itemID, mediaSourceID string) (mediaSourcePath, bool) {
+	if mediaPathCache == nil {
+		return mediaSourcePath{}, false
+	}
+
+	var source mediaSourcePath
+	value, found := mediaPathCache.Get(mediaSourceKey(itemID, mediaSourceID))
+	if !found || json.Unmarshal([]byte(value), &source) != nil || source.Path == "" {
+		return mediaSourcePath{}, false
+	}
+	if invalidated, found := mediaPathCache.Get(mediaPathKey(itemID)); found {
+		if invalidatedAt, err := strconv.ParseInt(invalidated, 10, 64); err != nil || source.ResolvedAt <= invalidatedAt {
+			return mediaSourcePath{}, false
+		}
+	}
+	return source, true
+}
+
+// isFresh reports whether the path was resolved recently enough to be served from the cache.
+func (s mediaSourcePath) isFresh(now time.Time) bool {
+	return now.Sub(time.UnixMilli(s.ResolvedAt)) < mediaPathTTL
+}
+
+// cacheMediaPath remembers the path of a media source that the media server returned for a request
+// sent at resolvedAt. A path requested before the item was invalidated is not served afterwards.
+func cacheMediaPath(itemID, mediaSourceID, mediaPath string, resolvedAt time.Time) {
+	if mediaPathCache == nil || itemID == "" || mediaSourceID == "" || mediaPath == "" {
+		return
+	}
+
+	if source, found := loadMediaSourcePath(itemID, mediaSourceID); found &&
+		source.Path == mediaPath && source.isFresh(time.Now()) {
+		return
+	}
+
+	value, err := json.Marshal(mediaSourcePath{Path: mediaPath, ResolvedAt: resolvedAt.UnixMilli()})
+	if err != nil {
+		return
+	}
+	if err := mediaPathCache.Set(mediaSourceKey(itemID, mediaSourceID), string(value)); err != nil {
+		logger.Warn("Failed to cache media path of item %s: %v", itemID, err)
+	}
+}
+
+// invalidateMediaPaths forgets the cached paths of the given items. The sources of an item cannot be
+// enumerated in every cache backend, so the time of the invalidation is recorded under the item key
+// and outlives every path resolved before it.
+func invalidateMediaPaths(itemIDs ...string) {
+	if mediaPathCache == nil {
+		return
+	}
+	invalidatedAt := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	for _, itemID := range itemIDs {
+		if err := mediaPathCache.Set(mediaPathKey(itemID), invalidatedAt); err != nil {
+			logger.Warn("Failed to invalidate media path of item %s: %v", itemID, err)
+			continue
+		}
+		logger.Info("Invalidated cached media paths of item %s", itemID)
+	}
+}
+
+// HandleInvalidateMediaPath handles the admin request forgetting the cached media paths of an item.
+func HandleInvalidateMediaPath(c *gin.Context) {
+	invalidateMediaPaths(c.Param("itemID"))
+	c.Status(http.StatusNoContent)
+}
+
+// HandleMediaWebhook invalidates the cached media paths of the items named by Emby or Jellyfin
+// webhook notifications of the configured events. Emby sends {"Event": ..., "Item": {"Id": ...}},
+// the Jellyfin webhook plugin {"NotificationType": ..., "ItemId": ...} with its default templates.
+// The webhook is authenticated by the token query parameter, since media servers cannot sign it;
+// without a configured token every request is rejected.
+func HandleMediaWebhook(c *gin.Context) {
+	cfg := config.GetConfig()
+	if cfg.MediaPathWebhookToken == "" ||
+		subtle.ConstantTimeCompare([]byte(c.Query("token")), []byte(cfg.MediaPathWebhookToken)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// The Emby webhooks plugin posts the JSON in the data field of a multipart form.
+	var payload []byte
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		payload = []byte(c.PostForm("data"))
+	} else {
+		var err error
+		if payload, err = io.ReadAll(c.Request.Body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook payload"})
+			return
+		}
+	}
+
+	var notification struct {
+		Event            string `json:"Event"`
+		NotificationType string `json:"NotificationType"`
+		ItemID           string `json:"ItemId"`
+		Item             struct {
+			ID string `json:"Id"`
+		} `json:"Item"`
+	}
+	if err := json.Unmarshal(payload, &notification); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook payload"})
+		return
+	}
+
+	event := notification.Event
+	if event == "" {
+		event = notification.NotificationType
+	}
+	itemID := notification.Item.ID
+	if itemID == "" {
+		itemID = notification.ItemID
+	}
+
+	if itemID != "" && slices.Contains(cfg.MediaPathWebhookEvents, event) {
+		logger.Info("Received %s webhook for item %s", event, itemID)
+		invalidateMediaPaths(itemID)
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,114 @@
+package stream
+
+import (
+	"PiliPili_Frontend/api"
+	"PiliPili_Frontend/config"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func useTestMediaPathCache(t *testing.T, ttl time.Duration) {
+	t.Helper()
+	previous, previousTTL := mediaPathCache, mediaPathTTL
+	mediaPathCache, mediaPathTTL = NewLRUCache(1<<20, time.Hour), ttl
+	t.Cleanup(func() { mediaPathCache, mediaPathTTL = previous, previousTTL })
+}
+
+func TestCacheMediaPathKeepsConcurrentSources(t *testing.T) {
+	useTestMediaPathCache(t, time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cacheMediaPath("ITEM-1", fmt.Sprintf("source%d", i), fmt.Sprintf("/media/%d.mkv", i), time.Now())
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 50; i++ {
+		want := fmt.Sprintf("/media/%d.mkv", i)
+		if mediaPath, found := getCachedMediaPath("item1", fmt.Sprintf("source%d", i)); !found || mediaPath != want {
+			t.Errorf("Source %d cached as %q, %v; want %q", i, mediaPath, found, want)
+		}
+	}
+}
+
+func TestInvalidateMediaPaths(t *testing.T) {
+	useTestMediaPathCache(t, time.Hour)
+
+	requestedAt := time.Now().Add(-time.Second)
+	cacheMediaPath("item1", "a", "/media/a.mkv", requestedAt)
+	cacheMediaPath("item2", "a", "/media/other.mkv", requestedAt)
+	invalidateMediaPaths("item1")
+
+	if _, found := getStaleMediaPath("item1", "a"); found {
+		t.Error("A path resolved before the invalidation is still served")
+	}
+	if _, found := getCachedMediaPath("item2", "a"); !found {
+		t.Error("Invalidating an item dropped the path of another item")
+	}
+
+	// A lookup sent before the invalidation must not bring its path back.
+	cacheMediaPath("item1", "a", "/media/a.mkv", requestedAt)
+	if _, found := getStaleMediaPath("item1", "a"); found {
+		t.Error("A path requested before the invalidation was cached after it")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	cacheMediaPath("item1", "a", "/media/a2.mkv", time.Now())
+	if mediaPath, found := getCachedMediaPath("item1", "a"); !found || mediaPath != "/media/a2.mkv" {
+		t.Errorf("A path resolved after the invalidation cached as %q, %v", mediaPath, found)
+	}
+}
+
+func TestStaleMediaPath(t *testing.T) {
+	useTestMediaPathCache(t, time.Minute)
+
+	cacheMediaPath("item1", "a", "/media/a.mkv", time.Now().Add(-2*time.Minute))
+	if _, found := getCachedMediaPath("item1", "a"); found {
+		t.Error("An expired path is served as fresh")
+	}
+	if mediaPath, found := getStaleMediaPath("item1", "a"); !found || mediaPath != "/media/a.mkv" {
+		t.Errorf("Stale path returned %q, %v", mediaPath, found)
+	}
+}
+
+func TestFetchMediaPathServesStalePathWhileBreakerOpen(t *testing.T) {
+	var calls atomic.Int32
+	useTestMediaServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	useTestConfig(t, func(cfg *config.Config) {
+		cfg.EmbyRetries = 0
+		cfg.EmbyBreakerThreshold = 1
+		cfg.EmbyBreakerCooldown = 60
+	})
+	if err := api.InitializeMediaServerClient(); err != nil {
+		t.Fatal(err)
+	}
+	useTestMediaPathCache(t, time.Minute)
+	cacheMediaPath("item1", "source1", "/media/movie.mkv", time.Now().Add(-2*time.Minute))
+
+	parameters := RequestParameters{EmbyApiKey: "client", UserID: "user", ItemId: "item1", MediaSourceID: "source1"}
+	for i := 0; i < 3; i++ {
+		if mediaPath, err := fetchMediaPath(parameters); err != nil || mediaPath != "/media/movie.mkv" {
+			t.Errorf("Request %d got %q, %v; want the stale path", i, mediaPath, err)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("Made %d media server requests, the open breaker should have stopped all but the first", got)
+	}
+
+	// Without a stale path the failure reaches the client.
+	parameters.MediaSourceID = "source2"
+	if _, err := fetchMediaPath(parameters); err == nil {
+		t.Error("fetchMediaPath succeeded without a media server and a stale path")
+	}
+}
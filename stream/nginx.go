@@ -0,0 +1,157 @@
+// Package stream handles processing of media streams.
+package stream
+
+import (
+	"PiliPili_Frontend/backend"
+	"PiliPili_Frontend/config"
+	"PiliPili_Frontend/logger"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// generateNginxURL builds a secure_link URL of the route's path on one of its nginx backends and
+// returns it with its expiry. The link is bound to the client address unless the rule skips $remote_addr.
+func generateNginxURL(route mediaRoute, clientIP string) (string, time.Time, error) {
+	pool, err := backend.GetPool()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	selectedBackend := pool.Select(route.Backends...)
+	if selectedBackend == nil {
+		return "", time.Time{}, errors.New("no backend configured")
+	}
+
+	baseURL, err := url.Parse(selectedBackend.URL)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	baseURL.Path = strings.TrimSuffix(baseURL.Path, "/") + "/" + route.Path
+	baseURL.RawPath = ""
+
+	remoteAddr := clientIP
+	if !route.bindsClientIP() {
+		remoteAddr = ""
+	} else if remoteAddr == "" {
+		return "", time.Time{}, errors.New("client address is unknown")
+	}
+
+	expireAt := time.Now().Unix() + int64(config.GetConfig().PlayURLMaxAliveTime)
+	token, err := route.Signature.SignSecureLink(baseURL.Path, expireAt, remoteAddr)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	baseURL.RawQuery = fmt.Sprintf("md5=%s&expires=%d", token, expireAt)
+
+	secureLink, err := selectedBackend.SignURL(baseURL.String(), time.Unix(expireAt, 0))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	logger.Info("Generated nginx secure link: %s", secureLink)
+	return secureLink, time.Unix(expireAt, 0), nil
+}
+
+// bindsClientIP reports whether URLs of the route are only valid for the client address they were signed for.
+func (route mediaRoute) bindsClientIP() bool {
+	return route.Kind == BackendKindNginx && route.Nginx != nil && !route.Nginx.SkipRemoteAddr
+}
+
+// NginxSnippet returns the nginx location blocks verifying the secure links of the nginx path mapping rules.
+// It only needs the configuration to be loaded.
+func NginxSnippet() (string, error) {
+	cfg := config.GetConfig()
+
+	var builder strings.Builder
+	for _, rule := range cfg.PathMappings {
+		if rule.Kind != BackendKindNginx {
+			continue
+		}
+
+		secret := rule.Encipher
+		if secret == "" {
+			secret = globalSecureLinkKey(cfg)
+		}
+		remoteAddr := "$remote_addr"
+		if rule.Nginx.SkipRemoteAddr {
+			remoteAddr = ""
+		}
+		root := rule.Nginx.Root
+		if root == "" {
+			root = "/path/to/media"
+		}
+
+		for _, location := range nginxLocations(rule.Backends) {
+			directive := "root " + root
+			if location != "/" {
+				directive = "alias " + strings.TrimSuffix(root, "/") + "/"
+			}
+
+			fmt.Fprintf(&builder, "# Path mapping: %s\n", rule.Name)
+			fmt.Fprintf(&builder, "location %s {\n", location)
+			builder.WriteString("    secure_link $arg_md5,$arg_expires;\n")
+			fmt.Fprintf(&builder, "    secure_link_md5 \"$secure_link_expires$uri%s %s\";\n\n", remoteAddr, secret)
+			builder.WriteString("    if ($secure_link = \"\") {\n        return 403;\n    }\n")
+			builder.WriteString("    if ($secure_link = \"0\") {\n        return 410;\n    }\n\n")
+			fmt.Fprintf(&builder, "    %s;\n", directive)
+			builder.WriteString("}\n\n")
+		}
+	}
+
+	if builder.Len() == 0 {
+		return "", errors.New("no path mapping uses the nginx kind")
+	}
+	return builder.String(), nil
+}
+
+// globalSecureLinkKey returns the key SignSecureLink uses for the global Signature: the first active
+// key of the keyring when it is an HMAC key, else its first HMAC key, or Encipher without keyring.
+// nginx cannot rotate keys, so rotating it requires a new snippet.
+func globalSecureLinkKey(cfg config.Config) string {
+	isHMAC := func(key config.SignatureKeyConfig) bool {
+		return key.Algorithm == "" || key.Algorithm == KeyAlgorithmHMAC
+	}
+
+	for _, key := range cfg.SignatureKeys {
+		if key.State == "" || key.State == KeyStateActive {
+			if isHMAC(key) {
+				return key.Key
+			}
+			break
+		}
+	}
+	for _, key := range cfg.SignatureKeys {
+		if isHMAC(key) {
+			return key.Key
+		}
+	}
+	return cfg.Encipher
+}
+
+// nginxLocations returns the distinct URL paths of the named backends, "/" for backends without a path.
+func nginxLocations(names []string) []string {
+	urls := []string{config.GetConfig().BackendURL}
+	if servers := config.GetConfig().BackendServers; len(servers) > 0 {
+		urls = urls[:0]
+		for _, server := range servers {
+			if len(names) == 0 || slices.Contains(names, server.Name) {
+				urls = append(urls, server.URL)
+			}
+		}
+	}
+
+	var locations []string
+	for _, rawURL := range urls {
+		location := "/"
+		if parsedURL, err := url.Parse(rawURL); err == nil && strings.Trim(parsedURL.Path, "/") != "" {
+			location = "/" + strings.Trim(parsedURL.Path, "/") + "/"
+		}
+		if !slices.Contains(locations, location) {
+			locations = append(locations, location)
+		}
+	}
+	return locations
+}
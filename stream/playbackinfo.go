@@ -0,0 +1,380 @@
+// Package stream handles processing of media streams.
+package stream
+
+import (
+	"PiliPili_Frontend/config"
+	"PiliPili_Frontend/logger"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// PlaybackInfo direct stream and transcoding modes.
+const (
+	DirectStreamForce   = "force"   // Point DirectStreamUrl at the signed backend URL and enable direct play
+	DirectStreamKeep    = "keep"    // Leave the media server's direct stream decision untouched
+	DirectStreamDisable = "disable" // Disable direct streaming
+	TranscodingKeep     = "keep"    // Leave the media server's transcoding decision untouched
+	TranscodingDisable  = "disable" // Disable transcoding and drop the transcoding URL
+)
+
+// playbackPolicy is a compiled PlaybackInfoPolicyConfig.
+type playbackPolicy struct {
+	rule    config.PlaybackInfoPolicyConfig
+	clients []*regexp.Regexp // Compiled client patterns
+}
+
+// playbackPolicies holds the compiled PlaybackInfo.policies in configuration order.
+var playbackPolicies []playbackPolicy
+
+// playbackInfoClient forwards PlaybackInfo requests to the media server.
+var playbackInfoClient = &http.Client{Timeout: 30 * time.Second}
+
+// hopByHopHeaders are response headers that only apply to the connection they arrived on.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// InitializePlaybackInfo compiles the per-user and per-client PlaybackInfo policies.
+func InitializePlaybackInfo() error {
+	cfg := config.GetConfig()
+	if err := validatePlaybackModes(cfg.PlaybackInfoDirectStream, cfg.PlaybackInfoTranscoding); err != nil {
+		return err
+	}
+
+	policies := []playbackPolicy{}
+	for _, rule := range cfg.PlaybackInfoPolicies {
+		if err := validatePlaybackModes(rule.DirectStream, rule.Transcoding); err != nil {
+			return fmt.Errorf("playback policy %s: %w", rule.Name, err)
+		}
+
+		policy := playbackPolicy{rule: rule}
+		for _, expr := range rule.Clients {
+			pattern, err := regexp.Compile(expr)
+			if err != nil {
+				return err
+			}
+			policy.clients = append(policy.clients, pattern)
+		}
+		policies = append(policies, policy)
+	}
+
+	playbackPolicies = policies
+	return nil
+}
+
+// validatePlaybackModes checks the direct stream and transcoding modes. Empty modes use the defaults.
+func validatePlaybackModes(directStream, transcoding string) error {
+	switch directStream {
+	case "", DirectStreamForce, DirectStreamKeep, DirectStreamDisable:
+	default:
+		return errors.New("unsupported direct stream mode: " + directStream)
+	}
+
+	switch transcoding {
+	case "", TranscodingKeep, TranscodingDisable:
+	default:
+		return errors.New("unsupported transcoding mode: " + transcoding)
+	}
+	return nil
+}
+
+// HandlePlaybackInfo forwards a PlaybackInfo request to the media server and rewrites every
+// MediaSource so that the client plays it directly from a signed backend URL.
+// Without PlaybackInfo.enabled, the request is passed through untouched.
+func HandlePlaybackInfo(c *gin.Context) {
+	if !config.GetConfig().PlaybackInfoEnabled {
+		proxyToMediaServer(c)
+		return
+	}
+
+	logger.Info("Handling PlaybackInfo request...")
+
+	identity, ok := authenticateRequest(c)
+	if !ok {
+		return
+	}
+
+	requestedAt := time.Now()
+	status, header, body, err := forwardToMediaServer(c.Request)
+	if err != nil {
+		logger.Error("Failed to forward PlaybackInfo request: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to fetch playback info"})
+		return
+	}
+
+	copyResponseHeaders(c, header)
+	contentType := header.Get("Content-Type")
+	if status != http.StatusOK {
+		c.Data(status, contentType, body)
+		return
+	}
+
+	directStream, transcoding := selectPlaybackPolicy(c.Request, identity)
+	parameters := RequestParameters{
+		EmbyApiKey: identity.Token,
+		UserID:     identity.UserID,
+		IsAPIKey:   identity.IsAPIKey,
+		DeviceID:   identity.DeviceID,
+		CacheScope: identity.cacheScope(),
+		ClientIP:   c.ClientIP(),
+		ItemId:     c.Param("itemID"),
+		ResolvedAt: requestedAt,
+	}
+	rewritten, err := rewritePlaybackInfo(body, parameters, directStream, transcoding)
+	if err != nil {
+		logger.Warn("Failed to rewrite PlaybackInfo, returning it unchanged: %v", err)
+		c.Data(status, contentType, body)
+		return
+	}
+
+	// The validators of the media server describe the body before it was rewritten.
+	c.Writer.Header().Del("ETag")
+	c.Writer.Header().Del("Last-Modified")
+	c.Data(status, "application/json; charset=utf-8", rewritten)
+}
+
+// proxyToMediaServer passes the request through to the media server untouched.
+func proxyToMediaServer(c *gin.Context) {
+	target, err := url.Parse(config.GetFullEmbyURL())
+	if err != nil {
+		logger.Error("Failed to parse media server URL: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid media server URL"})
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Error("Failed to forward PlaybackInfo request: %v", err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// copyResponseHeaders passes the headers of a media server response on to the client, except
+// the hop-by-hop headers and Content-Length, which is set for the body actually written.
+func copyResponseHeaders(c *gin.Context, header http.Header) {
+	skipped := map[string]bool{"Content-Length": true}
+	for _, key := range hopByHopHeaders {
+		skipped[key] = true
+	}
+	// Connection may name further headers that only apply to the connection.
+	for _, value := range header.Values("Connection") {
+		for _, key := range strings.Split(value, ",") {
+			skipped[http.CanonicalHeaderKey(strings.TrimSpace(key))] = true
+		}
+	}
+
+	for key, values := range header {
+		if !skipped[http.CanonicalHeaderKey(key)] {
+			c.Writer.Header()[key] = slices.Clone(values)
+		}
+	}
+}
+
+// forwardToMediaServer sends the request to the media server unchanged and returns its response.
+func forwardToMediaServer(r *http.Request) (int, http.Header, []byte, error) {
+	var requestBody []byte
+	if r.Body != nil {
+		var err error
+		if requestBody, err = io.ReadAll(r.Body); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(
+		r.Context(),
+		r.Method,
+		config.GetFullEmbyURL()+r.URL.RequestURI(),
+		bytes.NewReader(requestBody),
+	)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	req.Header = r.Header.Clone()
+	// The response body is parsed, so ask for it uncompressed.
+	req.Header.Del("Accept-Encoding")
+
+	resp, err := playbackInfoClient.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Error("Failed to close response body: %v", err)
+		}
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return resp.StatusCode, resp.Header, body, nil
+}
+
+// selectPlaybackPolicy returns the direct stream and transcoding modes of the first policy
+// matching the user or client. Modes the policy leaves empty, or every mode when no policy
+// matches, fall back to the global PlaybackInfo modes.
+func selectPlaybackPolicy(r *http.Request, identity clientIdentity) (string, string) {
+	cfg := config.GetConfig()
+	directStream, transcoding := cfg.PlaybackInfoDirectStream, cfg.PlaybackInfoTranscoding
+	client := extractClientName(r)
+	userAgent := r.UserAgent()
+
+	for _, policy := range playbackPolicies {
+		if policy.matches(identity, client, userAgent) {
+			logger.Debug("PlaybackInfo policy %s applies", policy.rule.Name)
+			if policy.rule.DirectStream != "" {
+				directStream = policy.rule.DirectStream
+			}
+			if policy.rule.Transcoding != "" {
+				transcoding = policy.rule.Transcoding
+			}
+			break
+		}
+	}
+
+	return directStream, transcoding
+}
+
+// matches reports whether the policy applies to the user or client.
+// A policy without users and clients never matches.
+func (policy playbackPolicy) matches(identity clientIdentity, client, userAgent string) bool {
+	if identity.UserID != "" &&
+		(slices.Contains(policy.rule.Users, identity.UserID) || slices.Contains(policy.rule.Users, identity.UserName)) {
+		return true
+	}
+
+	for _, pattern := range policy.clients {
+		if (client != "" && pattern.MatchString(client)) || pattern.MatchString(userAgent) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewritePlaybackInfo applies the direct stream and transcoding modes to every MediaSource.
+// Unknown fields of the response are preserved.
+// The parameters identify the caller and the item; the MediaSource ID is taken from each source.
+func rewritePlaybackInfo(body []byte, parameters RequestParameters, directStream, transcoding string) ([]byte, error) {
+	// Keep numbers such as RunTimeTicks exactly as the media server sent them.
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var playbackInfo map[string]any
+	if err := decoder.Decode(&playbackInfo); err != nil {
+		return nil, err
+	}
+
+	mediaSources, ok := playbackInfo["MediaSources"].([]any)
+	if !ok {
+		return nil, errors.New("response has no MediaSources")
+	}
+
+	for _, entry := range mediaSources {
+		source, ok := entry.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		switch directStream {
+		case DirectStreamForce, "":
+			forceDirectStream(source, parameters)
+		case DirectStreamDisable:
+			source["SupportsDirectStream"] = false
+			delete(source, "DirectStreamUrl")
+		}
+
+		if transcoding == TranscodingDisable {
+			source["SupportsTranscoding"] = false
+			delete(source, "TranscodingUrl")
+			delete(source, "TranscodingSubProtocol")
+			delete(source, "TranscodingContainer")
+		}
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(playbackInfo); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// forceDirectStream points the MediaSource at a signed backend URL, or at its remote URL, and enables direct play.
+func forceDirectStream(source map[string]any, parameters RequestParameters) {
+	mediaSourceID, _ := source["Id"].(string)
+	mediaPath, _ := source["Path"].(string)
+	if mediaSourceID == "" || mediaPath == "" {
+		return
+	}
+	cacheMediaPath(parameters.ItemId, mediaSourceID, mediaPath, parameters.ResolvedAt)
+
+	// Remote URLs and .strm files pointing to them are played without a backend. Targets that
+	// must be proxied keep the media server's URL, whose stream request the frontend proxies.
+	if target, ok := resolveRemoteTarget(mediaPath); ok {
+		if target.Proxy {
+			return
+		}
+		logger.Debug("Rewrote DirectStreamUrl of media source %s to remote URL: %s", mediaSourceID, target.URL)
+		source["DirectStreamUrl"] = target.URL
+		source["SupportsDirectPlay"] = true
+		source["SupportsDirectStream"] = true
+		return
+	}
+
+	parameters.MediaSourceID = mediaSourceID
+	streamingURL, err := generateAndCacheURL(mediaPath, parameters)
+	if err != nil {
+		logger.Warn("Failed to sign media source %s, leaving it unchanged: %v", mediaSourceID, err)
+		return
+	}
+
+	logger.Debug("Rewrote DirectStreamUrl of media source %s: %s", mediaSourceID, streamingURL)
+	source["DirectStreamUrl"] = streamingURL
+	source["SupportsDirectPlay"] = true
+	source["SupportsDirectStream"] = true
+}
+
+// extractClientName returns the client application name sent by the client, if any.
+func extractClientName(r *http.Request) string {
+	if client := r.URL.Query().Get("X-Emby-Client"); client != "" {
+		return client
+	}
+
+	if client := r.Header.Get("X-Emby-Client"); client != "" {
+		return client
+	}
+
+	for _, header := range []string{"Authorization", "X-Emby-Authorization"} {
+		if client := parseAuthorizationHeader(r.Header.Get(header))["Client"]; client != "" {
+			return client
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,161 @@
+// Package stream handles processing of media streams.
+package stream
+
+import (
+	"PiliPili_Frontend/config"
+	"PiliPili_Frontend/logger"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// Streaming modes supported by the frontend.
+const (
+	StreamModeRedirect = "redirect" // Answer with 302 to the signed backend URL
+	StreamModeProxy    = "proxy"    // Stream the backend response through the frontend
+)
+
+// proxyUserAgents holds the compiled Proxy.userAgents patterns.
+var proxyUserAgents []*regexp.Regexp
+
+// proxyTransport is shared by all proxied streams so that backend connections are reused.
+var proxyTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   32,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	// Media is already compressed; asking for gzip would break Range and Content-Length.
+	DisableCompression: true,
+}
+
+// clientOnlyHeaders are request headers that carry Emby credentials and must not reach the backend.
+var clientOnlyHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"X-Emby-Authorization",
+	"X-Emby-Token",
+	"X-MediaBrowser-Token",
+}
+
+// InitializeProxy compiles the User-Agent patterns that select the proxy streaming mode.
+func InitializeProxy() error {
+	cfg := config.GetConfig()
+
+	switch cfg.ProxyMode {
+	case "", StreamModeRedirect, StreamModeProxy:
+	default:
+		return errors.New("unsupported streaming mode: " + cfg.ProxyMode)
+	}
+
+	var patterns []*regexp.Regexp
+	for _, expr := range cfg.ProxyUserAgents {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	proxyUserAgents = patterns
+	return nil
+}
+
+// shouldProxy reports whether the request must be streamed through the frontend
+// instead of being redirected, either globally or because of the client's User-Agent.
+func shouldProxy(c *gin.Context) bool {
+	if config.GetConfig().ProxyMode == StreamModeProxy {
+		return true
+	}
+
+	userAgent := c.Request.UserAgent()
+	for _, pattern := range proxyUserAgents {
+		if pattern.MatchString(userAgent) {
+			logger.Debug("User-Agent %q matched proxy pattern %s", userAgent, pattern)
+			return true
+		}
+	}
+	return false
+}
+
+// respondWithStreamingURL sends the client to the streaming URL, either by redirecting it
+// or by proxying the backend response, depending on the streaming mode.
+func respondWithStreamingURL(c *gin.Context, streamingURL string) {
+	if shouldProxy(c) {
+		logger.Info("Proxying streaming URL: %s", streamingURL)
+		proxyStream(c, streamingURL, nil)
+		return
+	}
+
+	logger.Info("Redirecting to streaming URL: %s", streamingURL)
+	c.Header("Location", streamingURL)
+	c.Status(http.StatusFound)
+}
+
+// respondWithRemoteTarget sends the client straight to a remote target. Targets with headers
+// are always proxied, see InitializeStrm.
+func respondWithRemoteTarget(c *gin.Context, target remoteTarget) {
+	if target.Proxy || shouldProxy(c) {
+		logger.Info("Proxying remote URL: %s", target.URL)
+		proxyStream(c, target.URL, target.Headers)
+		return
+	}
+
+	logger.Info("Redirecting to remote URL: %s", target.URL)
+	c.Header("Location", target.URL)
+	c.Status(http.StatusFound)
+}
+
+// proxyStream streams the backend response for the target URL back to the client.
+// Range, If-Range and HEAD requests are forwarded as-is, backend headers such as Content-Length,
+// Content-Range and Accept-Ranges are preserved, and every chunk is flushed immediately.
+// The backend request is cancelled as soon as the client disconnects.
+// The given headers are set on the upstream request.
+func proxyStream(c *gin.Context, targetURL string, headers http.Header) {
+	target, err := url.Parse(targetURL)
+	if err != nil {
+		logger.Error("Failed to parse streaming URL %s: %v", targetURL, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid streaming URL"})
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL = target
+			r.Out.Host = target.Host
+			for _, header := range clientOnlyHeaders {
+				r.Out.Header.Del(header)
+			}
+			for key, values := range headers {
+				r.Out.Header[key] = values
+			}
+			r.SetXForwarded()
+			// The peer of the frontend is nginx, backends checking client-bound tokens need the real client.
+			r.Out.Header.Set("X-Forwarded-For", c.ClientIP())
+			r.Out.Header.Set("X-Real-IP", c.ClientIP())
+		},
+		Transport:     proxyTransport,
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(r.Context().Err(), context.Canceled) {
+				logger.Debug("Client disconnected while streaming %s", target.Path)
+				return
+			}
+			logger.Error("Failed to proxy streaming URL %s: %v", targetURL, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
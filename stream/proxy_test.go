@@ -0,0 +1,229 @@
+package stream
+
+import (
+	"PiliPili_Frontend/config"
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestBackend starts a backend serving the media content with Range support, and returns it
+// with the headers of the last request it received.
+func newTestBackend(t *testing.T, content string) (*httptest.Server, *http.Header) {
+	t.Helper()
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		if r.URL.Query().Get("signature") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "movie.mkv", time.Unix(1800000000, 0), bytes.NewReader([]byte(content)))
+	}))
+	t.Cleanup(server.Close)
+	return server, &received
+}
+
+// proxyTestRequest sends a request with the client headers to a frontend proxying every stream to
+// the target URL with the given upstream headers, and returns the response with its body.
+func proxyTestRequest(t *testing.T, method string, clientHeaders map[string]string, targetURL string, headers http.Header) (*http.Response, string) {
+	t.Helper()
+	r := gin.New()
+	r.Any("/videos/:itemID/stream", func(c *gin.Context) { proxyStream(c, targetURL, headers) })
+	frontend := httptest.NewServer(r)
+	t.Cleanup(frontend.Close)
+
+	req, err := http.NewRequest(method, frontend.URL+"/videos/1/stream?api_key=user-token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range clientHeaders {
+		req.Header.Set(key, value)
+	}
+	resp, err := frontend.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Proxy request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read the proxied body: %v", err)
+	}
+	return resp, string(body)
+}
+
+func TestProxyStreamPassesRanges(t *testing.T) {
+	server, _ := newTestBackend(t, "0123456789")
+	targetURL := server.URL + "/stream?signature=token"
+
+	tests := []struct {
+		name        string
+		method      string
+		headers     map[string]string
+		wantStatus  int
+		wantBody    string
+		wantHeaders map[string]string
+	}{
+		{
+			name:        "full content",
+			method:      http.MethodGet,
+			wantStatus:  http.StatusOK,
+			wantBody:    "0123456789",
+			wantHeaders: map[string]string{"Content-Length": "10", "Accept-Ranges": "bytes"},
+		},
+		{
+			name:        "range",
+			method:      http.MethodGet,
+			headers:     map[string]string{"Range": "bytes=2-5"},
+			wantStatus:  http.StatusPartialContent,
+			wantBody:    "2345",
+			wantHeaders: map[string]string{"Content-Length": "4", "Content-Range": "bytes 2-5/10"},
+		},
+		{
+			name:        "open range",
+			method:      http.MethodGet,
+			headers:     map[string]string{"Range": "bytes=7-"},
+			wantStatus:  http.StatusPartialContent,
+			wantBody:    "789",
+			wantHeaders: map[string]string{"Content-Range": "bytes 7-9/10"},
+		},
+		{
+			name:       "stale If-Range",
+			method:     http.MethodGet,
+			headers:    map[string]string{"Range": "bytes=2-5", "If-Range": "Mon, 02 Jan 2006 15:04:05 GMT"},
+			wantStatus: http.StatusOK,
+			wantBody:   "0123456789",
+		},
+		{
+			name:        "unsatisfiable range",
+			method:      http.MethodGet,
+			headers:     map[string]string{"Range": "bytes=20-"},
+			wantStatus:  http.StatusRequestedRangeNotSatisfiable,
+			wantHeaders: map[string]string{"Content-Range": "bytes */10"},
+		},
+		{
+			name:        "head",
+			method:      http.MethodHead,
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Content-Length": "10", "Accept-Ranges": "bytes"},
+		},
+		{
+			name:        "head with range",
+			method:      http.MethodHead,
+			headers:     map[string]string{"Range": "bytes=2-5"},
+			wantStatus:  http.StatusPartialContent,
+			wantHeaders: map[string]string{"Content-Length": "4", "Content-Range": "bytes 2-5/10"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, body := proxyTestRequest(t, test.method, test.headers, targetURL, nil)
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("Proxy answered %d, want %d", resp.StatusCode, test.wantStatus)
+			}
+			if test.wantBody != "" && body != test.wantBody {
+				t.Errorf("Proxy body\n got: %q\nwant: %q", body, test.wantBody)
+			}
+			if test.method == http.MethodHead && body != "" {
+				t.Errorf("Proxy answered HEAD with a body: %q", body)
+			}
+			for key, value := range test.wantHeaders {
+				if got := resp.Header.Get(key); got != value {
+					t.Errorf("Proxy header %s\n got: %q\nwant: %q", key, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyStreamStripsCredentials(t *testing.T) {
+	server, received := newTestBackend(t, "0123456789")
+
+	clientHeaders := map[string]string{
+		"Authorization":        `MediaBrowser Token="user-token"`,
+		"Cookie":               "session=secret",
+		"X-Emby-Authorization": `Emby Token="user-token"`,
+		"X-Emby-Token":         "user-token",
+		"X-MediaBrowser-Token": "user-token",
+		"User-Agent":           "Infuse/7.0",
+		"Range":                "bytes=0-1",
+	}
+	upstreamHeaders := http.Header{"Referer": {"https://pan.example.com/"}}
+
+	resp, _ := proxyTestRequest(t, http.MethodGet, clientHeaders, server.URL+"/stream?signature=token", upstreamHeaders)
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Proxy answered %d, want %d", resp.StatusCode, http.StatusPartialContent)
+	}
+
+	for _, header := range clientOnlyHeaders {
+		if value := received.Get(header); value != "" {
+			t.Errorf("Backend received the client credential %s: %q", header, value)
+		}
+	}
+	want := map[string]string{
+		"User-Agent":      "Infuse/7.0",
+		"Range":           "bytes=0-1",
+		"Referer":         "https://pan.example.com/",
+		"X-Forwarded-For": "127.0.0.1",
+		"X-Real-Ip":       "127.0.0.1",
+	}
+	for key, value := range want {
+		if got := received.Get(key); got != value {
+			t.Errorf("Backend header %s\n got: %q\nwant: %q", key, got, value)
+		}
+	}
+}
+
+func TestProxyStreamBackendFailure(t *testing.T) {
+	server, _ := newTestBackend(t, "0123456789")
+	server.Close()
+
+	if resp, _ := proxyTestRequest(t, http.MethodGet, nil, server.URL+"/stream", nil); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Proxy to a closed backend answered %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+}
+
+func TestShouldProxy(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		userAgent string
+		want      bool
+	}{
+		{name: "redirect mode", mode: StreamModeRedirect, userAgent: "Emby Web", want: false},
+		{name: "default mode", userAgent: "Emby Web", want: false},
+		{name: "proxy mode", mode: StreamModeProxy, userAgent: "Emby Web", want: true},
+		{name: "matching user agent", mode: StreamModeRedirect, userAgent: "Infuse/7.0", want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestConfig(t, func(cfg *config.Config) {
+				cfg.ProxyMode = test.mode
+				cfg.ProxyUserAgents = []string{`^Infuse/`}
+			})
+			previous := proxyUserAgents
+			t.Cleanup(func() { proxyUserAgents = previous })
+			if err := InitializeProxy(); err != nil {
+				t.Fatalf("InitializeProxy returned error: %v", err)
+			}
+
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/videos/1/stream", nil)
+			c.Request.Header.Set("User-Agent", test.userAgent)
+			if got := shouldProxy(c); got != test.want {
+				t.Errorf("shouldProxy(%q) = %v, want %v", test.userAgent, got, test.want)
+			}
+		})
+	}
+
+	useTestConfig(t, func(cfg *config.Config) { cfg.ProxyMode = "tunnel" })
+	if err := InitializeProxy(); err == nil {
+		t.Error("InitializeProxy accepted an unsupported streaming mode")
+	}
+}
@@ -0,0 +1,384 @@
+// Package stream handles processing of media streams.
+package stream
+
+import (
+	"PiliPili_Frontend/logger"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of revocations, each matching one claim of the stream tokens.
+const (
+	RevokeUser   = "user"   // Tokens issued to an Emby user ID (uid)
+	RevokeDevice = "device" // Tokens issued to a device ID (did)
+	RevokeItem   = "item"   // Tokens of an item ID (itemId)
+	RevokeToken  = "token"  // A single token, identified by its TokenID
+)
+
+// Revocation withdraws the stream tokens matching Type and Value that expire no later than ExpireAt.
+// Tokens issued after the revocation expire later and are not affected, and once ExpireAt has passed
+// every affected token has expired on its own, so the entry is dropped.
+type Revocation struct {
+	Version   int64  `json:"version"`
+	Type      string `json:"type"`
+	Value     string `json:"value"`
+	RevokedAt int64  `json:"revokedAt"`
+	ExpireAt  int64  `json:"expireAt"`
+}
+
+// revocationSnapshot is the published revocation list, also used as the format of Revocation.file.
+type revocationSnapshot struct {
+	Version     int64        `json:"version"`
+	Revocations []Revocation `json:"revocations"`
+}
+
+// RevocationList keeps the revocations of stream tokens issued by this frontend.
+// With a Redis cache, the revocations are stored in Redis and every instance keeps a copy
+// that it syncs at most revocationSyncInterval apart.
+type RevocationList struct {
+	mu       sync.RWMutex
+	version  int64
+	entries  []Revocation // Ordered by version
+	lifetime time.Duration
+	skew     time.Duration
+	file     string
+	redis    *redis.Client
+	key      string       // Sorted set of the revocations in Redis, scored by version
+	synced   atomic.Int64 // Unix nanoseconds of the last sync with Redis
+}
+
+// revocationSyncInterval bounds how long a revocation made by another instance takes to apply.
+const revocationSyncInterval = time.Second
+
+// revokeScript stores a revocation in the sorted set KEYS[1] under the next version of the
+// counter KEYS[2]. Versions follow the clock, given as ARGV[1], and are assigned in the order
+// the revocations are stored, so an instance syncing from its last version misses none.
+var revokeScript = redis.NewScript(`
+local version = redis.call("INCR", KEYS[2])
+if version < tonumber(ARGV[1]) then
+	redis.call("SET", KEYS[2], ARGV[1])
+	version = tonumber(ARGV[1])
+end
+redis.call("ZADD", KEYS[1], version, ARGV[2])
+return version
+`)
+
+var revocations *RevocationList
+
+// InitializeRevocations initializes the revocation list. Tokens live for at most lifetime, and
+// backends accept them for skew after they expire. The list is persisted to file unless it is empty,
+// or kept in Redis when the cache uses it.
+func InitializeRevocations(lifetime, skew time.Duration, file string) error {
+	list := &RevocationList{lifetime: lifetime, skew: skew, file: file}
+	if redisClient != nil {
+		if file != "" {
+			logger.Warn("Revocation.file is not used, revocations are kept in redis")
+		}
+		list.file, list.redis, list.key = "", redisClient, redisPrefix+"revocations"
+		list.mu.Lock()
+		err := list.sync(time.Now())
+		list.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to load revocations from redis: %w", err)
+		}
+	} else if err := list.load(); err != nil {
+		return err
+	}
+	revocations = list
+	return nil
+}
+
+// Revoke adds a revocation of the tokens of the given type and value issued until now.
+func (l *RevocationList) Revoke(kind, value string, now time.Time) (Revocation, error) {
+	switch kind {
+	case RevokeUser, RevokeDevice, RevokeItem, RevokeToken:
+	default:
+		return Revocation{}, fmt.Errorf("unsupported revocation type %q", kind)
+	}
+	if value == "" {
+		return Revocation{}, errors.New("revocation value is empty")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	revocation := Revocation{
+		Type:      kind,
+		Value:     value,
+		RevokedAt: now.Unix(),
+		ExpireAt:  now.Add(l.lifetime).Unix(),
+	}
+	if l.redis != nil {
+		return l.revokeShared(revocation, now)
+	}
+
+	l.prune(now)
+	// Versions follow the clock so that they keep increasing across restarts without a file.
+	l.version = max(l.version+1, now.UnixMilli())
+	revocation.Version = l.version
+	l.entries = append(l.entries, revocation)
+	// The revocation is in effect even if it cannot be persisted.
+	if err := l.save(); err != nil {
+		logger.Error("Failed to persist revocations to %s: %v", l.file, err)
+	}
+	return revocation, nil
+}
+
+// revokeShared stores the revocation in Redis and syncs the list, which then holds it together
+// with the revocations other instances stored before it. The caller must hold the lock.
+func (l *RevocationList) revokeShared(revocation Revocation, now time.Time) (Revocation, error) {
+	member, err := json.Marshal(revocation)
+	if err != nil {
+		return Revocation{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	keys := []string{l.key, l.key + ":version"}
+	if revocation.Version, err = revokeScript.Run(ctx, l.redis, keys, now.UnixMilli(), member).Int64(); err != nil {
+		return Revocation{}, fmt.Errorf("failed to store revocation in redis: %w", err)
+	}
+	if err := l.sync(now); err != nil {
+		logger.Warn("Failed to sync revocations from redis: %v", err)
+	}
+	return revocation, nil
+}
+
+// refresh syncs the list with Redis if it was last synced more than revocationSyncInterval ago.
+func (l *RevocationList) refresh(now time.Time) {
+	if l.redis == nil || now.UnixNano()-l.synced.Load() < int64(revocationSyncInterval) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.UnixNano()-l.synced.Load() < int64(revocationSyncInterval) {
+		return
+	}
+	if err := l.sync(now); err != nil {
+		// Redis is retried at the next interval, the revocations synced so far stay in effect.
+		logger.Warn("Failed to sync revocations from redis: %v", err)
+		l.synced.Store(now.UnixNano())
+	}
+}
+
+// sync appends the revocations stored in Redis after the current version and drops the expired
+// ones from Redis. The caller must hold the lock.
+func (l *RevocationList) sync(now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	// Versions are never below the revocation time in milliseconds, so this spares live entries.
+	cutoff := now.Add(-l.skew - l.lifetime).UnixMilli()
+	if err := l.redis.ZRemRangeByScore(ctx, l.key, "-inf", "("+strconv.FormatInt(cutoff, 10)).Err(); err != nil {
+		return err
+	}
+	stored, err := l.redis.ZRangeByScoreWithScores(ctx, l.key, &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(l.version, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range stored {
+		var revocation Revocation
+		member, _ := entry.Member.(string)
+		if err := json.Unmarshal([]byte(member), &revocation); err != nil {
+			logger.Warn("Ignoring invalid revocation in redis: %v", err)
+			continue
+		}
+		revocation.Version = int64(entry.Score)
+		l.entries = append(l.entries, revocation)
+		l.version = max(l.version, revocation.Version)
+	}
+	l.prune(now)
+	l.synced.Store(now.UnixNano())
+	return nil
+}
+
+// Since returns the current version and the revocations added after the given version.
+func (l *RevocationList) Since(version int64, now time.Time) (int64, []Revocation) {
+	l.refresh(now)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+	changes := []Revocation{}
+	for _, revocation := range l.entries {
+		if revocation.Version > version {
+			changes = append(changes, revocation)
+		}
+	}
+	return l.version, changes
+}
+
+// Revokes reports whether the token with the given claims has been revoked.
+func (l *RevocationList) Revokes(claims *StreamClaims, token string) bool {
+	l.refresh(time.Now())
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	tokenID := ""
+	for _, revocation := range l.entries {
+		if claims.ExpireAt > revocation.ExpireAt {
+			continue
+		}
+		var value string
+		switch revocation.Type {
+		case RevokeUser:
+			value = claims.UserId
+		case RevokeDevice:
+			value = claims.DeviceId
+		case RevokeItem:
+			value = claims.ItemId
+		case RevokeToken:
+			if tokenID == "" {
+				tokenID = TokenID(token)
+			}
+			value = tokenID
+		}
+		if value == revocation.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// prune drops the revocations whose tokens have all expired. The caller must hold the lock.
+func (l *RevocationList) prune(now time.Time) {
+	cutoff := now.Add(-l.skew).Unix()
+	kept := l.entries[:0]
+	for _, revocation := range l.entries {
+		if revocation.ExpireAt >= cutoff {
+			kept = append(kept, revocation)
+		}
+	}
+	clear(l.entries[len(kept):])
+	l.entries = kept
+}
+
+// load reads the persisted revocation list, if any.
+func (l *RevocationList) load() error {
+	if l.file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(l.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snapshot revocationSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("invalid revocation file %s: %w", l.file, err)
+	}
+	l.version, l.entries = snapshot.Version, snapshot.Revocations
+	l.prune(time.Now())
+	return nil
+}
+
+// save persists the revocation list, replacing the file atomically. The caller must hold the lock.
+func (l *RevocationList) save() error {
+	if l.file == "" {
+		return nil
+	}
+	data, err := json.Marshal(revocationSnapshot{Version: l.version, Revocations: l.entries})
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(l.file), filepath.Base(l.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), l.file)
+}
+
+// hasRevocations reports whether any token is currently revoked.
+func hasRevocations() bool {
+	if revocations == nil {
+		return false
+	}
+	revocations.refresh(time.Now())
+	revocations.mu.RLock()
+	defer revocations.mu.RUnlock()
+	return len(revocations.entries) > 0
+}
+
+// isRevoked reports whether a token that verified has been revoked since it was issued.
+func isRevoked(claims *StreamClaims, token string) bool {
+	return revocations != nil && revocations.Revokes(claims, token)
+}
+
+// HandleRevoke handles the admin request revoking tokens by user, device, item or token ID.
+// Revoking a user also purges the URLs cached for that user.
+func HandleRevoke(c *gin.Context) {
+	var request struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid revocation request"})
+		return
+	}
+
+	revocation, err := revocations.Revoke(request.Type, request.Value, time.Now())
+	if err != nil {
+		logger.Error("Failed to revoke %s %s: %v", request.Type, request.Value, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("Revoked tokens of %s %s (version %d)", revocation.Type, revocation.Value, revocation.Version)
+
+	if revocation.Type == RevokeUser {
+		purgeCacheScope(clientIdentity{UserID: revocation.Value}.cacheScope())
+		logger.Info("Purged cached URLs of user %s", revocation.Value)
+	}
+
+	c.JSON(http.StatusCreated, revocation)
+}
+
+// HandleRevocations publishes the revocations added after the version given by the since parameter.
+// The ETag is the current version, so pollers that are up to date get 304 Not Modified.
+func HandleRevocations(c *gin.Context) {
+	since, err := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since parameter"})
+		return
+	}
+
+	version, changes := revocations.Since(since, time.Now())
+	etag := fmt.Sprintf(`"%d"`, version)
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-cache")
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.JSON(http.StatusOK, revocationSnapshot{Version: version, Revocations: changes})
+}
@@ -0,0 +1,143 @@
+package stream
+
+import (
+	"PiliPili_Frontend/config"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"testing"
+	"time"
+)
+
+// useTestRedis makes the caches, revocations and cache generations use a fresh miniredis.
+func useTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	previousClient, previousPrefix, previousRevocations := redisClient, redisPrefix, revocations
+	redisClient, redisPrefix = client, "pilipili:"
+	t.Cleanup(func() {
+		redisClient, redisPrefix, revocations = previousClient, previousPrefix, previousRevocations
+		client.Close()
+	})
+	return server
+}
+
+// newSharedRevocationList creates the revocation list of one frontend instance.
+func newSharedRevocationList(t *testing.T) *RevocationList {
+	t.Helper()
+	if err := InitializeRevocations(time.Hour, time.Minute, ""); err != nil {
+		t.Fatalf("InitializeRevocations returned error: %v", err)
+	}
+	return revocations
+}
+
+func TestRevocationsAreSharedThroughRedis(t *testing.T) {
+	useTestRedis(t)
+	first, second := newSharedRevocationList(t), newSharedRevocationList(t)
+
+	now := time.Now()
+	revoked, err := first.Revoke(RevokeUser, "user1", now)
+	if err != nil {
+		t.Fatalf("Revoke returned error: %v", err)
+	}
+	other, err := second.Revoke(RevokeDevice, "device1", now)
+	if err != nil {
+		t.Fatalf("Revoke returned error: %v", err)
+	}
+	if other.Version <= revoked.Version {
+		t.Errorf("Instances issued versions %d and then %d", revoked.Version, other.Version)
+	}
+
+	claims := &StreamClaims{UserId: "user1", ExpireAt: now.Add(time.Minute).Unix()}
+	if !second.Revokes(claims, "token") {
+		t.Error("A revocation stored by another instance does not apply")
+	}
+
+	// The first instance synced when it revoked, so it only sees the second revocation once due.
+	deviceClaims := &StreamClaims{DeviceId: "device1", ExpireAt: now.Add(time.Minute).Unix()}
+	first.synced.Store(0)
+	if !first.Revokes(deviceClaims, "token") {
+		t.Error("A revocation stored by another instance does not apply after the sync interval")
+	}
+
+	for _, list := range []*RevocationList{first, second} {
+		version, changes := list.Since(0, now)
+		if version != other.Version || len(changes) != 2 ||
+			changes[0].Version != revoked.Version || changes[1].Version != other.Version {
+			t.Errorf("Since returned version %d and %+v", version, changes)
+		}
+	}
+}
+
+func TestRevocationsExpireFromRedis(t *testing.T) {
+	server := useTestRedis(t)
+	list := newSharedRevocationList(t)
+
+	past := time.Now().Add(-2 * time.Hour)
+	if _, err := list.Revoke(RevokeItem, "item1", past); err != nil {
+		t.Fatalf("Revoke returned error: %v", err)
+	}
+	list.synced.Store(0)
+	if _, changes := list.Since(0, time.Now()); len(changes) != 0 {
+		t.Errorf("Since returned expired revocations: %+v", changes)
+	}
+	if members, err := server.ZMembers("pilipili:revocations"); err == nil && len(members) != 0 {
+		t.Errorf("Expired revocations stay in redis: %v", members)
+	}
+}
+
+func TestCacheGenerationsAreSharedThroughRedis(t *testing.T) {
+	server := useTestRedis(t)
+	previousCache := cache
+	cache = NewRedisCache(redisClient, redisPrefix+"url:", time.Hour)
+	t.Cleanup(func() { cache = previousCache })
+
+	parameters := RequestParameters{CacheScope: "user:1", ItemId: "item1", MediaSourceID: "source1"}
+	before := buildCacheKey(parameters)
+	if err := cache.Set(before, "https://backend/stream"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	purgeCacheScope("user:1")
+	if generation, err := server.Get("pilipili:generation:user:1"); err != nil || generation != "1" {
+		t.Errorf("Generation stored in redis as %q, %v", generation, err)
+	}
+	after := buildCacheKey(parameters)
+	if after == before {
+		t.Error("Purging the scope did not change its cache key")
+	}
+	if _, found := cache.Get(before); found {
+		t.Error("Purging the scope left its URLs in redis")
+	}
+	if other := buildCacheKey(RequestParameters{CacheScope: "user:10", ItemId: "item1"}); other[:len("user:10:")] != "user:10:" {
+		t.Errorf("Purging a scope moved another scope to %s", other)
+	}
+}
+
+func TestMemoryCacheGenerationsArePruned(t *testing.T) {
+	useTestConfig(t, func(cfg *config.Config) { cfg.PlayURLMaxAliveTime = 60 })
+	previous, previousLast := cacheGenerations, cacheGenerationsLast
+	cacheGenerations = map[string]cacheGenerationEntry{}
+	t.Cleanup(func() { cacheGenerations, cacheGenerationsLast = previous, previousLast })
+
+	start := time.Unix(1800000000, 0)
+	for i := 0; i < 1000; i++ {
+		purgeMemoryCacheScope(fmt.Sprintf("user:%d", i), start)
+	}
+	first := memoryCacheGeneration("user:0", start.Add(59*time.Second))
+	if first == 0 {
+		t.Fatal("Purged scope is still at generation 0 within the URL lifetime")
+	}
+	if generation := memoryCacheGeneration("user:0", start.Add(time.Minute)); generation != 0 {
+		t.Errorf("Scope is at generation %d once the URLs cached before its purge expired, want 0", generation)
+	}
+
+	purgeMemoryCacheScope("user:0", start.Add(time.Minute))
+	if len(cacheGenerations) != 1 {
+		t.Errorf("%d generations are kept after the URL lifetime, want 1", len(cacheGenerations))
+	}
+	if generation := memoryCacheGeneration("user:0", start.Add(time.Minute)); generation == 0 || generation == first {
+		t.Errorf("Scope purged again moved to generation %d, want a new one after %d", generation, first)
+	}
+}
@@ -0,0 +1,32 @@
+// Package stream handles processing of media streams.
+package stream
+
+import (
+	"PiliPili_Frontend/config"
+	"PiliPili_Frontend/logger"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// generateS3URL presigns a GET URL for the route's object, valid for PlayURLMaxAliveTime but at most
+// seven days, and returns it with its expiry. Without a configured bucket, the first segment of the
+// mapped path names the bucket.
+func generateS3URL(route mediaRoute) (string, time.Time, error) {
+	bucket, key := route.S3Bucket, route.Path
+	if bucket == "" {
+		bucket, key, _ = strings.Cut(route.Path, "/")
+	}
+	if bucket == "" || key == "" {
+		return "", time.Time{}, fmt.Errorf("media path %s does not name an s3 bucket and key", route.Path)
+	}
+
+	expires := time.Duration(config.GetConfig().PlayURLMaxAliveTime) * time.Second
+	presignedURL, expireAt, err := route.S3.PresignGetObject(bucket, key, expires, time.Now())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	logger.Info("Presigned s3 object %s/%s", bucket, key)
+	return presignedURL, expireAt, nil
+}
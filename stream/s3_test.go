@@ -0,0 +1,45 @@
+package stream
+
+import (
+	"PiliPili_Frontend/api"
+	"PiliPili_Frontend/config"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateS3URLCapsExpiry(t *testing.T) {
+	s3, err := api.NewS3API("http://minio:9000", "", "access", "secret", "", true)
+	if err != nil {
+		t.Fatalf("NewS3API returned error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		want     time.Duration
+	}{
+		{name: "within the cap", lifetime: 6 * time.Hour, want: 6 * time.Hour},
+		{name: "longer than seven days", lifetime: 30 * 24 * time.Hour, want: 7 * 24 * time.Hour},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestConfig(t, func(cfg *config.Config) { cfg.PlayURLMaxAliveTime = int(test.lifetime / time.Second) })
+
+			start := time.Now()
+			presignedURL, expireAt, err := generateS3URL(mediaRoute{S3: s3, Path: "media/movie.mkv"})
+			if err != nil {
+				t.Fatalf("generateS3URL returned error: %v", err)
+			}
+			if expireAt.Before(start.Add(test.want-time.Second)) || expireAt.After(time.Now().Add(test.want)) {
+				t.Errorf("generateS3URL expires in %v, want %v", expireAt.Sub(start), test.want)
+			}
+			wantExpires := "X-Amz-Expires=" + strconv.Itoa(int(test.want/time.Second))
+			if !strings.Contains(presignedURL, wantExpires) {
+				t.Errorf("generateS3URL returned %s, want %s", presignedURL, wantExpires)
+			}
+		})
+	}
+}
@@ -2,12 +2,41 @@
 package stream
 
 import (
+	"PiliPili_Frontend/config"
+	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/hmac"
+	"crypto/md5"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Token format versions understood by Signature.
+const (
+	TokenVersionLegacy  = 1 // itemId, mediaId and expireAt only; path and host are not signed
+	TokenVersionV2      = 2 // adds path, backend host and an optional not-before time
+	TokenVersionCompact = 3 // binary token with a truncated MAC, the claims travel in the URL
+)
+
+// Signing key algorithms of the keyring.
+const (
+	KeyAlgorithmHMAC    = "hmac-sha256" // Shared secret, backends can mint tokens
+	KeyAlgorithmEd25519 = "ed25519"     // Key pair, backends only hold the public key
+)
+
+// Signing key states of the keyring.
+const (
+	KeyStateActive = "active" // Signs new tokens and verifies existing ones
+	KeyStateVerify = "verify" // Only verifies tokens, used while a retired key drains
 )
 
 var (
@@ -15,26 +44,205 @@ var (
 	once              sync.Once
 )
 
-// Signature provides methods for signing and verifying data using HMAC-SHA256.
+// Signature provides methods for signing and verifying data using HMAC-SHA256 or Ed25519.
+// Tokens are signed with the active key of its keyring, which can be swapped at runtime.
 type Signature struct {
-	key []byte
+	ring        atomic.Pointer[keyring]
+	options     SignatureOptions
+	legacyUntil int64 // Unix time after which legacy tokens are rejected
+}
+
+// signingKey is a key of the keyring.
+type signingKey struct {
+	id         string // Key ID carried by the tokens, empty for a key configured through Encipher
+	algorithm  string
+	secret     []byte             // HMAC secret
+	privateKey ed25519.PrivateKey // Ed25519 private key
+	tag        [4]byte            // Key tag of compact tokens
+	compact    *sync.Pool         // Reusable compactSigners
+	pathAEAD   cipher.AEAD        // Cipher of encrypted media paths, nil without path encryption
+}
+
+// keyring holds the keys a Signature verifies with and the one it signs with.
+type keyring struct {
+	active *signingKey
+	keys   []*signingKey
 }
 
-// InitializeSignature initializes the global Signature instance with the provided AES key.
-// The key length must be 16 bytes for AES-128.
-func InitializeSignature(encipher string) error {
+// SignatureOptions controls how stream tokens are issued and verified.
+type SignatureOptions struct {
+	Version           int           // Token version to issue (TokenVersionLegacy, TokenVersionV2 or TokenVersionCompact)
+	NotBefore         bool          // Whether v2 tokens carry a not-before time
+	ClockSkew         time.Duration // Tolerance applied to expireAt and nbf checks
+	LegacyGracePeriod time.Duration // How long legacy tokens keep verifying after start-up
+	PathEncryption    string        // AEAD hiding the media path inside v2 and compact tokens, empty to disable
+}
+
+// StreamClaims describes the fields bound into a stream token.
+// UserId identifies the Emby user the token was issued to, so the backend can log who is playing.
+type StreamClaims struct {
+	Version       int    `json:"v"`
+	ItemId        string `json:"itemId"`
+	MediaId       string `json:"mediaId"`
+	Path          string `json:"path"`
+	EncryptedPath string `json:"epath,omitempty"`
+	Host          string `json:"host"`
+	UserId        string `json:"uid,omitempty"`
+	ClientNet     string `json:"ip,omitempty"`
+	DeviceId      string `json:"did,omitempty"`
+	NotBefore     int64  `json:"nbf,omitempty"`
+	ExpireAt      int64  `json:"expireAt"`
+}
+
+// InitializeSignature initializes the global Signature instance with the provided AES key,
+// or with the keyring when keys are configured. Every key must be 16 bytes for AES-128.
+func InitializeSignature(encipher string, keys []config.SignatureKeyConfig, options SignatureOptions) error {
 	var initError error
 	once.Do(func() {
-		key := []byte(encipher)
-		if len(key) != 16 {
-			initError = errors.New("AES key must be 16 bytes long for AES-128")
-			return
+		signatureInstance, initError = NewSignature(encipher, options)
+		if initError == nil && len(keys) > 0 {
+			initError = signatureInstance.SetKeys(keys)
 		}
-		signatureInstance = &Signature{key: key}
 	})
 	return initError
 }
 
+// ReloadSignatureKeys replaces the keyring of the global Signature. Tokens signed with keys that are
+// still present keep verifying; an invalid keyring is rejected and the current one is kept.
+func ReloadSignatureKeys(keys []config.SignatureKeyConfig) error {
+	signature, err := GetSignatureInstance()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("signature keyring is empty")
+	}
+	return signature.SetKeys(keys)
+}
+
+// NewSignature creates a Signature for the given 16-byte key.
+func NewSignature(encipher string, options SignatureOptions) (*Signature, error) {
+	key := []byte(encipher)
+	if len(key) != 16 {
+		return nil, errors.New("AES key must be 16 bytes long for AES-128")
+	}
+	if options.Version == 0 {
+		options.Version = TokenVersionV2
+	}
+	if options.Version != TokenVersionLegacy && options.Version != TokenVersionV2 && options.Version != TokenVersionCompact {
+		return nil, errors.New("unsupported token version")
+	}
+	signature := &Signature{
+		options:     options,
+		legacyUntil: time.Now().Add(options.LegacyGracePeriod).Unix(),
+	}
+	onlyKey := &signingKey{algorithm: KeyAlgorithmHMAC, secret: key, tag: keyTag(""), compact: newCompactPool(key)}
+	var err error
+	if onlyKey.pathAEAD, err = newPathAEAD(options.PathEncryption, onlyKey); err != nil {
+		return nil, err
+	}
+	signature.ring.Store(&keyring{active: onlyKey, keys: []*signingKey{onlyKey}})
+	return signature, nil
+}
+
+// SetKeys replaces the keyring. Key IDs must be unique and at least one key must be active;
+// the first active key signs new tokens.
+func (s *Signature) SetKeys(keys []config.SignatureKeyConfig) error {
+	ring := &keyring{}
+	for i, key := range keys {
+		if key.ID == "" {
+			return fmt.Errorf("signature key %d has no id", i)
+		}
+		if ring.find(key.ID) != nil {
+			return fmt.Errorf("signature key %s is configured twice", key.ID)
+		}
+
+		entry, err := newSigningKey(key)
+		if err != nil {
+			return err
+		}
+		if entry.pathAEAD, err = newPathAEAD(s.options.PathEncryption, entry); err != nil {
+			return fmt.Errorf("signature key %s: %w", key.ID, err)
+		}
+		switch key.State {
+		case "", KeyStateActive:
+			if ring.active == nil {
+				ring.active = entry
+			}
+		case KeyStateVerify:
+		default:
+			return fmt.Errorf("signature key %s has an unsupported state: %s", key.ID, key.State)
+		}
+		ring.keys = append(ring.keys, entry)
+	}
+	if ring.active == nil {
+		return errors.New("signature keyring has no active key")
+	}
+
+	s.ring.Store(ring)
+	return nil
+}
+
+// newSigningKey parses a configured key: 16 raw bytes for HMAC, a base64-encoded 32-byte seed for Ed25519.
+func newSigningKey(key config.SignatureKeyConfig) (*signingKey, error) {
+	switch key.Algorithm {
+	case "", KeyAlgorithmHMAC:
+		if len(key.Key) != 16 {
+			return nil, fmt.Errorf("signature key %s must be 16 bytes long", key.ID)
+		}
+		secret := []byte(key.Key)
+		return &signingKey{
+			id:        key.ID,
+			algorithm: KeyAlgorithmHMAC,
+			secret:    secret,
+			tag:       keyTag(key.ID),
+			compact:   newCompactPool(secret),
+		}, nil
+	case KeyAlgorithmEd25519:
+		seed, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("signature key %s must be a base64-encoded %d-byte ed25519 seed", key.ID, ed25519.SeedSize)
+		}
+		return &signingKey{
+			id:         key.ID,
+			algorithm:  KeyAlgorithmEd25519,
+			privateKey: ed25519.NewKeyFromSeed(seed),
+			tag:        keyTag(key.ID),
+			compact:    newCompactPool(nil),
+		}, nil
+	default:
+		return nil, fmt.Errorf("signature key %s has an unsupported algorithm: %s", key.ID, key.Algorithm)
+	}
+}
+
+// sign returns the signature of the data.
+func (key *signingKey) sign(data []byte) []byte {
+	if key.algorithm == KeyAlgorithmEd25519 {
+		return ed25519.Sign(key.privateKey, data)
+	}
+	h := hmac.New(sha256.New, key.secret)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// verify reports whether the signature of the data is valid.
+func (key *signingKey) verify(data, signature []byte) bool {
+	if key.algorithm == KeyAlgorithmEd25519 {
+		return ed25519.Verify(key.privateKey.Public().(ed25519.PublicKey), data, signature)
+	}
+	return hmac.Equal(signature, key.sign(data))
+}
+
+// find returns the key with the given ID, or nil.
+func (ring *keyring) find(id string) *signingKey {
+	for _, key := range ring.keys {
+		if key.id == id {
+			return key
+		}
+	}
+	return nil
+}
+
 // GetSignatureInstance returns the global Signature instance.
 func GetSignatureInstance() (*Signature, error) {
 	if signatureInstance == nil {
@@ -43,6 +251,159 @@ func GetSignatureInstance() (*Signature, error) {
 	return signatureInstance, nil
 }
 
+// Version returns the token version the Signature issues.
+func (s *Signature) Version() int {
+	return s.options.Version
+}
+
+// EncryptsPath reports whether issued tokens carry the media path encrypted, so URLs must not expose it.
+func (s *Signature) EncryptsPath() bool {
+	return s.options.PathEncryption != "" && s.options.Version != TokenVersionLegacy
+}
+
+// Sign issues a token for the given claims using the configured token version.
+// Legacy tokens ignore Path, Host and NotBefore.
+func (s *Signature) Sign(claims StreamClaims) (string, error) {
+	if s.options.Version == TokenVersionLegacy {
+		return s.Encrypt(claims.ItemId, claims.MediaId, claims.ExpireAt)
+	}
+
+	if s.options.NotBefore && claims.NotBefore == 0 {
+		claims.NotBefore = time.Now().Unix()
+	}
+
+	if s.options.Version == TokenVersionCompact {
+		token, err := s.AppendCompact(nil, &claims)
+		return string(token), err
+	}
+
+	claims.Version = TokenVersionV2
+	if aead := s.ring.Load().active.pathAEAD; aead != nil {
+		encryptedPath, err := encryptPathClaim(aead, claims.Path)
+		if err != nil {
+			return "", err
+		}
+		claims.Path, claims.EncryptedPath = "", encryptedPath
+	}
+
+	jsonData, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	return s.seal(jsonData)
+}
+
+// Verify checks the token signature and validity window and returns its claims.
+// Legacy tokens are accepted only during the configured grace period.
+// Compact tokens do not carry their claims and are checked with VerifyCompact instead.
+func (s *Signature) Verify(token string, now time.Time) (*StreamClaims, error) {
+	if IsCompactToken(token) {
+		return nil, errors.New("compact tokens must be verified with their URL claims")
+	}
+
+	jsonData, key, err := s.open(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims StreamClaims
+	if err := json.Unmarshal(jsonData, &claims); err != nil {
+		return nil, err
+	}
+
+	switch claims.Version {
+	case 0:
+		if now.Unix() > s.legacyUntil {
+			return nil, errors.New("legacy token is no longer accepted")
+		}
+		claims.Version = TokenVersionLegacy
+	case TokenVersionV2:
+	default:
+		return nil, errors.New("unsupported token version")
+	}
+
+	if err := s.checkValidity(&claims, now); err != nil {
+		return nil, err
+	}
+
+	if claims.EncryptedPath != "" {
+		if key.pathAEAD == nil {
+			return nil, errors.New("token carries an encrypted path but path encryption is disabled")
+		}
+		if claims.Path, err = decryptPathClaim(key.pathAEAD, claims.EncryptedPath); err != nil {
+			return nil, err
+		}
+	}
+	return &claims, nil
+}
+
+// checkValidity checks the expireAt and nbf claims, allowing for the configured clock skew.
+func (s *Signature) checkValidity(claims *StreamClaims, now time.Time) error {
+	skew := int64(s.options.ClockSkew / time.Second)
+	if claims.ExpireAt+skew <= now.Unix() {
+		return errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && claims.NotBefore-skew > now.Unix() {
+		return errors.New("token not yet valid")
+	}
+	return nil
+}
+
+// Matches reports whether the claims were issued for the given media path and backend host.
+// Legacy tokens carry neither and always match.
+func (c *StreamClaims) Matches(path, host string) bool {
+	if c.Version == TokenVersionLegacy {
+		return true
+	}
+	return c.Path == path && c.Host == host
+}
+
+// TokenID returns the ID of a stream token used to revoke it: the first 16 bytes of the
+// SHA-256 of the token as it appears in the signature parameter, hex-encoded.
+func TokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:16])
+}
+
+// AllowsClient reports whether a request from clientIP may use the token.
+// Tokens that are not bound to a client network allow every client.
+func (c *StreamClaims) AllowsClient(clientIP string) bool {
+	if c.ClientNet == "" {
+		return true
+	}
+	network, err := netip.ParsePrefix(c.ClientNet)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(clientIP)
+	return err == nil && network.Contains(addr.Unmap().WithZone(""))
+}
+
+// SignSecureLink returns the token checked by the nginx secure_link module configured with
+// secure_link_md5 "$secure_link_expires$uri$remote_addr <key>": the base64url-encoded, unpadded md5
+// of the expiry, the decoded request URI, the client address and the key.
+// An empty remoteAddr matches an expression without $remote_addr.
+// nginx only knows shared secrets, so an Ed25519 active key gives way to the first HMAC key of the keyring.
+func (s *Signature) SignSecureLink(uri string, expireAt int64, remoteAddr string) (string, error) {
+	ring := s.ring.Load()
+	key := ring.active
+	if key.algorithm != KeyAlgorithmHMAC {
+		key = nil
+		for _, candidate := range ring.keys {
+			if candidate.algorithm == KeyAlgorithmHMAC {
+				key = candidate
+				break
+			}
+		}
+		if key == nil {
+			return "", errors.New("secure links require an hmac-sha256 key")
+		}
+	}
+
+	sum := md5.Sum([]byte(strconv.FormatInt(expireAt, 10) + uri + remoteAddr + " " + string(key.secret)))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
 // Encrypt deterministically generates a signature for the given itemId, mediaId and expireAt using HMAC-SHA256.
 // Returns a base64-encoded ciphertext string.
 func (s *Signature) Encrypt(itemId, mediaId string, expireAt int64) (string, error) {
@@ -59,16 +420,45 @@ func (s *Signature) Encrypt(itemId, mediaId string, expireAt int64) (string, err
 		return "", err
 	}
 
-	// Generate HMAC-SHA256 signature
-	h := hmac.New(sha256.New, s.key)
-	h.Write(jsonData)
-	signature := h.Sum(nil)
+	return s.seal(jsonData)
+}
+
+// Decrypt verifies the provided base64-encoded signature using HMAC-SHA256.
+// Returns the original data as a map if the signature is valid.
+func (s *Signature) Decrypt(ciphertext string) (map[string]interface{}, error) {
+	jsonData, _, err := s.open(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the original data
+	var data map[string]interface{}
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// seal signs jsonData with the active key and wraps it together with the signature and the key ID
+// into a base64-encoded payload.
+func (s *Signature) seal(jsonData []byte) (string, error) {
+	key := s.ring.Load().active
+
+	// Generate the HMAC-SHA256 or Ed25519 signature
+	signature := key.sign(jsonData)
 
 	// Combine the JSON data and signature
 	payload := map[string]string{
 		"data":      base64.StdEncoding.EncodeToString(jsonData),
 		"signature": base64.StdEncoding.EncodeToString(signature),
 	}
+	if key.id != "" {
+		payload["kid"] = key.id
+	}
+	if key.algorithm != KeyAlgorithmHMAC {
+		payload["alg"] = key.algorithm
+	}
 
 	// Serialize the payload to JSON
 	payloadJson, err := json.Marshal(payload)
@@ -80,44 +470,51 @@ func (s *Signature) Encrypt(itemId, mediaId string, expireAt int64) (string, err
 	return base64.StdEncoding.EncodeToString(payloadJson), nil
 }
 
-// Decrypt verifies the provided base64-encoded signature using HMAC-SHA256.
-// Returns the original data as a map if the signature is valid.
-func (s *Signature) Decrypt(ciphertext string) (map[string]interface{}, error) {
+// open unwraps a base64-encoded payload and returns the signed JSON data and the key that signed it
+// if the signature is valid.
+func (s *Signature) open(ciphertext string) ([]byte, *signingKey, error) {
 	// Decode the base64-encoded payload
 	payloadJson, err := base64.StdEncoding.DecodeString(ciphertext)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Parse the JSON payload
 	var payload map[string]string
 	if err := json.Unmarshal(payloadJson, &payload); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Decode the data and signature
 	jsonData, err := base64.StdEncoding.DecodeString(payload["data"])
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	signature, err := base64.StdEncoding.DecodeString(payload["signature"])
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Verify the HMAC-SHA256 signature
-	h := hmac.New(sha256.New, s.key)
-	h.Write(jsonData)
-	computedSignature := h.Sum(nil)
-	if !hmac.Equal(signature, computedSignature) {
-		return nil, errors.New("signature verification failed")
+	// Tokens without a key ID predate the keyring and may have been signed with any of its keys.
+	ring := s.ring.Load()
+	candidates := ring.keys
+	if kid := payload["kid"]; kid != "" {
+		key := ring.find(kid)
+		if key == nil {
+			return nil, nil, errors.New("unknown signature key: " + kid)
+		}
+		candidates = []*signingKey{key}
 	}
 
-	// Parse the original data
-	var data map[string]interface{}
-	if err := json.Unmarshal(jsonData, &data); err != nil {
-		return nil, err
+	// Verify the signature with a key of the announced algorithm, HMAC-SHA256 when none is given
+	algorithm := payload["alg"]
+	if algorithm == "" {
+		algorithm = KeyAlgorithmHMAC
 	}
-
-	return data, nil
+	for _, key := range candidates {
+		if key.algorithm == algorithm && key.verify(jsonData, signature) {
+			return jsonData, key, nil
+		}
+	}
+	return nil, nil, errors.New("signature verification failed")
 }
@@ -0,0 +1,439 @@
+package stream
+
+import (
+	"PiliPili_Frontend/config"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignSecureLink(t *testing.T) {
+	// The example of the nginx ngx_http_secure_link_module documentation, whose key is shorter
+	// than the keyring accepts, so it is put in place directly.
+	docs := newTestSignature(t, SignatureOptions{})
+	docKey := &signingKey{algorithm: KeyAlgorithmHMAC, secret: []byte("secret")}
+	docs.ring.Store(&keyring{active: docKey, keys: []*signingKey{docKey}})
+
+	tests := []struct {
+		name       string
+		signature  *Signature
+		uri        string
+		expireAt   int64
+		remoteAddr string
+		want       string
+	}{
+		{
+			name:       "nginx documentation",
+			signature:  docs,
+			uri:        "/s/link",
+			expireAt:   2147483647,
+			remoteAddr: "127.0.0.1",
+			want:       "_e4Nc3iduzkWRm01TBBNYw",
+		},
+		{
+			name:      "without remote address",
+			signature: newTestSignature(t, SignatureOptions{}),
+			uri:       "/Movies/a b.mkv",
+			expireAt:  1700000000,
+			want:      "_KbZ9Uaeu6NSUF_0yjZyVA",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.signature.SignSecureLink(test.uri, test.expireAt, test.remoteAddr)
+			if err != nil {
+				t.Fatalf("SignSecureLink returned error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("SignSecureLink(%q, %d, %q) = %s, want %s", test.uri, test.expireAt, test.remoteAddr, got, test.want)
+			}
+		})
+	}
+}
+
+// tamperToken rewrites the signed claims of a JSON envelope token, keeping its signature.
+func tamperToken(t *testing.T, token string, mutate func(claims map[string]any)) string {
+	t.Helper()
+	payloadJSON, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+		t.Fatal(err)
+	}
+	data, err := base64.StdEncoding.DecodeString(payload["data"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(data, &claims); err != nil {
+		t.Fatal(err)
+	}
+
+	mutate(claims)
+	if data, err = json.Marshal(claims); err != nil {
+		t.Fatal(err)
+	}
+	payload["data"] = base64.StdEncoding.EncodeToString(data)
+	if payloadJSON, err = json.Marshal(payload); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(payloadJSON)
+}
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	for _, version := range []int{TokenVersionLegacy, TokenVersionV2} {
+		signature := newTestSignature(t, SignatureOptions{Version: version, LegacyGracePeriod: time.Hour})
+		token, err := signature.Sign(testClaims)
+		if err != nil {
+			t.Fatalf("Sign v%d returned error: %v", version, err)
+		}
+
+		claims, err := signature.Verify(token, time.Now())
+		if err != nil {
+			t.Fatalf("Verify v%d returned error: %v", version, err)
+		}
+		if claims.Version != version || claims.ItemId != testClaims.ItemId ||
+			claims.MediaId != testClaims.MediaId || claims.ExpireAt != testClaims.ExpireAt {
+			t.Errorf("Verify v%d returned %+v", version, claims)
+		}
+		if !claims.Matches(testClaims.Path, testClaims.Host) {
+			t.Errorf("v%d token does not match the path and host it was issued for", version)
+		}
+		if version == TokenVersionV2 && claims.Matches(testClaims.Path+"x", testClaims.Host) {
+			t.Error("v2 token matches another path")
+		}
+	}
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	signature := newTestSignature(t, SignatureOptions{Version: TokenVersionV2, NotBefore: true})
+	token, err := signature.Sign(testClaims)
+	if err != nil {
+		t.Fatalf("Sign returned error: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		now   time.Time
+	}{
+		{name: "path", token: tamperToken(t, token, func(c map[string]any) { c["path"] = "/etc/passwd" }), now: time.Now()},
+		{name: "host", token: tamperToken(t, token, func(c map[string]any) { c["host"] = "evil.example.com" }), now: time.Now()},
+		{name: "expiry", token: tamperToken(t, token, func(c map[string]any) { c["expireAt"] = 2000000000 }), now: time.Now()},
+		{name: "signature", token: flipChar(token, len(token)/2), now: time.Now()},
+		{name: "other key", token: mustSign(t, newOtherKeySignature(t), testClaims), now: time.Now()},
+		{name: "expired", token: token, now: time.Unix(testClaims.ExpireAt, 0)},
+		{name: "not yet valid", token: token, now: time.Now().Add(-time.Hour)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := signature.Verify(test.token, test.now); err == nil {
+				t.Error("Verify accepted a tampered token")
+			}
+		})
+	}
+}
+
+func TestVerifyLegacyGracePeriod(t *testing.T) {
+	signature := newTestSignature(t, SignatureOptions{Version: TokenVersionV2, LegacyGracePeriod: time.Hour})
+	token, err := signature.Encrypt(testClaims.ItemId, testClaims.MediaId, testClaims.ExpireAt)
+	if err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	if _, err := signature.Verify(token, time.Now()); err != nil {
+		t.Errorf("Legacy token rejected during the grace period: %v", err)
+	}
+	if _, err := signature.Verify(token, time.Now().Add(2*time.Hour)); err == nil {
+		t.Error("Legacy token accepted after the grace period")
+	}
+}
+
+// newOtherKeySignature returns a Signature whose key differs from the one of newTestSignature.
+func newOtherKeySignature(t *testing.T) *Signature {
+	t.Helper()
+	signature, err := NewSignature("fedcba9876543210", SignatureOptions{Version: TokenVersionV2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+// mustSign signs the claims or fails the test.
+func mustSign(t *testing.T, signature *Signature, claims StreamClaims) string {
+	t.Helper()
+	token, err := signature.Sign(claims)
+	if err != nil {
+		t.Fatalf("Sign returned error: %v", err)
+	}
+	return token
+}
+
+// tokenKeyID returns the key ID announced by a JSON envelope token.
+func tokenKeyID(t *testing.T, token string) string {
+	t.Helper()
+	payloadJSON, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload["kid"]
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey := config.SignatureKeyConfig{ID: "2024-01", Key: "vPQC5LWCN2CW2opz", State: KeyStateActive}
+	newKey := config.SignatureKeyConfig{ID: "2024-06", Key: "Zk3Q8vT1pW6nR2sY", State: KeyStateActive}
+
+	for _, version := range []int{TokenVersionV2, TokenVersionCompact} {
+		signature := newTestSignature(t, SignatureOptions{Version: version})
+		verify := func(token string) error {
+			if version == TokenVersionCompact {
+				claims := urlClaims(testClaims)
+				return signature.VerifyCompact(token, &claims, testNow)
+			}
+			_, err := signature.Verify(token, testNow)
+			return err
+		}
+
+		if err := signature.SetKeys([]config.SignatureKeyConfig{oldKey}); err != nil {
+			t.Fatalf("SetKeys returned error: %v", err)
+		}
+		oldToken := mustSign(t, signature, testClaims)
+
+		// The new key signs, the old one still verifies the links in flight.
+		retired := oldKey
+		retired.State = KeyStateVerify
+		if err := signature.SetKeys([]config.SignatureKeyConfig{retired, newKey}); err != nil {
+			t.Fatalf("SetKeys returned error: %v", err)
+		}
+		newToken := mustSign(t, signature, testClaims)
+		if version == TokenVersionV2 {
+			if kid := tokenKeyID(t, newToken); kid != newKey.ID {
+				t.Errorf("v2 token signed with key %q, want %q", kid, newKey.ID)
+			}
+		}
+		if err := verify(oldToken); err != nil {
+			t.Errorf("v%d token of the verify-only key rejected: %v", version, err)
+		}
+		if err := verify(newToken); err != nil {
+			t.Errorf("v%d token of the active key rejected: %v", version, err)
+		}
+
+		// Once the old key is removed, its tokens no longer verify.
+		if err := signature.SetKeys([]config.SignatureKeyConfig{newKey}); err != nil {
+			t.Fatalf("SetKeys returned error: %v", err)
+		}
+		if err := verify(oldToken); err == nil {
+			t.Errorf("v%d token of a removed key accepted", version)
+		} else if version == TokenVersionV2 && !strings.Contains(err.Error(), "unknown signature key") {
+			t.Errorf("v2 token of a removed key rejected with %v", err)
+		}
+		if err := verify(newToken); err != nil {
+			t.Errorf("v%d token of the active key rejected after the rotation: %v", version, err)
+		}
+	}
+}
+
+func TestKeyIDIsBoundToItsKey(t *testing.T) {
+	signer := newTestSignature(t, SignatureOptions{Version: TokenVersionV2})
+	verifier := newTestSignature(t, SignatureOptions{Version: TokenVersionV2})
+	if err := signer.SetKeys([]config.SignatureKeyConfig{{ID: "2024-06", Key: "Zk3Q8vT1pW6nR2sY"}}); err != nil {
+		t.Fatalf("SetKeys returned error: %v", err)
+	}
+	if err := verifier.SetKeys([]config.SignatureKeyConfig{{ID: "2024-06", Key: "vPQC5LWCN2CW2opz"}}); err != nil {
+		t.Fatalf("SetKeys returned error: %v", err)
+	}
+
+	if _, err := verifier.Verify(mustSign(t, signer, testClaims), testNow); err == nil {
+		t.Error("Verify accepted a token signed with another key of the same ID")
+	}
+}
+
+func TestSetKeysRejectsInvalidKeyrings(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []config.SignatureKeyConfig
+	}{
+		{name: "empty", keys: nil},
+		{name: "missing id", keys: []config.SignatureKeyConfig{{Key: "Zk3Q8vT1pW6nR2sY"}}},
+		{name: "duplicate id", keys: []config.SignatureKeyConfig{
+			{ID: "a", Key: "Zk3Q8vT1pW6nR2sY"},
+			{ID: "a", Key: "vPQC5LWCN2CW2opz", State: KeyStateVerify},
+		}},
+		{name: "no active key", keys: []config.SignatureKeyConfig{{ID: "a", Key: "Zk3Q8vT1pW6nR2sY", State: KeyStateVerify}}},
+		{name: "unsupported state", keys: []config.SignatureKeyConfig{{ID: "a", Key: "Zk3Q8vT1pW6nR2sY", State: "retired"}}},
+		{name: "short key", keys: []config.SignatureKeyConfig{{ID: "a", Key: "short"}}},
+		{name: "unsupported algorithm", keys: []config.SignatureKeyConfig{{ID: "a", Algorithm: "rsa", Key: "Zk3Q8vT1pW6nR2sY"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signature := newTestSignature(t, SignatureOptions{Version: TokenVersionV2})
+			if err := signature.SetKeys(test.keys); err == nil {
+				t.Error("SetKeys accepted an invalid keyring")
+			}
+
+			// The previous keyring stays in place.
+			if _, err := signature.Verify(mustSign(t, signature, testClaims), testNow); err != nil {
+				t.Errorf("Verify returned error after a rejected keyring: %v", err)
+			}
+		})
+	}
+}
+
+// testEd25519Key is an Ed25519 keyring entry with a fixed seed.
+var testEd25519Key = config.SignatureKeyConfig{
+	ID:        "2024-09-ed",
+	Algorithm: KeyAlgorithmEd25519,
+	Key:       "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+	State:     KeyStateActive,
+}
+
+func TestEd25519RoundTrip(t *testing.T) {
+	pair, err := GenerateEd25519KeyPair()
+	if err != nil {
+		t.Fatalf("GenerateEd25519KeyPair returned error: %v", err)
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(pair.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		t.Fatalf("GenerateEd25519KeyPair returned an invalid public key %q", pair.PublicKey)
+	}
+	key := config.SignatureKeyConfig{ID: "generated", Algorithm: KeyAlgorithmEd25519, Key: pair.Seed}
+
+	t.Run("v2", func(t *testing.T) {
+		signature := newTestSignature(t, SignatureOptions{Version: TokenVersionV2})
+		if err := signature.SetKeys([]config.SignatureKeyConfig{key}); err != nil {
+			t.Fatalf("SetKeys returned error: %v", err)
+		}
+		token := mustSign(t, signature, testClaims)
+
+		claims, err := signature.Verify(token, testNow)
+		if err != nil {
+			t.Fatalf("Verify returned error: %v", err)
+		}
+		if !claims.Matches(testClaims.Path, testClaims.Host) {
+			t.Error("Ed25519 token does not match the path and host it was issued for")
+		}
+
+		// Backends only hold the public key.
+		payloadJSON, _ := base64.StdEncoding.DecodeString(token)
+		var payload map[string]string
+		if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := base64.StdEncoding.DecodeString(payload["data"])
+		sig, _ := base64.StdEncoding.DecodeString(payload["signature"])
+		if payload["alg"] != KeyAlgorithmEd25519 || !ed25519.Verify(publicKey, data, sig) {
+			t.Errorf("Token does not verify with the public key, alg %q", payload["alg"])
+		}
+
+		tampered := tamperToken(t, token, func(c map[string]any) { c["path"] = "/etc/passwd" })
+		if _, err := signature.Verify(tampered, testNow); err == nil {
+			t.Error("Verify accepted a tampered Ed25519 token")
+		}
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		signature := newTestSignature(t, SignatureOptions{Version: TokenVersionCompact})
+		if err := signature.SetKeys([]config.SignatureKeyConfig{key}); err != nil {
+			t.Fatalf("SetKeys returned error: %v", err)
+		}
+		token := mustSign(t, signature, testClaims)
+
+		claims := urlClaims(testClaims)
+		if err := signature.VerifyCompact(token, &claims, testNow); err != nil {
+			t.Fatalf("VerifyCompact returned error: %v", err)
+		}
+
+		claims = urlClaims(testClaims)
+		claims.Path += "x"
+		if err := signature.VerifyCompact(token, &claims, testNow); err == nil {
+			t.Error("VerifyCompact accepted an Ed25519 token for another path")
+		}
+		claims = urlClaims(testClaims)
+		if err := signature.VerifyCompact(flipChar(token, compactHeaderSize*4/3+2), &claims, testNow); err == nil {
+			t.Error("VerifyCompact accepted an Ed25519 token with a modified signature")
+		}
+	})
+}
+
+func TestEd25519TokenRequiresEd25519Key(t *testing.T) {
+	// An HMAC key sharing the ID, and so the compact key tag, must not verify Ed25519 tokens.
+	hmacKey := config.SignatureKeyConfig{ID: testEd25519Key.ID, Key: "Zk3Q8vT1pW6nR2sY"}
+
+	for _, version := range []int{TokenVersionV2, TokenVersionCompact} {
+		signer := newTestSignature(t, SignatureOptions{Version: version})
+		verifier := newTestSignature(t, SignatureOptions{Version: version})
+		if err := signer.SetKeys([]config.SignatureKeyConfig{testEd25519Key}); err != nil {
+			t.Fatalf("SetKeys returned error: %v", err)
+		}
+		if err := verifier.SetKeys([]config.SignatureKeyConfig{hmacKey}); err != nil {
+			t.Fatalf("SetKeys returned error: %v", err)
+		}
+		token := mustSign(t, signer, testClaims)
+
+		var err error
+		if version == TokenVersionCompact {
+			claims := urlClaims(testClaims)
+			err = verifier.VerifyCompact(token, &claims, testNow)
+		} else {
+			_, err = verifier.Verify(token, testNow)
+		}
+		if err == nil {
+			t.Errorf("v%d Ed25519 token accepted by an HMAC key", version)
+		}
+	}
+}
+
+func TestSetKeysRejectsInvalidEd25519Seed(t *testing.T) {
+	for _, seed := range []string{"not base64!", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		key := testEd25519Key
+		key.Key = seed
+		signature := newTestSignature(t, SignatureOptions{Version: TokenVersionV2})
+		if err := signature.SetKeys([]config.SignatureKeyConfig{key}); err == nil {
+			t.Errorf("SetKeys accepted the Ed25519 seed %q", seed)
+		}
+	}
+}
+
+func TestSignSecureLinkWithEd25519Keyring(t *testing.T) {
+	hmacKey := config.SignatureKeyConfig{ID: "2024-06", Key: "Zk3Q8vT1pW6nR2sY", State: KeyStateVerify}
+	hmacOnly := newTestSignature(t, SignatureOptions{Version: TokenVersionV2})
+	if err := hmacOnly.SetKeys([]config.SignatureKeyConfig{{ID: hmacKey.ID, Key: hmacKey.Key}}); err != nil {
+		t.Fatalf("SetKeys returned error: %v", err)
+	}
+	want, err := hmacOnly.SignSecureLink("/s/link", 2147483647, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("SignSecureLink returned error: %v", err)
+	}
+
+	// nginx only knows shared secrets: the HMAC key signs even though the Ed25519 key is active.
+	signature := newTestSignature(t, SignatureOptions{Version: TokenVersionV2})
+	if err := signature.SetKeys([]config.SignatureKeyConfig{testEd25519Key, hmacKey}); err != nil {
+		t.Fatalf("SetKeys returned error: %v", err)
+	}
+	got, err := signature.SignSecureLink("/s/link", 2147483647, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("SignSecureLink returned error: %v", err)
+	}
+	if got != want {
+		t.Errorf("SignSecureLink\n got: %s\nwant: %s", got, want)
+	}
+
+	if err := signature.SetKeys([]config.SignatureKeyConfig{testEd25519Key}); err != nil {
+		t.Fatalf("SetKeys returned error: %v", err)
+	}
+	if _, err := signature.SignSecureLink("/s/link", 2147483647, "127.0.0.1"); err == nil {
+		t.Error("SignSecureLink succeeded without an HMAC key")
+	}
+}
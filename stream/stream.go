@@ -3,46 +3,73 @@ package stream
 
 import (
 	"PiliPili_Frontend/api"
+	"PiliPili_Frontend/backend"
 	"PiliPili_Frontend/config"
 	"PiliPili_Frontend/logger"
 	"PiliPili_Frontend/util"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
 	"io"
 	"net/http"
 	"net/url"
-	"os"
-	"strings"
+	"sync"
 	"time"
 )
 
 // Cache instance for avoiding repeated processing.
-var cache *Cache
+var cache Cache
 var globalTimeChecker util.TimeChecker
 
+// cacheGenerations holds the generation of each purged cache scope, see purgeCacheScope.
+// With a Redis cache, the generations are kept in Redis instead.
+// Generations are drawn from a single counter, so that a scope purged again after its generation
+// expired never returns to a generation whose URLs may still be cached.
+var (
+	cacheGenerations     = map[string]cacheGenerationEntry{}
+	cacheGenerationsLast uint64
+	cacheGenerationsMu   sync.RWMutex
+)
+
+// cacheGenerationEntry is the in-memory generation of a cache scope.
+type cacheGenerationEntry struct {
+	generation uint64
+	purgedAt   time.Time // Time of the most recent purge of the scope
+}
+
+// expired reports whether every URL cached before the most recent purge has expired, so that the
+// scope may go back to generation 0 like a generation expiring in Redis.
+// Without a URL lifetime, generations never expire.
+func (e cacheGenerationEntry) expired(now time.Time) bool {
+	lifetime := time.Duration(config.GetConfig().PlayURLMaxAliveTime) * time.Second
+	return lifetime > 0 && !now.Before(e.purgedAt.Add(lifetime))
+}
+
 type RequestParameters struct {
-	EmbyApiKey    string // The API key for authenticating with the Emby server.
-	ItemId        string // The unique identifier of the media item.
-	MediaSourceID string // The identifier of the specific media source.
-	MediaPath     string // The file path to the media.
-	IsSpecialDate bool   // A flag indicating whether the request is for a special date or occasion.
+	EmbyApiKey    string    // The validated client token used for authenticating with the Emby server.
+	UserID        string    // The Emby user that owns the token, empty for the server API key.
+	IsAPIKey      bool      // The token is the configured server API key, which is not bound to a user.
+	DeviceID      string    // The device ID sent by the client, bound into stream tokens so that they can be revoked per device.
+	CacheScope    string    // The prefix isolating this caller's cached URLs from other callers.
+	ClientIP      string    // The client address, bound into nginx secure_link tokens and client-bound stream tokens.
+	ItemId        string    // The unique identifier of the media item.
+	MediaSourceID string    // The identifier of the specific media source.
+	MediaPath     string    // The file path to the media.
+	IsSpecialDate bool      // A flag indicating whether the request is for a special date or occasion.
+	ResolvedAt    time.Time // When the media server was asked for the media path, to cache it against invalidations.
 }
 
-// init initializes global variables such as cache and time checker.
+// init initializes global variables such as the time checker. The cache is created by InitializeCache.
 func init() {
-	var err error
-	cache, err = NewCache(30 * time.Minute)
-	if err != nil {
-		logger.Error("Failed to initialize cache: %v", err)
-		os.Exit(1)
-	}
-
 	globalTimeChecker = util.TimeChecker{}
 	logger.Info("TimeChecker initialized successfully")
 }
 
-// HandleStreamRequest processes client requests and redirects them to a generated streaming URL.
+// HandleStreamRequest processes client requests and redirects them to a generated streaming URL,
+// or streams the backend response itself when the proxy streaming mode applies.
 func HandleStreamRequest(c *gin.Context) {
 	logger.Info("Handling stream request...")
 	logRequestDetails(c)
@@ -57,6 +84,11 @@ func HandleStreamRequest(c *gin.Context) {
 		return // Early exit if parameters are missing.
 	}
 
+	// Make sure the user may see the item before any URL is served or signed.
+	if !authorizeItemAccess(c, requestParameters) {
+		return
+	}
+
 	// Handle cache: Check if a valid streaming URL exists in the cache.
 	if _, found := handleCache(c, requestParameters); found {
 		return
@@ -71,6 +103,12 @@ func HandleStreamRequest(c *gin.Context) {
 		return
 	}
 
+	// Remote URLs and .strm files pointing to them are played without a backend.
+	if target, ok := resolveRemoteTarget(mediaPath); ok {
+		respondWithRemoteTarget(c, target)
+		return
+	}
+
 	// Generate and cache the streaming URL.
 	streamingURL, err := generateAndCacheURL(mediaPath, requestParameters)
 	if err != nil {
@@ -78,65 +116,58 @@ func HandleStreamRequest(c *gin.Context) {
 		return
 	}
 
-	// Redirect the client to the generated streaming URL.
-	logger.Info("Redirecting to streaming URL: %s", streamingURL)
-	c.Header("Location", streamingURL)
-	c.Status(http.StatusFound)
+	// Redirect the client to (or proxy) the generated streaming URL.
+	respondWithStreamingURL(c, streamingURL)
 }
 
 // fetchRequestParameters retrieves parameters from the request or special date configuration.
 func fetchRequestParameters(c *gin.Context) RequestParameters {
 	currentTime := time.Now()
 
-	apiKey := c.Query("api_key")
-	if apiKey == "" {
-		apiKey = config.GetConfig().EmbyAPIKey
-	}
-
-	if apiKey == "" {
-		logger.Error("Missing emby api key")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing emby api key"})
+	// Authenticate the caller against Emby before anything gets signed.
+	identity, ok := authenticateRequest(c)
+	if !ok {
 		return RequestParameters{}
 	}
 
-	logger.Debug("Emby api key: %s", apiKey)
+	logger.Debug("Emby api key: %s, user: %s (%s)", identity.Token, identity.UserName, identity.UserID)
+	parameters := RequestParameters{
+		EmbyApiKey: identity.Token,
+		UserID:     identity.UserID,
+		IsAPIKey:   identity.IsAPIKey,
+		DeviceID:   identity.DeviceID,
+		CacheScope: identity.cacheScope(),
+		ClientIP:   c.ClientIP(),
+	}
 
 	// Check for special date configuration.
 	specialConfig := getMediaForSpecialDate(currentTime)
 	if specialConfig.IsValid() {
 		logger.Info("Special date detected. Using special configuration.")
-		return RequestParameters{
-			apiKey,
-			specialConfig.ItemId,
-			specialConfig.MediaSourceID,
-			specialConfig.MediaPath,
-			true,
-		}
+		parameters.ItemId = specialConfig.ItemId
+		parameters.MediaSourceID = specialConfig.MediaSourceID
+		parameters.MediaPath = specialConfig.MediaPath
+		parameters.IsSpecialDate = true
+		return parameters
 	}
 
 	// Retrieve parameters from the request.
 	itemID := c.Param("itemID")
 	mediaSourceID := c.Query("MediaSourceId")
+	if mediaSourceID == "" && api.IsJellyfin() {
+		// Jellyfin download and universal audio routes omit MediaSourceId; the default source shares the item ID.
+		mediaSourceID = itemID
+	}
 	logger.Debug("ItemID: %s, mediaSourceID: %s", itemID, mediaSourceID)
 	if itemID == "" || mediaSourceID == "" {
 		logger.Error("Missing itemID or MediaSourceId")
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing itemID or MediaSourceId"})
-		return RequestParameters{
-			apiKey,
-			"",
-			"",
-			"",
-			false,
-		}
+		return parameters
 	}
 
-	return RequestParameters{
-		apiKey,
-		itemID,
-		mediaSourceID,
-		"",
-		false,
-	}
+	parameters.ItemId = itemID
+	parameters.MediaSourceID = mediaSourceID
+	return parameters
 }
 
 // getMediaForSpecialDate returns the special media configuration for the current date.
@@ -183,14 +214,19 @@ func getMediaForMissingMedia() config.SpecialMediaConfig {
 }
 
 // handleCache checks the cache for an existing streaming URL.
+// Cached URLs expire before their signature does, so they are only verified again when
+// tokens have been revoked.
 func handleCache(c *gin.Context, parameters RequestParameters) (string, bool) {
-	cacheKey := fmt.Sprintf("%s:%s", parameters.ItemId, parameters.MediaSourceID)
+	cacheKey := buildCacheKey(parameters)
 	if cachedURL, found := cache.Get(cacheKey); found {
 		logger.Info("Cache hit for key: %s", cacheKey)
-		if validateSignature(cachedURL) {
-			logger.Debug("Signature is valid. Redirecting to cached URL: %s", cachedURL)
-			c.Header("Location", cachedURL)
-			c.Status(http.StatusFound)
+		if !isBackendHealthy(cachedURL) {
+			logger.Warn("Cached URL points to an unhealthy backend. Regenerating URL.")
+			return "", false
+		}
+		if !hasRevocations() || validateSignature(cachedURL) {
+			logger.Debug("Signature is valid. Serving cached URL: %s", cachedURL)
+			respondWithStreamingURL(c, cachedURL)
 			return cachedURL, true
 		}
 		logger.Warn("Signature expired or invalid. Regenerating URL.")
@@ -223,18 +259,26 @@ func fetchMediaPathIfNeeded(parameters RequestParameters) (string, error) {
 	return mediaPath, nil
 }
 
-// generateAndCacheURL generates a streaming URL and caches it.
+// generateAndCacheURL routes the media path to a backend, generates a streaming URL and caches it.
 func generateAndCacheURL(mediaPath string, parameters RequestParameters) (string, error) {
-	itemID := parameters.ItemId
-	mediaSourceID := parameters.MediaSourceID
+	route := resolveMediaRoute(resolveLocalStrmPath(mediaPath))
+	logger.Info("Processed media path: %s", route.Path)
 
-	streamingURL, err := generateStreamingURL(mediaPath, itemID, mediaSourceID)
+	streamingURL, expireAt, err := generateStreamingURL(route, parameters)
 	if err != nil {
 		return "", err
 	}
 
-	cacheKey := fmt.Sprintf("%s:%s", itemID, mediaSourceID)
-	if err := cache.Set(cacheKey, streamingURL); err != nil {
+	// URLs bound to the client address must not be served to the same user elsewhere.
+	if route.bindsClientIP() {
+		return streamingURL, nil
+	}
+
+	// The URL leaves the cache a safety margin before it expires, so that clients always get
+	// a URL that stays valid long enough to start playing.
+	cacheKey := buildCacheKey(parameters)
+	margin := time.Duration(config.GetConfig().CacheSafetyMargin) * time.Second
+	if err := cache.SetUntil(cacheKey, streamingURL, expireAt.Add(-margin)); err != nil {
 		logger.Error("Failed to set cache for key %s: %v", cacheKey, err)
 		return "", err
 	}
@@ -242,39 +286,188 @@ func generateAndCacheURL(mediaPath string, parameters RequestParameters) (string
 	return streamingURL, nil
 }
 
-// validateSignature checks if a cached URL's signature is valid and not expired.
-func validateSignature(cachedURL string) bool {
-	signatureStart := "signature="
-	index := strings.Index(cachedURL, signatureStart)
-	if index == -1 {
-		return false
+// buildCacheKey returns the cache key of a streaming URL, scoped to the requesting user so that
+// one user never receives a URL that was signed for another.
+// Tokens carry the device, so URLs are scoped to it as well, and URLs bound to the client network
+// are additionally scoped to that network.
+func buildCacheKey(parameters RequestParameters) string {
+	scope := parameters.CacheScope
+	if generation := cacheGeneration(scope); generation > 0 {
+		scope += fmt.Sprintf("#%d", generation)
 	}
+	cacheKey := fmt.Sprintf("%s:%s:%s:%s", scope, parameters.ItemId, parameters.MediaSourceID, parameters.DeviceID)
+	if network, err := clientNetwork(parameters); err == nil && network != "" {
+		cacheKey += ":" + network
+	}
+	return cacheKey
+}
+
+// purgeCacheScope makes every URL cached for the scope unreachable. Rather than scanning the whole
+// in-memory cache under its lock, the scope moves on to a new generation and the old entries are
+// evicted or expire on their own.
+// With a Redis cache, the generation is shared by every instance, and the old entries are deleted
+// right away to free their memory.
+func purgeCacheScope(scope string) {
+	if redisClient == nil {
+		purgeMemoryCacheScope(scope, time.Now())
+		return
+	}
+
+	// Once the URLs cached before the purge have expired, the generation may expire as well.
+	lifetime := time.Duration(config.GetConfig().PlayURLMaxAliveTime) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if _, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, cacheGenerationKey(scope))
+		if lifetime > 0 {
+			pipe.Expire(ctx, cacheGenerationKey(scope), lifetime)
+		}
+		return nil
+	}); err != nil {
+		logger.Error("Failed to move cached URLs of %s to a new generation in redis: %v", scope, err)
+	}
+
+	if redisCache, ok := cache.(*RedisCache); ok {
+		for _, prefix := range []string{scope + ":", scope + "#"} {
+			if err := redisCache.DeletePrefix(prefix); err != nil {
+				logger.Warn("Failed to purge cached URLs of %s from redis: %v", scope, err)
+			}
+		}
+	}
+}
+
+// purgeMemoryCacheScope moves the scope to a new in-memory generation. Expired generations are
+// dropped along the way, so that the map only holds the scopes purged within the URL lifetime.
+func purgeMemoryCacheScope(scope string, now time.Time) {
+	cacheGenerationsMu.Lock()
+	defer cacheGenerationsMu.Unlock()
+	for purgedScope, entry := range cacheGenerations {
+		if entry.expired(now) {
+			delete(cacheGenerations, purgedScope)
+		}
+	}
+	cacheGenerationsLast++
+	cacheGenerations[scope] = cacheGenerationEntry{generation: cacheGenerationsLast, purgedAt: now}
+}
+
+// cacheGeneration returns the generation of a cache scope, 0 until the scope is purged.
+// A Redis error counts as generation 0, which only reaches entries that a purge deleted.
+func cacheGeneration(scope string) uint64 {
+	if redisClient == nil {
+		return memoryCacheGeneration(scope, time.Now())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	generation, err := redisClient.Get(ctx, cacheGenerationKey(scope)).Uint64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		logger.Warn("Failed to read cache generation of %s from redis: %v", scope, err)
+	}
+	return generation
+}
+
+// memoryCacheGeneration returns the in-memory generation of a cache scope at the given time.
+func memoryCacheGeneration(scope string, now time.Time) uint64 {
+	cacheGenerationsMu.RLock()
+	defer cacheGenerationsMu.RUnlock()
+	entry, ok := cacheGenerations[scope]
+	if !ok || entry.expired(now) {
+		return 0
+	}
+	return entry.generation
+}
 
-	signature := cachedURL[index+len(signatureStart):]
-	signatureInstance, _ := GetSignatureInstance()
-	decoded, err := signatureInstance.Decrypt(signature)
+// cacheGenerationKey returns the Redis key holding the generation of a cache scope.
+func cacheGenerationKey(scope string) string {
+	return redisPrefix + "generation:" + scope
+}
+
+// clientNetwork returns the client network stream tokens of the request are bound to,
+// or an empty string when Signature.bindClientIP is disabled.
+func clientNetwork(parameters RequestParameters) (string, error) {
+	cfg := config.GetConfig()
+	if !cfg.SignatureBindClientIP {
+		return "", nil
+	}
+	return util.ClientNetwork(parameters.ClientIP, cfg.SignatureIPv4Prefix, cfg.SignatureIPv6Prefix)
+}
+
+// isBackendHealthy reports whether the backend a cached URL points to is still in rotation.
+func isBackendHealthy(cachedURL string) bool {
+	pool, err := backend.GetPool()
 	if err != nil {
-		logger.Warn("Failed to decrypt signature: %v", err)
 		return false
 	}
+	return pool.IsHealthyURL(cachedURL)
+}
 
-	expireAt, ok := decoded["expireAt"].(float64)
-	if !ok || int64(expireAt) <= time.Now().Unix() {
-		logger.Warn("Signature expired")
+// validateSignature checks if a cached URL's signature is valid and not expired.
+func validateSignature(cachedURL string) bool {
+	parsedURL, err := url.Parse(cachedURL)
+	if err != nil {
+		logger.Warn("Failed to parse cached URL: %v", err)
 		return false
 	}
 
-	return true
+	// CDN signers may add parameters after the signature, so the query is parsed.
+	query := parsedURL.Query()
+	signature := query.Get("signature")
+	if signature == "" {
+		// Direct links of other backend kinds are valid until the expiry they embed.
+		expireAt, ok := util.ParseURLExpiry(cachedURL)
+		return ok && expireAt.After(time.Now())
+	}
+
+	// The URL may have been signed with the key of a path mapping rule.
+	for _, signatureInstance := range knownSignatures() {
+		if IsCompactToken(signature) {
+			claims := StreamClaims{
+				Path:      query.Get("path"),
+				Host:      parsedURL.Host,
+				ItemId:    query.Get("item"),
+				MediaId:   query.Get("media"),
+				UserId:    query.Get("uid"),
+				ClientNet: query.Get("ip"),
+				DeviceId:  query.Get("did"),
+			}
+			if err = signatureInstance.VerifyCompact(signature, &claims, time.Now()); err == nil {
+				return !isRevoked(&claims, signature)
+			}
+		} else {
+			var claims *StreamClaims
+			if claims, err = signatureInstance.Verify(signature, time.Now()); err == nil {
+				return !isRevoked(claims, signature)
+			}
+		}
+	}
+
+	logger.Warn("Signature expired or invalid: %v", err)
+	return false
 }
 
-// fetchMediaPath retrieves the media path from the Emby server.
+// fetchMediaPath retrieves the media path from the media path cache, or from the media server.
 func fetchMediaPath(parameters RequestParameters) (string, error) {
-	embyAPI := api.NewEmbyAPI()
-	mediaPath, err := embyAPI.GetMediaPath(
-		parameters.EmbyApiKey,
-		parameters.ItemId,
-		parameters.MediaSourceID,
-	)
+	if mediaPath, found := getCachedMediaPath(parameters.ItemId, parameters.MediaSourceID); found {
+		logger.Info("Media path cache hit: %s", mediaPath)
+		return mediaPath, nil
+	}
+
+	// Clients that miss together share one lookup. Each of them has passed its own access check,
+	// so the lookup is made with the server API key rather than the token of whoever came first.
+	var lookup interface{}
+	var err error
+	var shared bool
+	if apiKey := config.GetConfig().EmbyAPIKey; apiKey != "" {
+		lookup, err, shared = mediaPathLookups.Do(mediaSourceKey(parameters.ItemId, parameters.MediaSourceID),
+			func() (interface{}, error) {
+				return lookupMediaPath(apiKey, "", parameters)
+			})
+	}
+	// Without a server API key, or when the media server rejected it, the client asks with its own token.
+	if lookup == nil && (err == nil || api.FailureKind(err) == api.FailureClient) {
+		lookup, err = lookupMediaPath(parameters.EmbyApiKey, parameters.UserID, parameters)
+		shared = false
+	}
 	if err != nil {
 		logger.Error(
 			"Failed to fetch media path for itemID: %s, MediaSourceId: %s. Error: %v",
@@ -282,34 +475,97 @@ func fetchMediaPath(parameters RequestParameters) (string, error) {
 			parameters.MediaSourceID,
 			err,
 		)
+		switch {
+		case api.IsTransient(err):
+			// Emby is down or struggling, a path it resolved earlier is better than no playback.
+			if mediaPath, found := getStaleMediaPath(parameters.ItemId, parameters.MediaSourceID); found {
+				logger.Warn("Serving stale media path of item %s while the media server is unavailable", parameters.ItemId)
+				return mediaPath, nil
+			}
+		case api.FailureKind(err) == api.FailureNotFound:
+			// The item or its media source is gone, so are the files the cache points to.
+			invalidateMediaPaths(parameters.ItemId)
+		}
 		return "", fmt.Errorf("failed to fetch media path")
 	}
-	logger.Info("Fetched original media path: %s", mediaPath)
-
-	backendStorageBasePath := config.GetConfig().BackendStorageBasePath
-	frontendSymlinkBasePath := config.GetConfig().FrontendSymlinkBasePath
-	if backendStorageBasePath != "" && strings.HasPrefix(mediaPath, backendStorageBasePath) {
-		mediaPath = strings.TrimPrefix(mediaPath, backendStorageBasePath)
-		mediaPath = strings.TrimPrefix(mediaPath, "/")
-	} else if frontendSymlinkBasePath != "" && strings.HasPrefix(mediaPath, frontendSymlinkBasePath) {
-		mediaPath = strings.TrimPrefix(mediaPath, frontendSymlinkBasePath)
-		mediaPath = strings.TrimPrefix(mediaPath, "/")
+	mediaPath := lookup.(string)
+	if shared {
+		logger.Info("Fetched original media path with a coalesced lookup: %s", mediaPath)
+	} else {
+		logger.Info("Fetched original media path: %s", mediaPath)
 	}
+	return mediaPath, nil
+}
 
-	logger.Info("Processed media path: %s", mediaPath)
+// lookupMediaPath asks the media server for the path of the media source with the given credentials
+// and caches it, as of the time the media server was asked.
+func lookupMediaPath(apiKey, userID string, parameters RequestParameters) (interface{}, error) {
+	requestedAt := time.Now()
+	mediaPath, err := api.NewMediaServer().GetMediaPath(apiKey, userID, parameters.ItemId, parameters.MediaSourceID)
+	if err != nil {
+		return nil, err
+	}
+	cacheMediaPath(parameters.ItemId, parameters.MediaSourceID, mediaPath, requestedAt)
 	return mediaPath, nil
 }
 
-// generateStreamingURL creates a signed streaming URL with a signature.
-func generateStreamingURL(mediaPath, itemID, mediaSourceID string) (string, error) {
+// generateStreamingURL creates a signed streaming URL with a signature and returns it with its expiry.
+// Routes of other backend kinds fall back to their PiliPili route when the kind fails.
+func generateStreamingURL(route mediaRoute, parameters RequestParameters) (string, time.Time, error) {
+	if route.Kind == BackendKindAlist {
+		rawURL, expireAt, err := generateAlistURL(route)
+		if err == nil {
+			return rawURL, expireAt, nil
+		}
+		logger.Warn("Failed to resolve Alist link for %s, falling back to the backend: %v", route.Path, err)
+		route = *route.Fallback
+	}
+	if route.Kind == BackendKindS3 {
+		return generateS3URL(route)
+	}
+	if route.Kind == BackendKindNginx {
+		return generateNginxURL(route, parameters.ClientIP)
+	}
+
+	itemID := parameters.ItemId
+	mediaSourceID := parameters.MediaSourceID
+	userID := parameters.UserID
+
 	cfg := config.GetConfig()
-	signatureInstance, _ := GetSignatureInstance()
+	pool, err := backend.GetPool()
+	if err != nil {
+		logger.Error("Failed to get backend pool: %v", err)
+		return "", time.Time{}, fmt.Errorf("failed to generate signed URL")
+	}
+	selectedBackend := pool.Select(route.Backends...)
+	if selectedBackend == nil {
+		logger.Error("No backend configured for media path %s", route.Path)
+		return "", time.Time{}, fmt.Errorf("failed to generate signed URL")
+	}
+
+	network, err := clientNetwork(parameters)
+	if err != nil {
+		logger.Error("Failed to bind stream token to client %s: %v", parameters.ClientIP, err)
+		return "", time.Time{}, fmt.Errorf("failed to generate signed URL")
+	}
+
+	mediaPath := route.Path
 	expireAt := time.Now().Unix() + int64(cfg.PlayURLMaxAliveTime)
-	signature, err := signatureInstance.Encrypt(itemID, mediaSourceID, expireAt)
+	signature, err := route.Signature.Sign(StreamClaims{
+		ItemId:    itemID,
+		MediaId:   mediaSourceID,
+		Path:      mediaPath,
+		Host:      selectedBackend.Host,
+		UserId:    userID,
+		DeviceId:  parameters.DeviceID,
+		ClientNet: network,
+		ExpireAt:  expireAt,
+	})
 	logger.Debug(
-		"Generated signature: itemID: %s, mediaSourceID %s, expireAt %d, signature %s, mediaPath: %s",
+		"Generated signature: itemID: %s, mediaSourceID %s, userID %s, expireAt %d, signature %s, mediaPath: %s",
 		itemID,
 		mediaSourceID,
+		userID,
 		expireAt,
 		signature,
 		mediaPath,
@@ -322,16 +578,34 @@ func generateStreamingURL(mediaPath, itemID, mediaSourceID string) (string, erro
 			mediaSourceID,
 			err,
 		)
-		return "", fmt.Errorf("failed to generate signed URL")
+		return "", time.Time{}, fmt.Errorf("failed to generate signed URL")
 	}
-	streamingURL := fmt.Sprintf(
-		"%s?path=%s&signature=%s",
-		config.GetFullBackendURL(),
-		url.QueryEscape(mediaPath),
-		signature,
-	)
-	logger.Info("Generated streaming URL: %s", streamingURL)
-	return streamingURL, nil
+	// Encrypted paths only travel inside the token.
+	query := "path=" + url.QueryEscape(mediaPath) + "&"
+	if route.Signature.EncryptsPath() {
+		query = ""
+	}
+	streamingURL := fmt.Sprintf("%s?%ssignature=%s", selectedBackend.URL, query, url.QueryEscape(signature))
+	if IsCompactToken(signature) {
+		// Compact tokens only carry the MAC, the other signed claims travel next to the path.
+		query += "item=" + url.QueryEscape(itemID) + "&media=" + url.QueryEscape(mediaSourceID)
+		if userID != "" {
+			query += "&uid=" + url.QueryEscape(userID)
+		}
+		if network != "" {
+			query += "&ip=" + url.QueryEscape(network)
+		}
+		if parameters.DeviceID != "" {
+			query += "&did=" + url.QueryEscape(parameters.DeviceID)
+		}
+		streamingURL = fmt.Sprintf("%s?%s&signature=%s", selectedBackend.URL, query, signature)
+	}
+	if streamingURL, err = selectedBackend.SignURL(streamingURL, time.Unix(expireAt, 0)); err != nil {
+		logger.Error("Failed to sign streaming URL for backend %s: %v", selectedBackend.Name, err)
+		return "", time.Time{}, fmt.Errorf("failed to generate signed URL")
+	}
+	logger.Info("Generated streaming URL: %s (token ID %s)", streamingURL, TokenID(signature))
+	return streamingURL, time.Unix(expireAt, 0), nil
 }
 
 // logRequestDetails logs request headers and body for debugging purposes.
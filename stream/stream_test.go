@@ -0,0 +1,318 @@
+package stream
+
+import (
+	"PiliPili_Frontend/api"
+	"PiliPili_Frontend/backend"
+	"PiliPili_Frontend/config"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useTestConfig applies mutate to a copy of the configuration for the duration of the test.
+func useTestConfig(t *testing.T, mutate func(cfg *config.Config)) {
+	t.Helper()
+	previous := config.GetConfig()
+	cfg := previous
+	mutate(&cfg)
+	config.SetConfig(cfg)
+	t.Cleanup(func() { config.SetConfig(previous) })
+}
+
+// useTestMediaServer points the configuration at a fake Emby answering with handler.
+// Media server requests are not retried and the circuit breaker is disabled.
+func useTestMediaServer(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	// Registered before the configuration is replaced, so that it runs once it is restored.
+	t.Cleanup(func() { api.InitializeMediaServerClient() })
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(serverURL.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestConfig(t, func(cfg *config.Config) {
+		cfg.MediaServerType = "emby"
+		cfg.EmbyURL = "http://" + serverURL.Hostname()
+		cfg.EmbyPort = port
+		cfg.EmbyAPIKey = "server-key"
+		cfg.EmbyRetries = 0
+		cfg.EmbyBreakerThreshold = 0
+	})
+	if err := api.InitializeMediaServerClient(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writePlaybackInfo answers a PlaybackInfo request with one media source.
+func writePlaybackInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"MediaSources":[{"Id":%q,"Path":"/media/movie.mkv"}]}`, r.URL.Query().Get("MediaSourceId"))
+}
+
+func TestFetchMediaPathCoalescesBurst(t *testing.T) {
+	var calls atomic.Int32
+	useTestMediaServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Query().Get("api_key") != "server-key" || r.URL.Query().Get("UserId") != "" {
+			t.Errorf("Coalesced lookup was made with client credentials: %s", r.URL.RawQuery)
+		}
+		time.Sleep(100 * time.Millisecond)
+		writePlaybackInfo(w, r)
+	})
+	useTestMediaPathCache(t, time.Hour)
+
+	const clients = 100
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			mediaPath, err := fetchMediaPath(RequestParameters{
+				EmbyApiKey:    "client-" + strconv.Itoa(i),
+				UserID:        "user-" + strconv.Itoa(i),
+				ItemId:        "item1",
+				MediaSourceID: "source1",
+			})
+			if err != nil || mediaPath != "/media/movie.mkv" {
+				t.Errorf("Client %d got %q, %v", i, mediaPath, err)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("%d clients made %d media server lookups, want 1", clients, got)
+	}
+}
+
+func TestFetchMediaPathDoesNotShareRejectedKey(t *testing.T) {
+	var clientCalls atomic.Int32
+	useTestMediaServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("api_key") == "server-key" {
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		clientCalls.Add(1)
+		writePlaybackInfo(w, r)
+	})
+	useTestMediaPathCache(t, time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mediaPath, err := fetchMediaPath(RequestParameters{
+				EmbyApiKey:    "client-" + strconv.Itoa(i),
+				UserID:        "user-" + strconv.Itoa(i),
+				ItemId:        "item1",
+				MediaSourceID: "source" + strconv.Itoa(i%2),
+			})
+			if err != nil || mediaPath != "/media/movie.mkv" {
+				t.Errorf("Client %d got %q, %v after the server API key was rejected", i, mediaPath, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if clientCalls.Load() == 0 {
+		t.Error("No client retried the lookup with its own token")
+	}
+}
+
+// useTestStreamHandler serves HandleStreamRequest behind the trusted proxy 127.0.0.1 the way main
+// does. Tokens of the given version are bound to the client's /24 or /64 network.
+// The fake Emby knows the token "user-token" and the item "allowed".
+func useTestStreamHandler(t *testing.T, version int) *gin.Engine {
+	t.Helper()
+	useTestMediaServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/Items/allowed/PlaybackInfo" && r.URL.Query().Get("api_key") == "server-key" {
+			writePlaybackInfo(w, r)
+			return
+		}
+		switch {
+		case r.Header.Get("X-Emby-Token") != "user-token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/Users/Me":
+			fmt.Fprint(w, `{"Id":"user-id","Name":"alice"}`)
+		case r.URL.Path == "/Users/user-id/Items/allowed":
+			fmt.Fprint(w, `{"Id":"allowed"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	useTestMediaPathCache(t, time.Hour)
+	if err := useTestPathMappings(t); err != nil {
+		t.Fatal(err)
+	}
+	signatureInstance = newTestSignature(t, SignatureOptions{Version: version})
+	useTestConfig(t, func(cfg *config.Config) {
+		cfg.PlayURLMaxAliveTime = 3600
+		cfg.SignatureBindClientIP = true
+		cfg.SignatureIPv4Prefix = 24
+		cfg.SignatureIPv6Prefix = 64
+		cfg.ServerTrustedProxies = []string{"127.0.0.1"}
+		cfg.ServerRemoteIPHeaders = []string{"X-Forwarded-For", "X-Real-IP"}
+	})
+
+	previousPool, _ := backend.GetPool()
+	pool, err := backend.NewPool([]*backend.Backend{{Name: "hk", URL: "https://hk.example.com/stream"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.SetPool(pool)
+	previousCache := cache
+	cache = NewLRUCache(1<<20, time.Hour)
+	t.Cleanup(func() { backend.SetPool(previousPool); cache = previousCache })
+
+	cfg := config.GetConfig()
+	r := gin.New()
+	r.RemoteIPHeaders = cfg.ServerRemoteIPHeaders
+	if err := r.SetTrustedProxies(cfg.ServerTrustedProxies); err != nil {
+		t.Fatal(err)
+	}
+	r.GET("/videos/:itemID/stream", HandleStreamRequest)
+	return r
+}
+
+// requestStream requests the stream of the item "allowed" from remoteAddr and returns the
+// streaming URL the client is redirected to.
+func requestStream(t *testing.T, r *gin.Engine, remoteAddr string, headers map[string]string) *url.URL {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/videos/allowed/stream?MediaSourceId=source1&api_key=user-token", nil)
+	req.RemoteAddr = remoteAddr
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("Stream request answered %d: %s", recorder.Code, recorder.Body.String())
+	}
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func TestHandleStreamRequestBindsClientNetwork(t *testing.T) {
+	r := useTestStreamHandler(t, TokenVersionV2)
+
+	// The tests share the URL cache, so a URL bound to one network must not be served to another.
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		wantNet    string
+		sameIP     string // Another address of the bound network
+		otherIP    string // Address outside the bound network
+	}{
+		{name: "direct client", remoteAddr: "203.0.113.7:50000", wantNet: "203.0.113.0/24", sameIP: "203.0.113.42", otherIP: "198.51.100.9"},
+		{
+			name:       "spoofed X-Forwarded-For",
+			remoteAddr: "203.0.113.7:50000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.9"},
+			wantNet:    "203.0.113.0/24",
+			sameIP:     "203.0.113.42",
+			otherIP:    "198.51.100.9",
+		},
+		{
+			name:       "spoofed X-Real-IP",
+			remoteAddr: "203.0.113.7:50000",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.9"},
+			wantNet:    "203.0.113.0/24",
+			sameIP:     "203.0.113.42",
+			otherIP:    "198.51.100.9",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "127.0.0.1:50000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.9"},
+			wantNet:    "198.51.100.0/24",
+			sameIP:     "198.51.100.42",
+			otherIP:    "203.0.113.7",
+		},
+		{
+			name:       "trusted proxy behind a spoofed hop",
+			remoteAddr: "127.0.0.1:50000",
+			headers:    map[string]string{"X-Forwarded-For": "10.0.0.1, 198.51.100.9"},
+			wantNet:    "198.51.100.0/24",
+			sameIP:     "198.51.100.42",
+			otherIP:    "10.0.0.1",
+		},
+		{name: "ipv6 client", remoteAddr: "[2001:db8:1:2::5]:50000", wantNet: "2001:db8:1:2::/64", sameIP: "2001:db8:1:2::42", otherIP: "2001:db8:1:3::5"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			location := requestStream(t, r, test.remoteAddr, test.headers)
+			claims, err := signatureInstance.Verify(location.Query().Get("signature"), time.Now())
+			if err != nil {
+				t.Fatalf("Verify returned error: %v", err)
+			}
+			if claims.ClientNet != test.wantNet {
+				t.Errorf("Token is bound to\n got: %s\nwant: %s", claims.ClientNet, test.wantNet)
+			}
+			if !claims.AllowsClient(test.sameIP) {
+				t.Errorf("Token bound to %s rejects %s", claims.ClientNet, test.sameIP)
+			}
+			if claims.AllowsClient(test.otherIP) {
+				t.Errorf("Token bound to %s allows %s", claims.ClientNet, test.otherIP)
+			}
+		})
+	}
+}
+
+func TestHandleStreamRequestBindsCompactTokens(t *testing.T) {
+	r := useTestStreamHandler(t, TokenVersionCompact)
+
+	location := requestStream(t, r, "203.0.113.7:50000", map[string]string{"X-Forwarded-For": "198.51.100.9"})
+	query := location.Query()
+	if query.Get("ip") != "203.0.113.0/24" {
+		t.Fatalf("Compact URL is bound to %q, want the peer network 203.0.113.0/24", query.Get("ip"))
+	}
+
+	claims := StreamClaims{
+		ItemId:    query.Get("item"),
+		MediaId:   query.Get("media"),
+		Path:      query.Get("path"),
+		Host:      location.Host,
+		UserId:    query.Get("uid"),
+		ClientNet: query.Get("ip"),
+	}
+	if err := signatureInstance.VerifyCompact(query.Get("signature"), &claims, time.Now()); err != nil {
+		t.Fatalf("VerifyCompact returned error: %v", err)
+	}
+
+	// A client replaying the URL from another network cannot rebind it.
+	claims = StreamClaims{
+		ItemId:    query.Get("item"),
+		MediaId:   query.Get("media"),
+		Path:      query.Get("path"),
+		Host:      location.Host,
+		UserId:    query.Get("uid"),
+		ClientNet: "198.51.100.0/24",
+	}
+	if err := signatureInstance.VerifyCompact(query.Get("signature"), &claims, time.Now()); err == nil {
+		t.Error("VerifyCompact accepted the token for another network")
+	}
+}
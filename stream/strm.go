@@ -0,0 +1,171 @@
+// Package stream handles processing of media streams.
+package stream
+
+import (
+	"PiliPili_Frontend/config"
+	"PiliPili_Frontend/logger"
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxStrmFileSize bounds how much of a .strm file is read.
+const maxStrmFileSize = 64 * 1024
+
+// remoteRewrite is a compiled RemoteRewriteConfig.
+type remoteRewrite struct {
+	rule  config.RemoteRewriteConfig
+	regex *regexp.Regexp
+}
+
+// remoteTarget describes a media file that is played straight from a remote URL instead of a backend.
+type remoteTarget struct {
+	URL     string      // URL the client is sent to
+	Headers http.Header // Headers added to the upstream request when the target is proxied
+	Proxy   bool        // Whether the target must always be proxied
+}
+
+// remoteRewrites holds the compiled Frontend.strmRewrites in configuration order.
+var remoteRewrites []remoteRewrite
+
+// InitializeStrm compiles the rewrite rules of remote targets.
+// Headers can only be added to proxied requests, so rules with headers always proxy.
+func InitializeStrm() error {
+	var rewrites []remoteRewrite
+	for i, rule := range config.GetConfig().StrmRewrites {
+		regex, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return fmt.Errorf("strm rewrite %d has an invalid match: %w", i, err)
+		}
+		if len(rule.Headers) > 0 && !rule.Proxy {
+			logger.Info("Strm rewrite %d sets headers, its targets are always proxied", i)
+			rule.Proxy = true
+		}
+		rewrites = append(rewrites, remoteRewrite{rule: rule, regex: regex})
+	}
+
+	remoteRewrites = rewrites
+	return nil
+}
+
+// resolveRemoteTarget reports whether the media path reported by Emby points to a remote URL,
+// either directly or through the contents of a .strm file, and returns the rewritten target.
+func resolveRemoteTarget(mediaPath string) (remoteTarget, bool) {
+	target := mediaPath
+	if isStrmFile(mediaPath) {
+		contents, err := readStrmFile(mediaPath)
+		if err != nil {
+			logger.Warn("Failed to read strm file %s: %v", mediaPath, err)
+			return remoteTarget{}, false
+		}
+		logger.Info("Strm file %s points to: %s", mediaPath, contents)
+		target = contents
+	}
+
+	if !isRemoteURL(target) {
+		return remoteTarget{}, false
+	}
+
+	return rewriteRemoteTarget(target), true
+}
+
+// resolveLocalStrmPath returns the path a .strm file points to when it holds a local path,
+// so that it can be routed to a backend like any other media file.
+func resolveLocalStrmPath(mediaPath string) string {
+	if !isStrmFile(mediaPath) {
+		return mediaPath
+	}
+
+	contents, err := readStrmFile(mediaPath)
+	if err != nil || isRemoteURL(contents) || contents == "" {
+		return mediaPath
+	}
+	return contents
+}
+
+// rewriteRemoteTarget applies the first matching rewrite rule to the remote URL.
+// Templates support regex groups ($1) and the {scheme}, {host}, {path} and {query} placeholders.
+func rewriteRemoteTarget(rawURL string) remoteTarget {
+	for _, rewrite := range remoteRewrites {
+		match := rewrite.regex.FindStringSubmatchIndex(rawURL)
+		if match == nil {
+			continue
+		}
+
+		target := remoteTarget{URL: rawURL, Headers: http.Header{}, Proxy: rewrite.rule.Proxy}
+		if rewrite.rule.Template != "" {
+			expanded := string(rewrite.regex.ExpandString(nil, rewrite.rule.Template, rawURL, match))
+			target.URL = expandURLPlaceholders(expanded, rawURL)
+		}
+		for key, value := range rewrite.rule.Headers {
+			target.Headers.Set(key, value)
+		}
+
+		logger.Debug("Remote URL %s rewritten to %s", rawURL, target.URL)
+		return target
+	}
+
+	return remoteTarget{URL: rawURL}
+}
+
+// expandURLPlaceholders replaces the {scheme}, {host}, {path} and {query} placeholders
+// with the parts of the original URL.
+func expandURLPlaceholders(template, rawURL string) string {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return template
+	}
+
+	return strings.NewReplacer(
+		"{scheme}", parsedURL.Scheme,
+		"{host}", parsedURL.Host,
+		"{path}", parsedURL.EscapedPath(),
+		"{query}", parsedURL.RawQuery,
+	).Replace(template)
+}
+
+// isRemoteURL reports whether the path is an http(s) URL.
+func isRemoteURL(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// isStrmFile reports whether the path is a .strm file under the frontend symlink base path.
+func isStrmFile(path string) bool {
+	basePath := config.GetConfig().FrontendSymlinkBasePath
+	if basePath == "" || !strings.EqualFold(filepath.Ext(path), ".strm") {
+		return false
+	}
+
+	cleaned := filepath.Clean(path)
+	return strings.HasPrefix(cleaned, filepath.Clean(basePath)+string(filepath.Separator))
+}
+
+// readStrmFile returns the first non-empty, non-comment line of a .strm file.
+func readStrmFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if err := file.Close(); err != nil {
+			logger.Error("Failed to close strm file: %v", err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(io.LimitReader(file, maxStrmFileSize))
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return line, nil
+		}
+	}
+	return "", scanner.Err()
+}
@@ -0,0 +1,171 @@
+package stream
+
+import (
+	"PiliPili_Frontend/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTestStrm compiles the rewrite rules and returns a symlink base path holding the given .strm files.
+func useTestStrm(t *testing.T, files map[string]string, rules ...config.RemoteRewriteConfig) string {
+	t.Helper()
+	basePath := t.TempDir()
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(basePath, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	useTestConfig(t, func(cfg *config.Config) {
+		cfg.FrontendSymlinkBasePath = basePath
+		cfg.StrmRewrites = rules
+	})
+	previous := remoteRewrites
+	t.Cleanup(func() { remoteRewrites = previous })
+	if err := InitializeStrm(); err != nil {
+		t.Fatalf("InitializeStrm returned error: %v", err)
+	}
+	return basePath
+}
+
+func TestReadStrmFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     string
+	}{
+		{name: "single line", contents: "https://cdn.example.com/movie.mkv", want: "https://cdn.example.com/movie.mkv"},
+		{name: "trailing newline", contents: "https://cdn.example.com/movie.mkv\r\n", want: "https://cdn.example.com/movie.mkv"},
+		{name: "byte order mark", contents: "\ufeffhttps://cdn.example.com/movie.mkv", want: "https://cdn.example.com/movie.mkv"},
+		{
+			name:     "comments and blank lines",
+			contents: "#EXTM3U\n\n  # Source: alist\n  /mnt/anime/movie.mkv  \nhttps://ignored.example.com\n",
+			want:     "/mnt/anime/movie.mkv",
+		},
+		{name: "empty", contents: "\n# nothing\n", want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "movie.strm")
+			if err := os.WriteFile(path, []byte(test.contents), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readStrmFile(path)
+			if err != nil {
+				t.Fatalf("readStrmFile returned error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("readStrmFile(%q)\n got: %q\nwant: %q", test.contents, got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveRemoteTarget(t *testing.T) {
+	basePath := useTestStrm(t, map[string]string{
+		"remote.strm": "https://cdn.example.com/movie.mkv\n",
+		"local.strm":  "/mnt/anime/movie.mkv\n",
+		"empty.STRM":  "# nothing\n",
+	})
+	outside := filepath.Join(t.TempDir(), "outside.strm")
+	if err := os.WriteFile(outside, []byte("https://cdn.example.com/outside.mkv"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		mediaPath string
+		wantURL   string // Empty when the media path is not remote
+		wantLocal string // Path resolveLocalStrmPath routes to a backend
+	}{
+		{name: "remote url", mediaPath: "https://cdn.example.com/movie.mkv", wantURL: "https://cdn.example.com/movie.mkv"},
+		{name: "uppercase scheme", mediaPath: "HTTP://cdn.example.com/movie.mkv", wantURL: "HTTP://cdn.example.com/movie.mkv"},
+		{name: "local file", mediaPath: "/mnt/anime/movie.mkv", wantLocal: "/mnt/anime/movie.mkv"},
+		{name: "strm with url", mediaPath: filepath.Join(basePath, "remote.strm"), wantURL: "https://cdn.example.com/movie.mkv"},
+		{name: "strm with local path", mediaPath: filepath.Join(basePath, "local.strm"), wantLocal: "/mnt/anime/movie.mkv"},
+		{name: "empty strm", mediaPath: filepath.Join(basePath, "empty.STRM"), wantLocal: filepath.Join(basePath, "empty.STRM")},
+		{name: "missing strm", mediaPath: filepath.Join(basePath, "missing.strm"), wantLocal: filepath.Join(basePath, "missing.strm")},
+		{name: "strm outside the base path", mediaPath: outside, wantLocal: outside},
+		{
+			name:      "strm escaping the base path",
+			mediaPath: basePath + "/../" + filepath.Base(filepath.Dir(outside)) + "/outside.strm",
+			wantLocal: basePath + "/../" + filepath.Base(filepath.Dir(outside)) + "/outside.strm",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, ok := resolveRemoteTarget(test.mediaPath)
+			if ok != (test.wantURL != "") || target.URL != test.wantURL {
+				t.Errorf("resolveRemoteTarget(%q)\n got: %q (remote %v)\nwant: %q", test.mediaPath, target.URL, ok, test.wantURL)
+			}
+			if test.wantLocal == "" {
+				return
+			}
+			if got := resolveLocalStrmPath(test.mediaPath); got != test.wantLocal {
+				t.Errorf("resolveLocalStrmPath(%q)\n got: %s\nwant: %s", test.mediaPath, got, test.wantLocal)
+			}
+		})
+	}
+}
+
+func TestRewriteRemoteTarget(t *testing.T) {
+	useTestStrm(t, nil,
+		config.RemoteRewriteConfig{Match: `^https?://alist\.lan(:\d+)?/d/(.*)$`, Template: "https://alist.example.com/d/$2"},
+		config.RemoteRewriteConfig{Match: `^https://pan\.example\.com/`, Template: "{scheme}://mirror.example.com{path}?{query}&via={host}"},
+		config.RemoteRewriteConfig{Match: `^https://referer\.example\.com/`, Headers: map[string]string{"Referer": "https://referer.example.com/"}},
+		config.RemoteRewriteConfig{Match: `^https://proxied\.example\.com/`, Proxy: true},
+		// Never reached, the first matching rule decides.
+		config.RemoteRewriteConfig{Match: `^https://pan\.example\.com/`, Template: "https://shadowed.example.com/"},
+	)
+
+	tests := []struct {
+		name        string
+		rawURL      string
+		wantURL     string
+		wantReferer string
+		wantProxy   bool
+	}{
+		{name: "regex groups", rawURL: "http://alist.lan:5244/d/anime/a b.mkv", wantURL: "https://alist.example.com/d/anime/a b.mkv"},
+		{
+			name:    "placeholders",
+			rawURL:  "https://pan.example.com/share/a%20b.mkv?sign=abc",
+			wantURL: "https://mirror.example.com/share/a%20b.mkv?sign=abc&via=pan.example.com",
+		},
+		{
+			name:        "headers force the proxy",
+			rawURL:      "https://referer.example.com/movie.mkv",
+			wantURL:     "https://referer.example.com/movie.mkv",
+			wantReferer: "https://referer.example.com/",
+			wantProxy:   true,
+		},
+		{name: "proxy", rawURL: "https://proxied.example.com/movie.mkv", wantURL: "https://proxied.example.com/movie.mkv", wantProxy: true},
+		{name: "no match", rawURL: "https://cdn.example.com/movie.mkv", wantURL: "https://cdn.example.com/movie.mkv"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := rewriteRemoteTarget(test.rawURL)
+			if target.URL != test.wantURL {
+				t.Errorf("rewriteRemoteTarget(%q)\n got: %s\nwant: %s", test.rawURL, target.URL, test.wantURL)
+			}
+			if target.Proxy != test.wantProxy || target.Headers.Get("Referer") != test.wantReferer {
+				t.Errorf("rewriteRemoteTarget(%q) proxies %v with Referer %q, want %v with %q",
+					test.rawURL, target.Proxy, target.Headers.Get("Referer"), test.wantProxy, test.wantReferer)
+			}
+		})
+	}
+}
+
+func TestInitializeStrmRejectsInvalidMatch(t *testing.T) {
+	useTestConfig(t, func(cfg *config.Config) {
+		cfg.StrmRewrites = []config.RemoteRewriteConfig{{Match: `^https://(`}}
+	})
+	previous := remoteRewrites
+	t.Cleanup(func() { remoteRewrites = previous })
+	if err := InitializeStrm(); err == nil {
+		t.Error("InitializeStrm accepted an invalid match")
+	}
+}
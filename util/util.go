@@ -3,8 +3,11 @@ package util
 
 import (
 	"fmt"
+	"net/netip"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // BuildFullURL constructs a complete URL with an optional port.
@@ -36,3 +39,63 @@ func BuildFullURL(baseURL string, port int) string {
 
 	return parsedURL.String()
 }
+
+// ExtractHost returns the host (including the port, if present) of the given URL.
+// An empty string is returned if the URL cannot be parsed.
+func ExtractHost(rawURL string) string {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return parsedURL.Host
+}
+
+// ParseURLExpiry returns the expiry time embedded in a presigned URL, if it carries one.
+// It understands the Expires parameter of S3 v2 / OSS / CloudFront URLs, the X-Amz-Date and
+// X-Amz-Expires parameters of S3 v4 URLs, the x-oss-expires parameter of OSS v4 URLs and the
+// expires parameter of nginx secure links.
+func ParseURLExpiry(rawURL string) (time.Time, bool) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return time.Time{}, false
+	}
+	query := parsedURL.Query()
+
+	for _, key := range []string{"Expires", "expires", "x-oss-expires"} {
+		if value := query.Get(key); value != "" {
+			if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return time.Unix(seconds, 0), true
+			}
+		}
+	}
+
+	if date, expires := query.Get("X-Amz-Date"), query.Get("X-Amz-Expires"); date != "" && expires != "" {
+		signedAt, err := time.Parse("20060102T150405Z", date)
+		seconds, convErr := strconv.Atoi(expires)
+		if err == nil && convErr == nil {
+			return signedAt.Add(time.Duration(seconds) * time.Second), true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// ClientNetwork returns the network of a client address in CIDR notation, masked to ipv4Prefix
+// or ipv6Prefix bits depending on the address family. IPv4-mapped IPv6 addresses count as IPv4.
+func ClientNetwork(clientIP string, ipv4Prefix, ipv6Prefix int) (string, error) {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return "", fmt.Errorf("invalid client IP %q: %w", clientIP, err)
+	}
+	addr = addr.Unmap().WithZone("")
+
+	bits := ipv6Prefix
+	if addr.Is4() {
+		bits = ipv4Prefix
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return "", err
+	}
+	return prefix.String(), nil
+}